@@ -0,0 +1,60 @@
+package client
+
+import (
+	"encoding/pem"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	"github.com/prantlf/ovai/internal/web"
+)
+
+func StartStub() (*httptest.Server, web.ClientConfig) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"totalTokens":1}`))
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+
+	caFile := filepath.Join(os.TempDir(), "ovai-bench-ca.pem")
+	caPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(caFile, caPem, 0o644); err != nil {
+		log.Fatalf("writing certificate failed: %v", err)
+	}
+	config := web.DefaultClientConfig()
+	config.CAFiles = []string{caFile}
+	return server, config
+}
+
+func NewClient(config web.ClientConfig) *http.Client {
+	client, err := web.NewClient(config)
+	if err != nil {
+		log.Fatalf("creating client failed: %v", err)
+	}
+	return client
+}
+
+func Request(client *http.Client, url string) {
+	res, err := client.Get(url)
+	if err != nil {
+		log.Fatalf("making request failed: %v", err)
+	}
+	if _, err := io.Copy(io.Discard, res.Body); err != nil {
+		log.Fatalf("reading response failed: %v", err)
+	}
+	if err := res.Body.Close(); err != nil {
+		log.Fatalf("closing response failed: %v", err)
+	}
+}
+
+// RequestWithNewClient simulates creating a client with a new transport for
+// each request, which was done before, when the network was enforced.
+func RequestWithNewClient(config web.ClientConfig, url string) {
+	client := NewClient(config)
+	Request(client, url)
+	client.CloseIdleConnections()
+}
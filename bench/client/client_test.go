@@ -0,0 +1,47 @@
+package client
+
+import (
+	"testing"
+)
+
+func BenchmarkSharedClient(b *testing.B) {
+	server, config := StartStub()
+	defer server.Close()
+	client := NewClient(config)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		Request(client, server.URL)
+	}
+}
+
+func BenchmarkSharedClientHTTP1(b *testing.B) {
+	server, config := StartStub()
+	defer server.Close()
+	config.HTTP2 = false
+	client := NewClient(config)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		Request(client, server.URL)
+	}
+}
+
+func BenchmarkNewClientPerRequest(b *testing.B) {
+	server, config := StartStub()
+	defer server.Close()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		RequestWithNewClient(config, server.URL)
+	}
+}
+
+func BenchmarkSharedClientParallel(b *testing.B) {
+	server, config := StartStub()
+	defer server.Close()
+	client := NewClient(config)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			Request(client, server.URL)
+		}
+	})
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prantlf/ovai/internal/auth"
+	"github.com/prantlf/ovai/internal/cfg"
+	"github.com/prantlf/ovai/internal/routes"
+)
+
+const (
+	checkPassed        = 0
+	checkInvalidConfig = 1
+	checkNetworkFailed = 2
+)
+
+type checkReport struct {
+	status int
+}
+
+func (r *checkReport) print(result string, subject string, detail string) {
+	fmt.Printf("%-5s %-15s %s\n", result, subject, detail)
+}
+
+func (r *checkReport) pass(subject string, detail string) {
+	r.print("ok", subject, detail)
+}
+
+func (r *checkReport) warn(subject string, detail string) {
+	r.print("warn", subject, detail)
+}
+
+func (r *checkReport) skip(subject string, detail string) {
+	r.print("skip", subject, detail)
+}
+
+func (r *checkReport) fail(subject string, err error, status int) {
+	r.print("fail", subject, err.Error())
+	if r.status == checkPassed || status < r.status {
+		r.status = status
+	}
+}
+
+func checkDefaults(report *checkReport, defaultsFile string) *cfg.Defaults {
+	deflts, err := cfg.LoadDefaults(defaultsFile)
+	if err != nil {
+		report.fail("model defaults", err, checkInvalidConfig)
+		return nil
+	}
+	if _, err := os.Stat(defaultsFile); errors.Is(err, fs.ErrNotExist) {
+		report.pass("model defaults", "built-in, "+defaultsFile+" not found")
+		return deflts
+	}
+	report.pass("model defaults", defaultsFile)
+	for _, path := range deflts.UnknownKeys() {
+		report.warn("unknown key", path)
+	}
+	return deflts
+}
+
+func checkAccount(report *checkReport, accountFile string) *auth.Account {
+	accnt, err := auth.LoadAccount(accountFile)
+	if err != nil {
+		report.fail("google account", err, checkInvalidConfig)
+		return nil
+	}
+	var missing []string
+	if len(accnt.ProjectId) == 0 {
+		missing = append(missing, "project_id")
+	}
+	if len(accnt.ClientEmail) == 0 {
+		missing = append(missing, "client_email")
+	}
+	if len(missing) > 0 {
+		report.fail("google account", fmt.Errorf("%s missing in %s",
+			strings.Join(missing, ", "), accountFile), checkInvalidConfig)
+		return nil
+	}
+	report.pass("google account", fmt.Sprintf("%s, project %s, private key parsed",
+		accountFile, accnt.ProjectId))
+	return accnt
+}
+
+type checkOptions struct {
+	offline *bool
+	model   *string
+	timeout *time.Duration
+}
+
+func addCheckFlags(flags *flag.FlagSet) *checkOptions {
+	return &checkOptions{
+		offline: flags.Bool("offline", false, "skip the network probes of the check"),
+		model:   flags.String("model", "gemini-2.5-flash", "model to probe Vertex AI with by the check"),
+		timeout: flags.Duration("timeout", 10*time.Second, "timeout of each network probe of the check"),
+	}
+}
+
+func runCheck(config *cfg.Config, options *checkOptions) int {
+	offline, model, timeout := options.offline, options.model, options.timeout
+
+	fmt.Printf("ovai %s check\n\n", version)
+	report := &checkReport{}
+	deflts := checkDefaults(report, config.DefaultsFile)
+	accnt := checkAccount(report, config.AccountFile)
+
+	if *offline {
+		report.skip("access token", "offline")
+		report.skip("vertex ai", "offline")
+		report.skip("ollama", "offline")
+	} else {
+		if accnt == nil {
+			report.skip("access token", "no google account")
+		} else {
+			auth.SetAccount(accnt)
+			if err := auth.ProbeAccessToken(*timeout); err != nil {
+				report.fail("access token", err, checkNetworkFailed)
+			} else {
+				report.pass("access token", accnt.AuthUri)
+			}
+		}
+		if accnt == nil || deflts == nil {
+			report.skip("vertex ai", "no valid configuration")
+		} else {
+			cfg.SetDefaults(deflts)
+			if url, err := routes.ProbeVertex(*model, *timeout); err != nil {
+				report.fail("vertex ai", fmt.Errorf("%s: %v", url, err), checkNetworkFailed)
+			} else {
+				report.pass("vertex ai", url)
+			}
+		}
+		if len(routes.GetOllamaOrigin()) == 0 {
+			report.skip("ollama", "OLLAMA_ORIGIN not set")
+		} else if ver, err := routes.ProbeOllama(*timeout); err != nil {
+			report.fail("ollama", fmt.Errorf("%s: %v", routes.GetOllamaOrigin(), err), checkNetworkFailed)
+		} else {
+			report.pass("ollama", fmt.Sprintf("%s, version %s", routes.GetOllamaOrigin(), ver))
+		}
+	}
+
+	if report.status == checkPassed {
+		fmt.Println("\ncheck passed")
+	} else {
+		fmt.Println("\ncheck failed")
+	}
+	return report.status
+}
@@ -3,9 +3,20 @@ package main
 import (
 	"context"
 	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/prantlf/ovai/internal/auth"
+	"github.com/prantlf/ovai/internal/cache"
+	"github.com/prantlf/ovai/internal/cfg"
 	"github.com/prantlf/ovai/internal/log"
 	"github.com/prantlf/ovai/internal/routes"
 	"github.com/prantlf/ovai/internal/web"
@@ -13,42 +24,276 @@ import (
 
 const version = "0.21.0"
 
+func printUsage(flags *flag.FlagSet) {
+	fmt.Printf(`ovai %s - ollama-compatible proxy to Google Vertex AI
+
+Usage: ovai [command] [options]
+
+Commands:
+  serve    run the HTTP server (default)
+  check    validate the configuration and probe the servers
+  version  print the version
+  help     print this usage instructions
+
+Options:
+`, version)
+	flags.SetOutput(os.Stdout)
+	flags.PrintDefaults()
+	fmt.Print(`
+Options on the command line override environment variables, which override
+the config file. The config file is ovai.json, ovai.jsonc, ovai.yaml or
+ovai.yml in the current directory, if not specified.
+`)
+}
+
+func seconds(value int) time.Duration {
+	return time.Duration(value) * time.Second
+}
+
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func applyConfig(config *cfg.Config) error {
+	if err := log.Configure(config.Debug, config.LogFile); err != nil {
+		return err
+	}
+	client := web.ClientConfig{
+		Network:               config.Network,
+		MaxIdleConns:          config.MaxIdleConns,
+		MaxIdleConnsPerHost:   config.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       config.MaxConnsPerHost,
+		DialTimeout:           seconds(config.DialTimeout),
+		KeepAlive:             seconds(config.KeepAlive),
+		TLSHandshakeTimeout:   seconds(config.TLSHandshakeTimeout),
+		ResponseHeaderTimeout: seconds(config.ResponseHeaderTimeout),
+		IdleConnTimeout:       seconds(config.IdleConnTimeout),
+		HTTP2:                 config.HTTP2,
+		CAFiles:               append(splitList(config.CAFiles), splitList(config.CAFile)...),
+		Proxy:                 config.Proxy,
+	}
+	if err := web.ConfigureClient(web.OAuth, client); err != nil {
+		return err
+	}
+	if err := web.ConfigureClient(web.Media, client); err != nil {
+		return err
+	}
+	if err := web.ConfigureClient(web.Storage, client); err != nil {
+		return err
+	}
+	vertex := client
+	vertex.PinnedKeys = splitList(config.VertexPins)
+	if err := web.ConfigureClient(web.Vertex, vertex); err != nil {
+		return err
+	}
+	if err := web.SetRecording(web.Vertex, config.Recording, config.RecordingsDir, config.ReplayMiss, config.ReplayTiming); err != nil {
+		return err
+	}
+	if config.Recording == "replay" && config.ReplayMiss != "passthrough" {
+		auth.UseFixedAccessToken("replay")
+	}
+	ollama := client
+	ollama.Proxy = config.OllamaProxy
+	if err := web.ConfigureClient(web.Ollama, ollama); err != nil {
+		return err
+	}
+	routes.SetOllamaOrigin(config.OllamaOrigin)
+	routes.SetUpstreamLimit(config.MaxUpstreamRequests)
+	if config.Cache {
+		store := &cache.TieredStore{Memory: cache.NewMemoryStore(int64(config.CacheSize))}
+		if len(config.CacheDir) > 0 {
+			var err error
+			if store.Disk, err = cache.NewDiskStore(config.CacheDir); err != nil {
+				return err
+			}
+		}
+		routes.SetResponseCache(store, seconds(config.CacheTtl))
+	}
+	routes.SetContextCache(config.ContextCache, config.ContextCacheMinSize, seconds(config.ContextCacheTtl))
+	if err := routes.SetContextGuard(config.ContextGuard, config.ContextTruncate); err != nil {
+		return err
+	}
+	routes.SetStrictValidation(config.Strict)
+	if err := routes.SetFimTemplate(config.FimTemplate); err != nil {
+		return err
+	}
+	routes.SetMediaFetching(splitList(config.MediaHosts), config.MediaSize)
+	if err := routes.SetFileStorage(config.FilesDir, config.FilesBucket); err != nil {
+		return err
+	}
+	return nil
+}
+
 func main() {
+	command := "serve"
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	flags := flag.NewFlagSet("ovai", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	flags.Usage = func() {}
+	showVersion := flags.Bool("version", false, "print the version and exit")
+	var check *checkOptions
+	switch command {
+	case "serve", "version", "help":
+	case "check":
+		check = addCheckFlags(flags)
+	default:
+		fmt.Fprintf(os.Stderr, "ovai: unknown command: %s\n", command)
+		os.Exit(2)
+	}
+
+	config, err := cfg.ParseConfig(flags, args)
+	if errors.Is(err, flag.ErrHelp) || command == "help" {
+		printUsage(flags)
+		return
+	}
+	if *showVersion || command == "version" {
+		fmt.Println(version)
+		return
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ovai: %v\n", err)
+		os.Exit(2)
+	}
+	if err := applyConfig(config); err != nil {
+		fmt.Fprintf(os.Stderr, "ovai: %v\n", err)
+		os.Exit(2)
+	}
+
+	if check != nil {
+		os.Exit(runCheck(config, check))
+	}
+	serve(config)
+}
+
+// removeStaleSocket removes a socket file left by a process, which didn't
+// exit gracefully and would prevent listening. Other files and sockets
+// used by a running process are left intact.
+func removeStaleSocket(socket string) error {
+	info, err := os.Lstat(socket)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	if info.Mode()&fs.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", socket)
+	}
+	if conn, err := net.DialTimeout("unix", socket, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is used by another process", socket)
+	}
+	return os.Remove(socket)
+}
+
+func listen(config *cfg.Config) (net.Listener, string, error) {
+	if len(config.Socket) > 0 {
+		if err := removeStaleSocket(config.Socket); err != nil {
+			return nil, "", err
+		}
+		listener, err := net.Listen("unix", config.Socket)
+		if err != nil {
+			return nil, "", err
+		}
+		if err := os.Chmod(config.Socket, 0o660); err != nil {
+			return nil, "", err
+		}
+		return listener, "unix:" + config.Socket, nil
+	}
+	listener, err := net.Listen("tcp", net.JoinHostPort(config.Host, strconv.Itoa(config.Port)))
+	if err != nil {
+		return nil, "", err
+	}
+	host := config.Host
+	if len(host) == 0 {
+		host = "localhost"
+	}
+	return listener, net.JoinHostPort(host, strconv.Itoa(config.Port)), nil
+}
+
+func serve(config *cfg.Config) {
 	if log.IsDbg {
 		cwd, _ := os.Getwd()
 		log.Dbg("version %s runs in %s", version, cwd)
 	}
 
-	port := os.Getenv("PORT")
-	if len(port) == 0 {
-		port = "22434"
+	if err := routes.LoadConfig(config.DefaultsFile, config.AccountFile); err != nil {
+		log.Ftl("%v", err)
 	}
+	routes.WatchConfig(seconds(config.ReloadInterval))
+
 	server := &http.Server{
-		Addr: ":" + port,
+		ReadHeaderTimeout: seconds(config.ReadHeaderTimeout),
+		ReadTimeout:       seconds(config.ReadTimeout),
+		WriteTimeout:      seconds(config.WriteTimeout),
+		IdleTimeout:       seconds(config.IdleTimeout),
+		MaxHeaderBytes:    config.MaxHeaderBytes,
 	}
+	bodySize, chatBodySize := int64(config.MaxBodySize), int64(config.MaxChatBodySize)
+	fileSize := int64(config.MaxFileSize)
 
 	http.HandleFunc("/", web.WrapHandler(routes.HandleRoot, []string{"GET", "HEAD"}))
-	http.HandleFunc("/api/chat", web.WrapHandler(routes.HandleChat, []string{"POST"}))
-	http.HandleFunc("/v1/chat/completions", web.WrapHandler(routes.HandleCompletions, []string{"POST"}))
-	http.HandleFunc("/api/embeddings", web.WrapHandler(routes.HandleEmbeddings, []string{"POST"}))
-	http.HandleFunc("/api/embed", web.WrapHandler(routes.HandleEmbed, []string{"POST"}))
-	http.HandleFunc("/api/generate", web.WrapHandler(routes.HandleGenerate, []string{"POST"}))
+	http.HandleFunc("/api/cache", web.WrapHandler(routes.HandleCache, []string{"GET", "HEAD", "DELETE"}))
+	http.HandleFunc("/api/chat", web.WrapHandler(routes.LimitBody(routes.LimitUpstream(routes.HandleChat), chatBodySize), []string{"POST"}))
+	http.HandleFunc("/v1/chat/completions", web.WrapHandler(routes.LimitBody(routes.LimitUpstream(routes.HandleCompletions), chatBodySize), []string{"POST"}))
+	http.HandleFunc("/api/contexts", web.WrapHandler(routes.LimitUpstream(routes.HandleContexts), []string{"GET", "HEAD", "DELETE"}))
+	http.HandleFunc("/api/count_tokens", web.WrapHandler(routes.LimitBody(routes.LimitUpstream(routes.HandleCountTokens), chatBodySize), []string{"POST"}))
+	http.HandleFunc("/api/embeddings", web.WrapHandler(routes.LimitBody(routes.LimitUpstream(routes.HandleEmbeddings), bodySize), []string{"POST"}))
+	http.HandleFunc("/api/embed", web.WrapHandler(routes.LimitBody(routes.LimitUpstream(routes.HandleEmbed), bodySize), []string{"POST"}))
+	http.HandleFunc("/api/generate", web.WrapHandler(routes.LimitBody(routes.LimitUpstream(routes.HandleGenerate), chatBodySize), []string{"POST"}))
+	http.HandleFunc("/api/reload", web.WrapHandler(routes.HandleReload, []string{"POST"}))
 	http.HandleFunc("/api/ping", web.WrapHandler(routes.HandlePing, []string{"GET", "HEAD"}))
-	http.HandleFunc("/api/show", web.WrapHandler(routes.HandleShow, []string{"POST"}))
+	http.HandleFunc("/api/show", web.WrapHandler(routes.LimitBody(routes.LimitUpstream(routes.HandleShow), bodySize), []string{"POST"}))
 	http.HandleFunc("/api/shutdown", web.WrapHandler(routes.HandleShutdown, []string{"POST"}))
 	http.HandleFunc("/api/tags", web.WrapHandler(routes.HandleTags, []string{"GET", "HEAD"}))
+	http.HandleFunc("/v1/chat/completions/input_tokens", web.WrapHandler(routes.LimitBody(routes.LimitUpstream(routes.HandleInputTokens), chatBodySize), []string{"POST"}))
+	http.HandleFunc("/v1/files", web.WrapHandler(routes.LimitBody(routes.LimitUpstream(routes.HandleFiles), fileSize), []string{"GET", "HEAD", "POST"}))
+	http.HandleFunc("/v1/files/", web.WrapHandler(routes.LimitUpstream(routes.HandleFiles), []string{"GET", "HEAD", "DELETE"}))
 	http.HandleFunc("/v1/models", web.WrapHandler(routes.HandleModels, []string{"GET", "HEAD"}))
 
+	listener, location, err := listen(config)
+	if err != nil {
+		log.Ftl("listening failed: %v", err)
+	}
+	if len(config.TlsCert) > 0 {
+		if server.TLSConfig, err = web.NewServerTLSConfig(config.TlsCert, config.TlsKey, config.TlsClientCA); err != nil {
+			log.Ftl("%v", err)
+		}
+	}
+
 	go func() {
-		log.Log("listen on http://localhost:%s", port)
-		if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		var err error
+		if server.TLSConfig != nil {
+			log.Log("ovai %s listen on https://%s", version, location)
+			err = server.ServeTLS(listener, "", "")
+		} else {
+			log.Log("ovai %s listen on http://%s", version, location)
+			err = server.Serve(listener)
+		}
+		if !errors.Is(err, http.ErrServerClosed) {
 			log.Ftl("listening failed: %v", err)
 		}
 	}()
 
 	routes.WaitForShutdown()
 	log.Log("shut server down")
-	if err := server.Shutdown(context.Background()); err != nil {
+	ctx := context.Background()
+	if config.ShutdownTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, seconds(config.ShutdownTimeout))
+		defer cancel()
+	}
+	if err := server.Shutdown(ctx); err != nil {
 		log.Log("shutting down server failed: %v", err)
 		if err = server.Close(); err != nil {
 			log.Log("killing server failed: %v", err)
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prantlf/ovai/internal/cfg"
+	"github.com/prantlf/ovai/internal/test"
+)
+
+func newSocketPath(t *testing.T) string {
+	// t.TempDir can be too long for a socket path
+	dir, err := os.MkdirTemp("", "ovai")
+	test.Nil(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return filepath.Join(dir, "ovai.sock")
+}
+
+func TestListenSocket(t *testing.T) {
+	socket := newSocketPath(t)
+	config := &cfg.Config{Socket: socket}
+
+	// a stale socket left by a crashed process is replaced
+	stale, err := net.Listen("unix", socket)
+	test.Nil(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	listener, address, err := listen(config)
+	test.Nil(t, err)
+	test.Equal(t, "unix:"+socket, address)
+
+	// a socket used by a running process is left intact
+	_, _, err = listen(config)
+	test.NotNil(t, err)
+	listener.Close()
+}
+
+func TestListenSocketNotSocket(t *testing.T) {
+	socket := newSocketPath(t)
+	test.Nil(t, os.WriteFile(socket, []byte("keep"), 0o600))
+	_, _, err := listen(&cfg.Config{Socket: socket})
+	test.NotNil(t, err)
+	content, err := os.ReadFile(socket)
+	test.Nil(t, err)
+	test.Equal(t, "keep", string(content))
+}
+
+func TestListenPort(t *testing.T) {
+	listener, _, err := listen(&cfg.Config{Host: "127.0.0.1"})
+	test.Nil(t, err)
+	test.Equal(t, "tcp", listener.Addr().Network())
+	listener.Close()
+}
@@ -3,3 +3,5 @@ module github.com/prantlf/ovai
 go 1.22.3
 
 require github.com/tidwall/jsonc v0.3.2
+
+require gopkg.in/yaml.v3 v3.0.1
@@ -1,8 +1,13 @@
 package auth
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/prantlf/ovai/internal/log"
@@ -20,25 +25,32 @@ type response struct {
 	ExpiresIn   int    `json:"expires_in"`
 }
 
-var Account = readAccount()
+var current atomic.Pointer[Account]
 
+var tokenLock sync.Mutex
+var tokenAccount *Account
 var accessToken string
 var accessExpires time.Time
+var fixedToken string
 
-func readAccount() *account {
-	accntFile := os.Getenv("OVAI_ACCOUNT")
-	if len(accntFile) == 0 {
-		accntFile = "google-account.json"
-	}
+func GetAccount() *Account {
+	return current.Load()
+}
+
+func SetAccount(accnt *Account) {
+	current.Store(accnt)
+}
+
+func LoadAccount(accntFile string) (*Account, error) {
 	log.Dbg("read %s", accntFile)
 	accntJson, err := os.ReadFile(accntFile)
 	if err != nil {
-		log.Ftl("reading %s failed: %v", accntFile, err)
+		return nil, fmt.Errorf("reading %s failed: %v", accntFile, err)
 	}
-	var accnt account
+	var accnt Account
 	jsonc.ToJSONInPlace(accntJson)
 	if err := json.Unmarshal(accntJson, &accnt); err != nil {
-		log.Ftl("decoding %s failed: %v", accntFile, err)
+		return nil, fmt.Errorf("decoding %s failed: %v", accntFile, err)
 	}
 	if len(accnt.Scope) == 0 {
 		accnt.Scope = "https://www.googleapis.com/auth/cloud-platform"
@@ -46,41 +58,144 @@ func readAccount() *account {
 	if len(accnt.AuthUri) == 0 {
 		accnt.AuthUri = "https://www.googleapis.com/oauth2/v4/token"
 	}
-	return &accnt
+	if accnt.privateKey, err = decodeKey(accnt.PrivateKey); err != nil {
+		return nil, fmt.Errorf("decoding %s failed: %v", accntFile, err)
+	}
+	return &accnt, nil
 }
 
-func RefreshAccessToken() (string, error) {
-	signedToken, err := createToken()
+// tokenRefresh is an exchange of the token in progress, which other requests
+// wait for instead of starting their own.
+type tokenRefresh struct {
+	accnt *Account
+	done  chan struct{}
+	token string
+	err   error
+}
+
+var pendingRefresh *tokenRefresh
+
+func requestAccessToken(ctx context.Context, accnt *Account) (string, time.Time, error) {
+	signedToken, err := createToken(accnt)
 	if err != nil {
-		return "", err
+		return "", time.Time{}, err
 	}
 	reqJson := &request{
 		GrantType: "urn:ietf:params:oauth:grant-type:jwt-bearer",
 		Assertion: signedToken,
 	}
 
-	req, err := web.CreatePostRequest(Account.AuthUri, reqJson)
+	req, err := web.CreatePostRequest(accnt.AuthUri, reqJson)
 	if err != nil {
-		return "", err
+		return "", time.Time{}, err
 	}
 	var resJson response
-	if _, err := web.DispatchRequest(req, &resJson); err != nil {
-		return "", err
+	if _, err := web.DispatchRequest(web.OAuth, req.WithContext(ctx), &resJson); err != nil {
+		return "", time.Time{}, err
 	}
 
-	expires := time.Duration((resJson.ExpiresIn - 20) * int(time.Second))
-	accessToken = resJson.AccessToken
-	accessExpires = time.Now().Add(expires)
+	expires := time.Now().Add(time.Duration((resJson.ExpiresIn - 20) * int(time.Second)))
 	if log.IsDbg {
 		log.Dbg("< got access with %d characters until %s",
-			len(accessToken), accessExpires.Format(time.DateTime))
+			len(resJson.AccessToken), expires.Format(time.DateTime))
+	}
+	return resJson.AccessToken, expires, nil
+}
+
+// refreshAccessToken exchanges the token outside of the lock, so that
+// requests with a valid token don't wait. Requests needing the token at
+// the same time share the single exchange. The lock is expected to be held
+// when called and it is released.
+func refreshAccessToken(accnt *Account) (string, error) {
+	if refresh := pendingRefresh; refresh != nil && refresh.accnt == accnt {
+		tokenLock.Unlock()
+		<-refresh.done
+		return refresh.token, refresh.err
+	}
+	refresh := &tokenRefresh{accnt: accnt, done: make(chan struct{})}
+	pendingRefresh = refresh
+	tokenLock.Unlock()
+
+	token, expires, err := requestAccessToken(context.Background(), accnt)
+	refresh.token, refresh.err = token, err
+
+	tokenLock.Lock()
+	if err == nil {
+		tokenAccount = accnt
+		accessToken = token
+		accessExpires = expires
+	}
+	if pendingRefresh == refresh {
+		pendingRefresh = nil
 	}
-	return accessToken, nil
+	tokenLock.Unlock()
+	close(refresh.done)
+	return token, err
+}
+
+// ProbeAccessToken exchanges the private key of the account for an access
+// token, failing if no response comes within the timeout. The token will be
+// reused by the next requests.
+func ProbeAccessToken(timeout time.Duration) error {
+	accnt := GetAccount()
+	if accnt == nil {
+		return errors.New("google account missing")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	}
+	defer cancel()
+	token, expires, err := requestAccessToken(ctx, accnt)
+	if err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return fmt.Errorf("no response in %s", timeout)
+		}
+		return err
+	}
+	tokenLock.Lock()
+	tokenAccount = accnt
+	accessToken = token
+	accessExpires = expires
+	tokenLock.Unlock()
+	return nil
+}
+
+// UseFixedAccessToken makes the upstream requests authorised by the token
+// without asking for it, if recorded responses are replayed.
+func UseFixedAccessToken(token string) {
+	fixedToken = token
+}
+
+func UsesFixedAccessToken() bool {
+	return len(fixedToken) > 0
+}
+
+func RefreshAccessToken() (string, error) {
+	if len(fixedToken) > 0 {
+		return fixedToken, nil
+	}
+	accnt := GetAccount()
+	if accnt == nil {
+		return "", errors.New("google account missing")
+	}
+	tokenLock.Lock()
+	return refreshAccessToken(accnt)
 }
 
 func UseAccessToken() (string, error) {
-	if len(accessToken) > 0 && time.Now().Compare(accessExpires) < 0 {
-		return accessToken, nil
+	if len(fixedToken) > 0 {
+		return fixedToken, nil
+	}
+	accnt := GetAccount()
+	if accnt == nil {
+		return "", errors.New("google account missing")
+	}
+	tokenLock.Lock()
+	if tokenAccount == accnt && len(accessToken) > 0 && time.Now().Compare(accessExpires) < 0 {
+		token := accessToken
+		tokenLock.Unlock()
+		return token, nil
 	}
-	return RefreshAccessToken()
+	return refreshAccessToken(accnt)
 }
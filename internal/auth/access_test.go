@@ -0,0 +1,81 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prantlf/ovai/internal/test"
+)
+
+func TestUseAccessTokenSingleExchange(t *testing.T) {
+	var exchanges atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		exchanges.Add(1)
+		time.Sleep(50 * time.Millisecond)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"secret","expires_in":3600}`))
+	}))
+	defer server.Close()
+	accnt, err := LoadAccount("google-account.json")
+	test.Nil(t, err)
+	accnt.AuthUri = server.URL
+	previous := GetAccount()
+	SetAccount(accnt)
+	defer func() {
+		SetAccount(previous)
+		tokenAccount, accessToken, accessExpires = nil, "", time.Time{}
+	}()
+
+	// requests waiting for the token share the single exchange
+	var wg sync.WaitGroup
+	tokens := make([]string, 5)
+	for i := range tokens {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tokens[i], _ = UseAccessToken()
+		}()
+	}
+	wg.Wait()
+	test.Equal(t, int32(1), exchanges.Load())
+	for _, token := range tokens {
+		test.Equal(t, "secret", token)
+	}
+
+	// a valid token is reused
+	token, err := UseAccessToken()
+	test.Nil(t, err)
+	test.Equal(t, "secret", token)
+	test.Equal(t, int32(1), exchanges.Load())
+
+	// a forced refresh exchanges the token again
+	_, err = RefreshAccessToken()
+	test.Nil(t, err)
+	test.Equal(t, int32(2), exchanges.Load())
+}
+
+func TestProbeAccessTokenTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+	accnt, err := LoadAccount("google-account.json")
+	test.Nil(t, err)
+	accnt.AuthUri = server.URL
+	previous := GetAccount()
+	SetAccount(accnt)
+	defer SetAccount(previous)
+
+	start := time.Now()
+	test.NotNil(t, ProbeAccessToken(50*time.Millisecond))
+	test.Equal(t, true, time.Since(start) < time.Second)
+}
@@ -10,18 +10,20 @@ import (
 	"encoding/json"
 	"encoding/pem"
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/prantlf/ovai/internal/log"
 )
 
-type account struct {
+type Account struct {
 	ProjectId    string `json:"project_id"`
 	PrivateKeyId string `json:"private_key_id"`
 	PrivateKey   string `json:"private_key"`
 	ClientEmail  string `json:"client_email"`
 	Scope        string `json:"scope,omitempty"`
 	AuthUri      string `json:"auth_uri,omitempty"`
+	privateKey   *rsa.PrivateKey
 }
 
 type header struct {
@@ -38,8 +40,6 @@ type payload struct {
 	Iss   string `json:"iss"`
 }
 
-var privateKey = decodeKey()
-
 func encodePart[T any](part *T) (string, error) {
 	bytes, err := json.Marshal(part)
 	if err != nil {
@@ -48,7 +48,7 @@ func encodePart[T any](part *T) (string, error) {
 	return base64.URLEncoding.EncodeToString(bytes), nil
 }
 
-func encodeToken(head *header, pay *payload) (string, error) {
+func encodeToken(head *header, pay *payload, privateKey *rsa.PrivateKey) (string, error) {
 	headEnc, err := encodePart(head)
 	if err != nil {
 		log.Dbg("encoding token header failed: %v", err)
@@ -74,41 +74,41 @@ func encodeToken(head *header, pay *payload) (string, error) {
 	return tokenEnc + "." + signatureEnc, nil
 }
 
-func decodeKey() *rsa.PrivateKey {
-	keyDec, _ := pem.Decode([]byte(Account.PrivateKey))
+func decodeKey(privateKey string) (*rsa.PrivateKey, error) {
+	keyDec, _ := pem.Decode([]byte(privateKey))
 	if keyDec == nil {
-		log.Ftl("decoding private key failed")
+		return nil, errors.New("decoding private key failed")
 	}
 	keyBytes := keyDec.Bytes
 	keyParsed, err := x509.ParsePKCS8PrivateKey(keyBytes)
 	if err != nil {
 		if keyParsed, err = x509.ParsePKCS1PrivateKey(keyBytes); err != nil {
-			log.Ftl("parsing private key failed: %v", err)
+			return nil, fmt.Errorf("parsing private key failed: %v", err)
 		}
 	}
 	keyRSA, ok := keyParsed.(*rsa.PrivateKey)
 	if !ok {
-		log.Ftl("invalid private key")
+		return nil, errors.New("invalid private key")
 	}
 	log.Dbg("%d characters of private key parsed to %d bytes",
-		len(Account.PrivateKey), keyRSA.Size())
-	return keyRSA
+		len(privateKey), keyRSA.Size())
+	return keyRSA, nil
 }
 
-func createToken() (string, error) {
+func createToken(accnt *Account) (string, error) {
 	head := &header{
 		Alg: "RS256",
 		Typ: "JWT",
-		KID: Account.PrivateKeyId,
+		KID: accnt.PrivateKeyId,
 	}
 	iat := time.Now().Add(-10 * time.Second)
 	exp := iat.Add(time.Hour)
 	pay := &payload{
 		Iat:   iat.Unix(),
 		Exp:   exp.Unix(),
-		Scope: Account.Scope,
-		Aud:   Account.AuthUri,
-		Iss:   Account.ClientEmail,
+		Scope: accnt.Scope,
+		Aud:   accnt.AuthUri,
+		Iss:   accnt.ClientEmail,
 	}
 	if log.IsDbg {
 		headJson, errHead := json.MarshalIndent(head, " ", "  ")
@@ -119,5 +119,5 @@ func createToken() (string, error) {
 			log.Dbg("> create token with header %s\n and payload %s", headJson, payJson)
 		}
 	}
-	return encodeToken(head, pay)
+	return encodeToken(head, pay, accnt.privateKey)
 }
@@ -19,6 +19,8 @@ func TestEncodePart(t *testing.T) {
 }
 
 func TestCreateToken(t *testing.T) {
-	_, err := createToken()
+	accnt, err := LoadAccount("google-account.json")
+	test.Nil(t, err)
+	_, err = createToken(accnt)
 	test.Nil(t, err)
 }
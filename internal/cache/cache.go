@@ -0,0 +1,214 @@
+package cache
+
+import (
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+type Store interface {
+	Get(key string) ([]byte, bool)
+	Set(key string, value []byte, ttl time.Duration)
+	Clear() error
+}
+
+type Stats struct {
+	Entries int   `json:"entries"`
+	Size    int64 `json:"size"`
+}
+
+type entry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+// MemoryStore keeps the most recently used values up to the maximum size.
+type MemoryStore struct {
+	lock    sync.Mutex
+	maxSize int64
+	size    int64
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+func NewMemoryStore(maxSize int64) *MemoryStore {
+	return &MemoryStore{
+		maxSize: maxSize,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func (s *MemoryStore) remove(elem *list.Element) {
+	ent := elem.Value.(*entry)
+	s.order.Remove(elem)
+	delete(s.entries, ent.key)
+	s.size -= int64(len(ent.value))
+}
+
+func (s *MemoryStore) Get(key string) ([]byte, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	elem, ok := s.entries[key]
+	if !ok {
+		return nil, false
+	}
+	ent := elem.Value.(*entry)
+	if time.Now().After(ent.expires) {
+		s.remove(elem)
+		return nil, false
+	}
+	s.order.MoveToFront(elem)
+	return ent.value, true
+}
+
+func (s *MemoryStore) Set(key string, value []byte, ttl time.Duration) {
+	if int64(len(value)) > s.maxSize {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if elem, ok := s.entries[key]; ok {
+		s.remove(elem)
+	}
+	s.entries[key] = s.order.PushFront(&entry{
+		key:     key,
+		value:   value,
+		expires: time.Now().Add(ttl),
+	})
+	s.size += int64(len(value))
+	for s.size > s.maxSize {
+		s.remove(s.order.Back())
+	}
+}
+
+func (s *MemoryStore) Clear() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.order.Init()
+	s.entries = make(map[string]*list.Element)
+	s.size = 0
+	return nil
+}
+
+func (s *MemoryStore) Stats() Stats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return Stats{
+		Entries: len(s.entries),
+		Size:    s.size,
+	}
+}
+
+// DiskStore keeps values in files named by their keys, which have to be
+// valid file names. Each file starts with the expiration time.
+type DiskStore struct {
+	dir string
+}
+
+func NewDiskStore(dir string) (*DiskStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("creating %s failed: %v", dir, err)
+	}
+	return &DiskStore{dir: dir}, nil
+}
+
+func (s *DiskStore) get(key string) ([]byte, time.Time, bool) {
+	file := filepath.Join(s.dir, key)
+	data, err := os.ReadFile(file)
+	if err != nil || len(data) < 8 {
+		return nil, time.Time{}, false
+	}
+	expires := time.Unix(0, int64(binary.BigEndian.Uint64(data)))
+	if time.Now().After(expires) {
+		_ = os.Remove(file)
+		return nil, time.Time{}, false
+	}
+	return data[8:], expires, true
+}
+
+func (s *DiskStore) Get(key string) ([]byte, bool) {
+	value, _, ok := s.get(key)
+	return value, ok
+}
+
+func (s *DiskStore) Set(key string, value []byte, ttl time.Duration) {
+	data := make([]byte, 8, 8+len(value))
+	binary.BigEndian.PutUint64(data, uint64(time.Now().Add(ttl).UnixNano()))
+	data = append(data, value...)
+	// write to a temporary file first to prevent reading incomplete content
+	temp, err := os.CreateTemp(s.dir, key+".*.tmp")
+	if err != nil {
+		return
+	}
+	_, err = temp.Write(data)
+	if errClose := temp.Close(); err == nil {
+		err = errClose
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), filepath.Join(s.dir, key))
+	}
+	if err != nil {
+		_ = os.Remove(temp.Name())
+	}
+}
+
+func (s *DiskStore) Clear() error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	for _, ent := range entries {
+		if !ent.IsDir() {
+			if err := os.Remove(filepath.Join(s.dir, ent.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// TieredStore looks to the memory first and then to the disk, if set.
+type TieredStore struct {
+	Memory *MemoryStore
+	Disk   *DiskStore
+}
+
+func (s *TieredStore) Get(key string) ([]byte, bool) {
+	if value, ok := s.Memory.Get(key); ok {
+		return value, true
+	}
+	if s.Disk == nil {
+		return nil, false
+	}
+	value, expires, ok := s.Disk.get(key)
+	if ok {
+		s.Memory.Set(key, value, time.Until(expires))
+	}
+	return value, ok
+}
+
+func (s *TieredStore) Set(key string, value []byte, ttl time.Duration) {
+	s.Memory.Set(key, value, ttl)
+	if s.Disk != nil {
+		s.Disk.Set(key, value, ttl)
+	}
+}
+
+func (s *TieredStore) Clear() error {
+	err := s.Memory.Clear()
+	if s.Disk != nil {
+		err = errors.Join(err, s.Disk.Clear())
+	}
+	return err
+}
@@ -0,0 +1,48 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prantlf/ovai/internal/test"
+)
+
+func TestMemoryStoreEvictsLeastRecentlyUsed(t *testing.T) {
+	store := NewMemoryStore(6)
+	store.Set("a", []byte("aa"), time.Hour)
+	store.Set("b", []byte("bb"), time.Hour)
+	store.Set("c", []byte("cc"), time.Hour)
+	_, ok := store.Get("a")
+	test.Equal(t, true, ok)
+	store.Set("d", []byte("dd"), time.Hour)
+	_, ok = store.Get("b")
+	test.Equal(t, false, ok)
+	_, ok = store.Get("a")
+	test.Equal(t, true, ok)
+	test.Equal(t, 3, store.Stats().Entries)
+}
+
+func TestMemoryStoreExpires(t *testing.T) {
+	store := NewMemoryStore(100)
+	store.Set("a", []byte("a"), -time.Second)
+	_, ok := store.Get("a")
+	test.Equal(t, false, ok)
+	test.Equal(t, 0, store.Stats().Entries)
+}
+
+func TestTieredStoreReadsDisk(t *testing.T) {
+	disk, err := NewDiskStore(t.TempDir())
+	test.Nil(t, err)
+	disk.Set("a", []byte("value"), time.Hour)
+	disk.Set("b", []byte("value"), -time.Second)
+	store := &TieredStore{Memory: NewMemoryStore(100), Disk: disk}
+	value, ok := store.Get("a")
+	test.Equal(t, true, ok)
+	test.Equal(t, "value", string(value))
+	test.Equal(t, 1, store.Memory.Stats().Entries)
+	_, ok = store.Get("b")
+	test.Equal(t, false, ok)
+	test.Nil(t, store.Clear())
+	_, ok = store.Get("a")
+	test.Equal(t, false, ok)
+}
@@ -0,0 +1,374 @@
+package cfg
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/jsonc"
+	"gopkg.in/yaml.v3"
+)
+
+type Config struct {
+	Host                  string `json:"host,omitempty" yaml:"host,omitempty"`
+	Port                  int    `json:"port,omitempty" yaml:"port,omitempty"`
+	Socket                string `json:"socket,omitempty" yaml:"socket,omitempty"`
+	TlsCert               string `json:"tlsCert,omitempty" yaml:"tlsCert,omitempty"`
+	TlsKey                string `json:"tlsKey,omitempty" yaml:"tlsKey,omitempty"`
+	TlsClientCA           string `json:"tlsClientCA,omitempty" yaml:"tlsClientCA,omitempty"`
+	ReadHeaderTimeout     int    `json:"readHeaderTimeout,omitempty" yaml:"readHeaderTimeout,omitempty"` // seconds
+	ReadTimeout           int    `json:"readTimeout,omitempty" yaml:"readTimeout,omitempty"`             // seconds
+	WriteTimeout          int    `json:"writeTimeout,omitempty" yaml:"writeTimeout,omitempty"`           // seconds
+	IdleTimeout           int    `json:"idleTimeout,omitempty" yaml:"idleTimeout,omitempty"`             // seconds
+	ShutdownTimeout       int    `json:"shutdownTimeout,omitempty" yaml:"shutdownTimeout,omitempty"`     // seconds
+	MaxHeaderBytes        int    `json:"maxHeaderBytes,omitempty" yaml:"maxHeaderBytes,omitempty"`
+	MaxBodySize           int    `json:"maxBodySize,omitempty" yaml:"maxBodySize,omitempty"`         // bytes
+	MaxChatBodySize       int    `json:"maxChatBodySize,omitempty" yaml:"maxChatBodySize,omitempty"` // bytes
+	MaxUpstreamRequests   int    `json:"maxUpstreamRequests,omitempty" yaml:"maxUpstreamRequests,omitempty"`
+	Cache                 bool   `json:"cache" yaml:"cache"`
+	CacheTtl              int    `json:"cacheTtl,omitempty" yaml:"cacheTtl,omitempty"`   // seconds
+	CacheSize             int    `json:"cacheSize,omitempty" yaml:"cacheSize,omitempty"` // bytes
+	CacheDir              string `json:"cacheDir,omitempty" yaml:"cacheDir,omitempty"`
+	ContextCache          bool   `json:"contextCache" yaml:"contextCache"`
+	ContextCacheMinSize   int    `json:"contextCacheMinSize,omitempty" yaml:"contextCacheMinSize,omitempty"` // bytes
+	ContextCacheTtl       int    `json:"contextCacheTtl,omitempty" yaml:"contextCacheTtl,omitempty"`         // seconds
+	ContextGuard          string `json:"contextGuard,omitempty" yaml:"contextGuard,omitempty"`               // estimate, count
+	ContextTruncate       bool   `json:"contextTruncate" yaml:"contextTruncate"`
+	Strict                bool   `json:"strict" yaml:"strict"`
+	FimTemplate           string `json:"fimTemplate,omitempty" yaml:"fimTemplate,omitempty"`
+	MediaHosts            string `json:"mediaHosts,omitempty" yaml:"mediaHosts,omitempty"` // comma-separated
+	MediaSize             int    `json:"mediaSize,omitempty" yaml:"mediaSize,omitempty"`   // bytes
+	FilesDir              string `json:"filesDir,omitempty" yaml:"filesDir,omitempty"`
+	FilesBucket           string `json:"filesBucket,omitempty" yaml:"filesBucket,omitempty"`
+	MaxFileSize           int    `json:"maxFileSize,omitempty" yaml:"maxFileSize,omitempty"` // bytes
+	Recording             string `json:"recording,omitempty" yaml:"recording,omitempty"`     // record, replay
+	RecordingsDir         string `json:"recordingsDir,omitempty" yaml:"recordingsDir,omitempty"`
+	ReplayMiss            string `json:"replayMiss,omitempty" yaml:"replayMiss,omitempty"` // fail, passthrough, closest
+	ReplayTiming          bool   `json:"replayTiming" yaml:"replayTiming"`
+	OllamaOrigin          string `json:"ollamaOrigin,omitempty" yaml:"ollamaOrigin,omitempty"`
+	MaxIdleConns          int    `json:"maxIdleConns,omitempty" yaml:"maxIdleConns,omitempty"`
+	MaxIdleConnsPerHost   int    `json:"maxIdleConnsPerHost,omitempty" yaml:"maxIdleConnsPerHost,omitempty"`
+	MaxConnsPerHost       int    `json:"maxConnsPerHost,omitempty" yaml:"maxConnsPerHost,omitempty"`
+	DialTimeout           int    `json:"dialTimeout,omitempty" yaml:"dialTimeout,omitempty"`                     // seconds
+	KeepAlive             int    `json:"keepAlive,omitempty" yaml:"keepAlive,omitempty"`                         // seconds
+	TLSHandshakeTimeout   int    `json:"tlsHandshakeTimeout,omitempty" yaml:"tlsHandshakeTimeout,omitempty"`     // seconds
+	ResponseHeaderTimeout int    `json:"responseHeaderTimeout,omitempty" yaml:"responseHeaderTimeout,omitempty"` // seconds
+	IdleConnTimeout       int    `json:"idleConnTimeout,omitempty" yaml:"idleConnTimeout,omitempty"`             // seconds
+	HTTP2                 bool   `json:"http2" yaml:"http2"`
+	CAFiles               string `json:"caFiles,omitempty" yaml:"caFiles,omitempty"` // comma-separated
+	CAFile                string `json:"caFile,omitempty" yaml:"caFile,omitempty"`   // deprecated, added to CAFiles
+	Proxy                 string `json:"proxy,omitempty" yaml:"proxy,omitempty"`
+	OllamaProxy           string `json:"ollamaProxy,omitempty" yaml:"ollamaProxy,omitempty"`
+	VertexPins            string `json:"vertexPins,omitempty" yaml:"vertexPins,omitempty"` // comma-separated
+	Network               string `json:"network,omitempty" yaml:"network,omitempty"`       // IPV4, IPV6
+	AccountFile           string `json:"accountFile,omitempty" yaml:"accountFile,omitempty"`
+	DefaultsFile          string `json:"defaultsFile,omitempty" yaml:"defaultsFile,omitempty"`
+	ReloadInterval        int    `json:"reloadInterval,omitempty" yaml:"reloadInterval,omitempty"` // seconds
+	Debug                 string `json:"debug,omitempty" yaml:"debug,omitempty"`
+	LogFile               string `json:"logFile,omitempty" yaml:"logFile,omitempty"`
+}
+
+type configOption struct {
+	flag  string
+	env   string
+	usage string
+	value func(*Config) interface{}
+}
+
+var configOptions = []configOption{
+	{"host", "OVAI_HOST", "interface to listen on (all by default)",
+		func(c *Config) interface{} { return &c.Host }},
+	{"port", "PORT", "port to listen on",
+		func(c *Config) interface{} { return &c.Port }},
+	{"socket", "OVAI_SOCKET", "unix socket to listen on instead of the host and port",
+		func(c *Config) interface{} { return &c.Socket }},
+	{"tls-cert", "OVAI_TLS_CERT", "certificate file to serve HTTPS with",
+		func(c *Config) interface{} { return &c.TlsCert }},
+	{"tls-key", "OVAI_TLS_KEY", "private key file to serve HTTPS with",
+		func(c *Config) interface{} { return &c.TlsKey }},
+	{"tls-client-ca", "OVAI_TLS_CLIENT_CA", "CA file to require and verify client certificates with",
+		func(c *Config) interface{} { return &c.TlsClientCA }},
+	{"read-header-timeout", "OVAI_READ_HEADER_TIMEOUT", "seconds to read request headers",
+		func(c *Config) interface{} { return &c.ReadHeaderTimeout }},
+	{"read-timeout", "OVAI_READ_TIMEOUT", "seconds to read the whole request (0 - no limit)",
+		func(c *Config) interface{} { return &c.ReadTimeout }},
+	{"write-timeout", "OVAI_WRITE_TIMEOUT", "seconds to write the whole response (0 - no limit)",
+		func(c *Config) interface{} { return &c.WriteTimeout }},
+	{"idle-timeout", "OVAI_IDLE_TIMEOUT", "seconds to keep idle connections open",
+		func(c *Config) interface{} { return &c.IdleTimeout }},
+	{"shutdown-timeout", "OVAI_SHUTDOWN_TIMEOUT", "seconds to wait for requests in progress when shutting down",
+		func(c *Config) interface{} { return &c.ShutdownTimeout }},
+	{"max-header-bytes", "OVAI_MAX_HEADER_BYTES", "maximum size of request headers in bytes",
+		func(c *Config) interface{} { return &c.MaxHeaderBytes }},
+	{"max-body-size", "OVAI_MAX_BODY_SIZE", "maximum size of request bodies in bytes (0 - no limit)",
+		func(c *Config) interface{} { return &c.MaxBodySize }},
+	{"max-chat-body-size", "OVAI_MAX_CHAT_BODY_SIZE", "maximum size of chat and generate request bodies in bytes (0 - no limit)",
+		func(c *Config) interface{} { return &c.MaxChatBodySize }},
+	{"max-upstream-requests", "OVAI_MAX_UPSTREAM_REQUESTS", "maximum of requests forwarded at the same time (0 - no limit)",
+		func(c *Config) interface{} { return &c.MaxUpstreamRequests }},
+	{"cache", "OVAI_CACHE", "cache responses of deterministic requests",
+		func(c *Config) interface{} { return &c.Cache }},
+	{"cache-ttl", "OVAI_CACHE_TTL", "seconds to keep cached responses",
+		func(c *Config) interface{} { return &c.CacheTtl }},
+	{"cache-size", "OVAI_CACHE_SIZE", "maximum size of cached responses in memory in bytes",
+		func(c *Config) interface{} { return &c.CacheSize }},
+	{"cache-dir", "OVAI_CACHE_DIR", "directory to cache responses in too (memory only by default)",
+		func(c *Config) interface{} { return &c.CacheDir }},
+	{"context-cache", "OVAI_CONTEXT_CACHE", "cache long leading chat messages in Vertex AI automatically",
+		func(c *Config) interface{} { return &c.ContextCache }},
+	{"context-cache-min-size", "OVAI_CONTEXT_CACHE_MIN_SIZE", "minimum size of leading chat messages to cache automatically in bytes",
+		func(c *Config) interface{} { return &c.ContextCacheMinSize }},
+	{"context-cache-ttl", "OVAI_CONTEXT_CACHE_TTL", "seconds to keep cached chat messages in Vertex AI",
+		func(c *Config) interface{} { return &c.ContextCacheTtl }},
+	{"context-guard", "OVAI_CONTEXT_GUARD", "check chat messages against the input limit (estimate or count)",
+		func(c *Config) interface{} { return &c.ContextGuard }},
+	{"context-truncate", "OVAI_CONTEXT_TRUNCATE", "drop the oldest chat messages exceeding the input limit",
+		func(c *Config) interface{} { return &c.ContextTruncate }},
+	{"strict", "OVAI_STRICT", "reject requests with unknown, unsupported or invalid properties",
+		func(c *Config) interface{} { return &c.Strict }},
+	{"fim-template", "OVAI_FIM_TEMPLATE", "template of the prompt to fill in the middle with a suffix",
+		func(c *Config) interface{} { return &c.FimTemplate }},
+	{"media-hosts", "OVAI_MEDIA_HOSTS", "hosts to fetch media by URL from, *.domain for subdomains (none by default)",
+		func(c *Config) interface{} { return &c.MediaHosts }},
+	{"media-size", "OVAI_MEDIA_SIZE", "maximum size of media fetched by URL in bytes",
+		func(c *Config) interface{} { return &c.MediaSize }},
+	{"files-dir", "OVAI_FILES_DIR", "directory to store uploaded files and their metadata in",
+		func(c *Config) interface{} { return &c.FilesDir }},
+	{"files-bucket", "OVAI_FILES_BUCKET", "Cloud Storage bucket to store the content of uploaded files in (gs://bucket/prefix)",
+		func(c *Config) interface{} { return &c.FilesBucket }},
+	{"max-file-size", "OVAI_MAX_FILE_SIZE", "maximum size of uploaded files in bytes (0 - no limit)",
+		func(c *Config) interface{} { return &c.MaxFileSize }},
+	{"recording", "OVAI_RECORDING", "record the exchanges with Vertex AI or replay them (record or replay)",
+		func(c *Config) interface{} { return &c.Recording }},
+	{"recordings-dir", "OVAI_RECORDINGS_DIR", "directory to store the recorded exchanges with Vertex AI in",
+		func(c *Config) interface{} { return &c.RecordingsDir }},
+	{"replay-miss", "OVAI_REPLAY_MISS", "what to do if no recording matches a request (fail, passthrough or closest)",
+		func(c *Config) interface{} { return &c.ReplayMiss }},
+	{"replay-timing", "OVAI_REPLAY_TIMING", "replay the response chunks with the recorded delays",
+		func(c *Config) interface{} { return &c.ReplayTiming }},
+	{"ollama-origin", "OLLAMA_ORIGIN", "origin of ollama to forward other than Google models to",
+		func(c *Config) interface{} { return &c.OllamaOrigin }},
+	{"max-idle-conns", "OVAI_MAX_IDLE_CONNS", "maximum of idle connections to all upstream hosts",
+		func(c *Config) interface{} { return &c.MaxIdleConns }},
+	{"max-idle-conns-per-host", "OVAI_MAX_IDLE_CONNS_PER_HOST", "maximum of idle connections to an upstream host",
+		func(c *Config) interface{} { return &c.MaxIdleConnsPerHost }},
+	{"max-conns-per-host", "OVAI_MAX_CONNS_PER_HOST", "maximum of connections to an upstream host (0 - no limit)",
+		func(c *Config) interface{} { return &c.MaxConnsPerHost }},
+	{"dial-timeout", "OVAI_DIAL_TIMEOUT", "seconds to connect to an upstream host",
+		func(c *Config) interface{} { return &c.DialTimeout }},
+	{"keep-alive", "OVAI_KEEP_ALIVE", "seconds between keep-alive probes of upstream connections",
+		func(c *Config) interface{} { return &c.KeepAlive }},
+	{"tls-handshake-timeout", "OVAI_TLS_HANDSHAKE_TIMEOUT", "seconds to perform a TLS handshake with an upstream host",
+		func(c *Config) interface{} { return &c.TLSHandshakeTimeout }},
+	{"response-header-timeout", "OVAI_RESPONSE_HEADER_TIMEOUT", "seconds to wait for response headers from an upstream host (0 - no limit)",
+		func(c *Config) interface{} { return &c.ResponseHeaderTimeout }},
+	{"idle-conn-timeout", "OVAI_IDLE_CONN_TIMEOUT", "seconds to keep idle upstream connections open",
+		func(c *Config) interface{} { return &c.IdleConnTimeout }},
+	{"http2", "OVAI_HTTP2", "use HTTP/2 for upstream hosts supporting it",
+		func(c *Config) interface{} { return &c.HTTP2 }},
+	{"ca-files", "OVAI_CA_FILES", "comma-separated files with certificates of additional trusted authorities",
+		func(c *Config) interface{} { return &c.CAFiles }},
+	{"ca-file", "OVAI_CA_FILE", "file with certificates of additional trusted authorities (deprecated, use ca-files)",
+		func(c *Config) interface{} { return &c.CAFile }},
+	{"proxy", "OVAI_PROXY", "proxy URL for Vertex AI and Google authorisation (direct - none, environment by default)",
+		func(c *Config) interface{} { return &c.Proxy }},
+	{"ollama-proxy", "OVAI_OLLAMA_PROXY", "proxy URL for ollama (direct - none, environment by default)",
+		func(c *Config) interface{} { return &c.OllamaProxy }},
+	{"vertex-pins", "OVAI_VERTEX_PINS", "comma-separated base64 SHA-256 hashes of public keys to accept from Vertex AI",
+		func(c *Config) interface{} { return &c.VertexPins }},
+	{"network", "NETWORK", "network to enforce (IPV4 or IPV6)",
+		func(c *Config) interface{} { return &c.Network }},
+	{"account", "OVAI_ACCOUNT", "file with the google account key",
+		func(c *Config) interface{} { return &c.AccountFile }},
+	{"defaults", "OVAI_DEFAULTS", "file with the model defaults",
+		func(c *Config) interface{} { return &c.DefaultsFile }},
+	{"reload-interval", "OVAI_RELOAD_INTERVAL", "seconds to check the account and defaults for changes (0 - never)",
+		func(c *Config) interface{} { return &c.ReloadInterval }},
+	{"debug", "DEBUG", "categories of debug logging (ovai, ovai:srv, ovai:net)",
+		func(c *Config) interface{} { return &c.Debug }},
+	{"log-file", "OVAI_LOG_FILE", "file to append the log to (stderr by default)",
+		func(c *Config) interface{} { return &c.LogFile }},
+}
+
+var configFiles = []string{"ovai.json", "ovai.jsonc", "ovai.yaml", "ovai.yml"}
+
+func defaultConfig() *Config {
+	return &Config{
+		Port:                22434,
+		ReadHeaderTimeout:   10,
+		IdleTimeout:         120,
+		ShutdownTimeout:     30,
+		MaxHeaderBytes:      1 << 20,
+		MaxBodySize:         4 << 20,
+		MaxChatBodySize:     32 << 20,
+		CacheTtl:            3600,
+		CacheSize:           64 << 20,
+		ContextCacheMinSize: 32 << 10,
+		ContextCacheTtl:     3600,
+		MediaSize:           20 << 20,
+		FilesDir:            "files",
+		MaxFileSize:         64 << 20,
+		RecordingsDir:       "recordings",
+		ReplayMiss:          "fail",
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 16,
+		DialTimeout:         10,
+		KeepAlive:           30,
+		TLSHandshakeTimeout: 10,
+		IdleConnTimeout:     90,
+		HTTP2:               true,
+		AccountFile:         "google-account.json",
+		DefaultsFile:        "model-defaults.json",
+		ReloadInterval:      5,
+	}
+}
+
+func findConfigFile() string {
+	for _, file := range configFiles {
+		if _, err := os.Stat(file); err == nil {
+			return file
+		}
+	}
+	return ""
+}
+
+func readConfigFile(configFile string, config *Config) error {
+	configData, err := os.ReadFile(configFile)
+	if err != nil {
+		return fmt.Errorf("reading %s failed: %v", configFile, err)
+	}
+	switch strings.ToLower(filepath.Ext(configFile)) {
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(configData))
+		decoder.KnownFields(true)
+		err = decoder.Decode(config)
+	default:
+		decoder := json.NewDecoder(bytes.NewReader(jsonc.ToJSON(configData)))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(config)
+	}
+	if err != nil {
+		return fmt.Errorf("decoding %s failed: %v", configFile, err)
+	}
+	return nil
+}
+
+func setOptionValue(option *configOption, config *Config, value string) error {
+	switch target := option.value(config).(type) {
+	case *string:
+		*target = value
+	case *int:
+		number, err := strconv.Atoi(value)
+		if err != nil || number < 0 {
+			return fmt.Errorf("invalid value of %s: %q", option.env, value)
+		}
+		*target = number
+	case *bool:
+		flag, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid value of %s: %q", option.env, value)
+		}
+		*target = flag
+	}
+	return nil
+}
+
+func copyOptionValue(option *configOption, target *Config, source *Config) {
+	switch value := option.value(source).(type) {
+	case *string:
+		*option.value(target).(*string) = *value
+	case *int:
+		*option.value(target).(*int) = *value
+	case *bool:
+		*option.value(target).(*bool) = *value
+	}
+}
+
+func validateConfig(config *Config) error {
+	if config.Port < 1 || config.Port > 65535 {
+		return fmt.Errorf("invalid port: %d", config.Port)
+	}
+	if (len(config.TlsCert) == 0) != (len(config.TlsKey) == 0) {
+		return errors.New("both certificate and private key have to be set for HTTPS")
+	}
+	if len(config.TlsClientCA) > 0 && len(config.TlsCert) == 0 {
+		return errors.New("client certificates can be verified only with HTTPS")
+	}
+	switch config.Network {
+	case "", "IPV4", "IPV6":
+	default:
+		return fmt.Errorf("invalid network: %q", config.Network)
+	}
+	return nil
+}
+
+// ParseConfig reads the configuration from the built-in defaults, a config
+// file, environment variables and command-line flags, in this precedence.
+func ParseConfig(flags *flag.FlagSet, args []string) (*Config, error) {
+	config := defaultConfig()
+	overrides := defaultConfig()
+	configFile := flags.String("config", "", "JSON, JSONC or YAML file with options (OVAI_CONFIG)")
+	for i := range configOptions {
+		option := &configOptions[i]
+		usage := fmt.Sprintf("%s (%s)", option.usage, option.env)
+		switch value := option.value(overrides).(type) {
+		case *string:
+			flags.StringVar(value, option.flag, *value, usage)
+		case *int:
+			flags.IntVar(value, option.flag, *value, usage)
+		case *bool:
+			flags.BoolVar(value, option.flag, *value, usage)
+		}
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if len(*configFile) == 0 {
+		*configFile = os.Getenv("OVAI_CONFIG")
+	}
+	if len(*configFile) == 0 {
+		*configFile = findConfigFile()
+	}
+	if len(*configFile) > 0 {
+		if err := readConfigFile(*configFile, config); err != nil {
+			return nil, err
+		}
+	}
+
+	for i := range configOptions {
+		option := &configOptions[i]
+		if value, ok := os.LookupEnv(option.env); ok && len(value) > 0 {
+			if err := setOptionValue(option, config, value); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var flagErr error
+	flags.Visit(func(f *flag.Flag) {
+		for i := range configOptions {
+			option := &configOptions[i]
+			if option.flag == f.Name {
+				copyOptionValue(option, config, overrides)
+				if value, ok := option.value(config).(*int); ok && *value < 0 {
+					flagErr = fmt.Errorf("invalid value of %s: %d", option.flag, *value)
+				}
+			}
+		}
+	})
+	if flagErr != nil {
+		return nil, flagErr
+	}
+
+	if err := validateConfig(config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
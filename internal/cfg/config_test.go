@@ -0,0 +1,50 @@
+package cfg
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prantlf/ovai/internal/test"
+)
+
+func TestParseConfigPrecedence(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "ovai.yaml")
+	test.Nil(t, os.WriteFile(configFile, []byte("port: 1000\nhost: 127.0.0.1\nidleTimeout: 60\n"), 0o644))
+	t.Setenv("OVAI_CONFIG", configFile)
+	t.Setenv("PORT", "2000")
+	t.Setenv("OVAI_IDLE_TIMEOUT", "")
+
+	flags := flag.NewFlagSet("ovai", flag.ContinueOnError)
+	config, err := ParseConfig(flags, []string{"-host", "::1"})
+	test.Nil(t, err)
+	test.Equal(t, "::1", config.Host)
+	test.Equal(t, 2000, config.Port)
+	test.Equal(t, 60, config.IdleTimeout)
+	test.Equal(t, 10, config.ReadHeaderTimeout)
+}
+
+func TestParseConfigInvalid(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "ovai.json")
+	test.Nil(t, os.WriteFile(configFile, []byte(`{ "prot": 1000 }`), 0o644))
+
+	flags := flag.NewFlagSet("ovai", flag.ContinueOnError)
+	_, err := ParseConfig(flags, []string{"-config", configFile})
+	test.NotNil(t, err)
+
+	t.Setenv("PORT", "none")
+	flags = flag.NewFlagSet("ovai", flag.ContinueOnError)
+	_, err = ParseConfig(flags, []string{})
+	test.NotNil(t, err)
+}
+
+func TestParseConfigCAFile(t *testing.T) {
+	// the previous single-file option is still accepted
+	t.Setenv("OVAI_CA_FILE", "corp.pem")
+	flags := flag.NewFlagSet("ovai", flag.ContinueOnError)
+	config, err := ParseConfig(flags, []string{"-ca-files", "a.pem,b.pem"})
+	test.Nil(t, err)
+	test.Equal(t, "a.pem,b.pem", config.CAFiles)
+	test.Equal(t, "corp.pem", config.CAFile)
+}
@@ -4,7 +4,11 @@ import (
 	"bytes"
 	_ "embed"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
 	"os"
+	"sync/atomic"
 
 	"github.com/prantlf/ovai/internal/log"
 	"github.com/tidwall/jsonc"
@@ -16,12 +20,19 @@ type ThinkingConfig struct {
 }
 
 type GenerationConfig struct {
-	MaxOutputTokens *int           `json:"maxOutputTokens,omitempty"`
-	Temperature     *float64       `json:"temperature,omitempty"`
-	TopP            *float64       `json:"topP,omitempty"`
-	TopK            *int           `json:"topK,omitempty"`
-	Scope           string         `json:"scope,omitempty"`
-	ThinkingConfig  ThinkingConfig `json:"thinkingConfig,omitempty"`
+	MaxOutputTokens  *int           `json:"maxOutputTokens,omitempty"`
+	Temperature      *float64       `json:"temperature,omitempty"`
+	TopP             *float64       `json:"topP,omitempty"`
+	TopK             *int           `json:"topK,omitempty"`
+	CandidateCount   *int           `json:"candidateCount,omitempty"`
+	StopSequences    []string       `json:"stopSequences,omitempty"`
+	Seed             *int           `json:"seed,omitempty"`
+	PresencePenalty  *float64       `json:"presencePenalty,omitempty"`
+	FrequencyPenalty *float64       `json:"frequencyPenalty,omitempty"`
+	ResponseLogprobs bool           `json:"responseLogprobs,omitempty"`
+	Logprobs         *int           `json:"logprobs,omitempty"`
+	Scope            string         `json:"scope,omitempty"`
+	ThinkingConfig   ThinkingConfig `json:"thinkingConfig,omitempty"`
 }
 
 type SafetySetting struct {
@@ -34,18 +45,48 @@ type geminiDefaults struct {
 	SafetySettings   []SafetySetting  `json:"safetySettings"`
 }
 
-type defaults struct {
-	ApiLocation    string         `json:"apiLocation"`
-	ApiEndpoint    string         `json:"apiEndpoint"`
-	GeminiDefaults geminiDefaults `json:"geminiDefaults"`
+type Defaults struct {
+	ApiLocation    string          `json:"apiLocation"`
+	ApiEndpoint    string          `json:"apiEndpoint"`
+	GeminiDefaults geminiDefaults  `json:"geminiDefaults"`
+	ModelRoutes    []ModelRoute    `json:"modelRoutes,omitempty"`
+	ModelFallbacks []ModelFallback `json:"modelFallbacks,omitempty"`
+	ModelDefaults  []ModelDefaults `json:"modelDefaults,omitempty"`
+	SafetyPolicies []SafetyPolicy  `json:"safetyPolicies,omitempty"`
+	RedactionRules []RedactionRule `json:"redactionRules,omitempty"`
+	unknownKeys    []string
 }
 
 //go:embed model-defaults.json
 var builtins []byte
 
-var Defaults = readDefaults()
+var current atomic.Pointer[Defaults]
 
-func mergeParameters(target *GenerationConfig, source *GenerationConfig) {
+var _ = initDefaults()
+
+func initDefaults() bool {
+	deflts, err := readBuiltins()
+	if err != nil {
+		log.Ftl("%v", err)
+	}
+	current.Store(deflts)
+	return true
+}
+
+func GetDefaults() *Defaults {
+	return current.Load()
+}
+
+func SetDefaults(deflts *Defaults) {
+	current.Store(deflts)
+}
+
+// UnknownKeys returns JSON paths of properties in the file, which were ignored.
+func (d *Defaults) UnknownKeys() []string {
+	return d.unknownKeys
+}
+
+func MergeParameters(target *GenerationConfig, source *GenerationConfig) {
 	if source.MaxOutputTokens != nil {
 		target.MaxOutputTokens = source.MaxOutputTokens
 	}
@@ -58,6 +99,27 @@ func mergeParameters(target *GenerationConfig, source *GenerationConfig) {
 	if source.TopK != nil {
 		target.TopK = source.TopK
 	}
+	if source.CandidateCount != nil {
+		target.CandidateCount = source.CandidateCount
+	}
+	if len(source.StopSequences) > 0 {
+		target.StopSequences = source.StopSequences
+	}
+	if source.Seed != nil {
+		target.Seed = source.Seed
+	}
+	if source.PresencePenalty != nil {
+		target.PresencePenalty = source.PresencePenalty
+	}
+	if source.FrequencyPenalty != nil {
+		target.FrequencyPenalty = source.FrequencyPenalty
+	}
+	if source.ResponseLogprobs {
+		target.ResponseLogprobs = true
+	}
+	if source.Logprobs != nil {
+		target.Logprobs = source.Logprobs
+	}
 	if len(source.Scope) > 0 {
 		target.Scope = source.Scope
 	}
@@ -66,58 +128,95 @@ func mergeParameters(target *GenerationConfig, source *GenerationConfig) {
 	}
 }
 
-func mergeDefaults(target *defaults, source *defaults) {
+func mergeDefaults(target *Defaults, source *Defaults) {
 	if len(source.ApiLocation) > 0 {
 		target.ApiLocation = source.ApiLocation
 	}
 	if len(source.ApiEndpoint) > 0 {
 		target.ApiEndpoint = source.ApiEndpoint
 	}
-	mergeParameters(&target.GeminiDefaults.GenerationConfig, &source.GeminiDefaults.GenerationConfig)
+	MergeParameters(&target.GeminiDefaults.GenerationConfig, &source.GeminiDefaults.GenerationConfig)
 	if len(source.GeminiDefaults.SafetySettings) > 0 {
 		target.GeminiDefaults.SafetySettings = source.GeminiDefaults.SafetySettings
 	}
+	if len(source.ModelRoutes) > 0 {
+		target.ModelRoutes = source.ModelRoutes
+	}
+	if len(source.ModelFallbacks) > 0 {
+		target.ModelFallbacks = source.ModelFallbacks
+	}
+	if len(source.ModelDefaults) > 0 {
+		target.ModelDefaults = source.ModelDefaults
+	}
+	if len(source.SafetyPolicies) > 0 {
+		target.SafetyPolicies = source.SafetyPolicies
+	}
+	if len(source.RedactionRules) > 0 {
+		target.RedactionRules = source.RedactionRules
+	}
 }
 
-func readDefaults() *defaults {
-	defaultsFile := os.Getenv("OVAI_DEFAULTS")
-	if len(defaultsFile) == 0 {
-		defaultsFile = "model-defaults.json"
+func readBuiltins() (*Defaults, error) {
+	var deflts Defaults
+	if err := json.Unmarshal(jsonc.ToJSON(builtins), &deflts); err != nil {
+		return nil, fmt.Errorf("decoding built-in defaults failed: %v", err)
 	}
-	var deflts defaults
-	jsonc.ToJSONInPlace(builtins)
-	if err := json.Unmarshal(builtins, &deflts); err != nil {
-		log.Ftl("decoding built-in defaults failed: %v", err)
+	return &deflts, nil
+}
+
+func LoadDefaults(defaultsFile string) (*Defaults, error) {
+	deflts, err := readBuiltins()
+	if err != nil {
+		return nil, err
 	}
 	log.Dbg("read %s", defaultsFile)
 	defaultsJson, err := os.ReadFile(defaultsFile)
 	if err != nil {
-		log.Dbg("reading %s failed: %v", defaultsFile, err)
-	} else {
-		over := defaults{
-			GeminiDefaults: geminiDefaults{
-				GenerationConfig: GenerationConfig{},
-			},
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("reading %s failed: %v", defaultsFile, err)
 		}
-		jsonc.ToJSONInPlace(defaultsJson)
-		if err := json.Unmarshal(defaultsJson, &over); err != nil {
-			log.Ftl("decoding %s failed: %v", defaultsFile, err)
+		log.Dbg("reading %s failed: %v", defaultsFile, err)
+		return deflts, nil
+	}
+	over := Defaults{
+		GeminiDefaults: geminiDefaults{
+			GenerationConfig: GenerationConfig{},
+		},
+	}
+	jsonc.ToJSONInPlace(defaultsJson)
+	if err := json.Unmarshal(defaultsJson, &over); err != nil {
+		return nil, fmt.Errorf("decoding %s failed: %v", defaultsFile, err)
+	}
+	mergeDefaults(deflts, &over)
+	if err := compileModelRoutes(deflts.ModelRoutes); err != nil {
+		return nil, fmt.Errorf("decoding %s failed: %v", defaultsFile, err)
+	}
+	if err := compileModelFallbacks(deflts.ModelFallbacks); err != nil {
+		return nil, fmt.Errorf("decoding %s failed: %v", defaultsFile, err)
+	}
+	if err := compileAllModelDefaults(deflts.ModelDefaults); err != nil {
+		return nil, fmt.Errorf("decoding %s failed: %v", defaultsFile, err)
+	}
+	if err := compileRedactionRules(deflts.RedactionRules); err != nil {
+		return nil, fmt.Errorf("decoding %s failed: %v", defaultsFile, err)
+	}
+	if err := validateDefaults(deflts); err != nil {
+		return nil, fmt.Errorf("validating %s failed: %v", defaultsFile, err)
+	}
+	deflts.unknownKeys, _ = FindUnknownKeys(defaultsJson)
+	if log.IsDbg {
+		var overJson bytes.Buffer
+		if errLog := json.Indent(&overJson, defaultsJson, "", "  "); errLog != nil {
+			log.Dbg("override defaults: %s", defaultsJson)
+		} else {
+			log.Dbg("override defaults: %s", overJson.Bytes())
 		}
-		mergeDefaults(&deflts, &over)
-		if log.IsDbg {
-			var overJson bytes.Buffer
-			if errLog := json.Indent(&overJson, defaultsJson, "", "  "); errLog != nil {
-				log.Dbg("override defaults: %s", defaultsJson)
-			} else {
-				log.Dbg("override defaults: %s", overJson.Bytes())
-			}
-			defltsJson, errLog := json.MarshalIndent(deflts, "", "  ")
-			if errLog != nil {
-				log.Dbg("customised defaults: %+v", deflts)
-			} else {
-				log.Dbg("customised defaults: %s", defltsJson)
-			}
+		defltsJson, errLog := json.MarshalIndent(deflts, "", "  ")
+		if errLog != nil {
+			log.Dbg("customised defaults: %+v", deflts)
+		} else {
+			log.Dbg("customised defaults: %s", defltsJson)
 		}
 	}
-	return &deflts
+	return deflts, nil
 }
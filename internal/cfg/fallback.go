@@ -0,0 +1,77 @@
+package cfg
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"time"
+)
+
+type ModelFallback struct {
+	Match         string   `json:"match"`
+	Models        []string `json:"models"`
+	StatusCodes   []int    `json:"statusCodes,omitempty"`
+	FinishReasons []string `json:"finishReasons,omitempty"`
+	Timeout       int      `json:"timeout,omitempty"` // seconds
+	pattern       *regexp.Regexp
+}
+
+var fallbackStatusCodes = []int{429, 500, 502, 503, 504}
+
+func (f *ModelFallback) Matches(name string) bool {
+	return matchPattern(f.pattern, f.Match, name)
+}
+
+func (f *ModelFallback) AdvancesOnStatus(status int) bool {
+	statusCodes := f.StatusCodes
+	if len(statusCodes) == 0 {
+		statusCodes = fallbackStatusCodes
+	}
+	return slices.Contains(statusCodes, status)
+}
+
+func (f *ModelFallback) AdvancesOnReason(reason string) bool {
+	return slices.Contains(f.FinishReasons, reason)
+}
+
+func (f *ModelFallback) GetTimeout() time.Duration {
+	return time.Duration(f.Timeout) * time.Second
+}
+
+func compileModelFallback(fallback *ModelFallback) error {
+	if len(fallback.Match) == 0 {
+		return errors.New("model fallback without match")
+	}
+	if len(fallback.Models) == 0 {
+		return fmt.Errorf("model fallback %q without models", fallback.Match)
+	}
+	if fallback.Timeout < 0 {
+		return fmt.Errorf("invalid timeout of model fallback %q: %d", fallback.Match, fallback.Timeout)
+	}
+	pattern, err := compilePattern(fallback.Match)
+	if err != nil {
+		return fmt.Errorf("invalid pattern of model fallback %q: %v", fallback.Match, err)
+	}
+	fallback.pattern = pattern
+	return nil
+}
+
+func compileModelFallbacks(fallbacks []ModelFallback) error {
+	for i := range fallbacks {
+		if err := compileModelFallback(&fallbacks[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *Defaults) FindModelFallback(name string) *ModelFallback {
+	for i := range d.ModelFallbacks {
+		fallback := &d.ModelFallbacks[i]
+		if fallback.Matches(name) {
+			return fallback
+		}
+	}
+	return nil
+}
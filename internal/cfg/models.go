@@ -0,0 +1,81 @@
+package cfg
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+type ModelDefaults struct {
+	Match            string           `json:"match"`
+	GenerationConfig GenerationConfig `json:"generationConfig,omitempty"`
+	SafetySettings   []SafetySetting  `json:"safetySettings,omitempty"`
+	Dimensionality   int              `json:"dimensionality,omitempty"`
+	pattern          *regexp.Regexp
+}
+
+func (d *ModelDefaults) Matches(name string) bool {
+	return matchPattern(d.pattern, d.Match, name)
+}
+
+func compileModelDefaults(deflts *ModelDefaults) error {
+	if len(deflts.Match) == 0 {
+		return errors.New("model defaults without match")
+	}
+	if deflts.Dimensionality < 0 {
+		return fmt.Errorf("invalid dimensionality of model defaults %q: %d", deflts.Match, deflts.Dimensionality)
+	}
+	pattern, err := compilePattern(deflts.Match)
+	if err != nil {
+		return fmt.Errorf("invalid pattern of model defaults %q: %v", deflts.Match, err)
+	}
+	deflts.pattern = pattern
+	return nil
+}
+
+func compileAllModelDefaults(allDefaults []ModelDefaults) error {
+	for i := range allDefaults {
+		if err := compileModelDefaults(&allDefaults[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func MergeSafetySettings(target []SafetySetting, source []SafetySetting) []SafetySetting {
+	merged := make([]SafetySetting, len(target), len(target)+len(source))
+	copy(merged, target)
+	for _, setting := range source {
+		replaced := false
+		for i := range merged {
+			if merged[i].Category == setting.Category {
+				merged[i].Threshold = setting.Threshold
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			merged = append(merged, setting)
+		}
+	}
+	return merged
+}
+
+func (d *Defaults) GetModelDefaults(model string) (GenerationConfig, []SafetySetting, int) {
+	generationConfig := d.GeminiDefaults.GenerationConfig
+	safetySettings := d.GeminiDefaults.SafetySettings
+	dimensionality := 0
+	for i := range d.ModelDefaults {
+		deflts := &d.ModelDefaults[i]
+		if deflts.Matches(model) {
+			MergeParameters(&generationConfig, &deflts.GenerationConfig)
+			if len(deflts.SafetySettings) > 0 {
+				safetySettings = MergeSafetySettings(safetySettings, deflts.SafetySettings)
+			}
+			if deflts.Dimensionality > 0 {
+				dimensionality = deflts.Dimensionality
+			}
+		}
+	}
+	return generationConfig, safetySettings, dimensionality
+}
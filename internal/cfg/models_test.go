@@ -0,0 +1,40 @@
+package cfg
+
+import (
+	"testing"
+
+	"github.com/prantlf/ovai/internal/test"
+)
+
+func TestMergeSafetySettings(t *testing.T) {
+	merged := MergeSafetySettings([]SafetySetting{
+		{Category: "HARM_CATEGORY_HATE_SPEECH", Threshold: "BLOCK_ONLY_HIGH"},
+		{Category: "HARM_CATEGORY_HARASSMENT", Threshold: "BLOCK_ONLY_HIGH"},
+	}, []SafetySetting{
+		{Category: "HARM_CATEGORY_HARASSMENT", Threshold: "BLOCK_NONE"},
+		{Category: "HARM_CATEGORY_DANGEROUS_CONTENT", Threshold: "BLOCK_LOW_AND_ABOVE"},
+	})
+	test.Equal(t, 3, len(merged))
+	test.Equal(t, "BLOCK_ONLY_HIGH", merged[0].Threshold)
+	test.Equal(t, "BLOCK_NONE", merged[1].Threshold)
+	test.Equal(t, "HARM_CATEGORY_DANGEROUS_CONTENT", merged[2].Category)
+}
+
+func TestGetModelDefaults(t *testing.T) {
+	family, model := 0.5, 0.2
+	deflts := &Defaults{}
+	deflts.ModelDefaults = []ModelDefaults{
+		{Match: "gemini-2.5-*", GenerationConfig: GenerationConfig{Temperature: &family}},
+		{Match: "gemini-2.5-pro", GenerationConfig: GenerationConfig{Temperature: &model}},
+		{Match: "gemini-embedding-001", Dimensionality: 768},
+	}
+	test.Nil(t, compileAllModelDefaults(deflts.ModelDefaults))
+
+	generationConfig, _, dimensionality := deflts.GetModelDefaults("gemini-2.5-pro")
+	test.Equal(t, 0.2, *generationConfig.Temperature)
+	test.Equal(t, 0, dimensionality)
+	generationConfig, _, _ = deflts.GetModelDefaults("gemini-2.5-flash")
+	test.Equal(t, 0.5, *generationConfig.Temperature)
+	_, _, dimensionality = deflts.GetModelDefaults("gemini-embedding-001")
+	test.Equal(t, 768, dimensionality)
+}
@@ -0,0 +1,140 @@
+package cfg
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// RedactionRule finds sensitive values in prompts to replace them with
+// placeholders. Values are found by a preset, a regular expression or
+// a list of words.
+type RedactionRule struct {
+	Name       string   `json:"name"`
+	Preset     string   `json:"preset,omitempty"`
+	Pattern    string   `json:"pattern,omitempty"`
+	Words      []string `json:"words,omitempty"`
+	IgnoreCase bool     `json:"ignoreCase,omitempty"`
+	pattern    *regexp.Regexp
+	check      func(string) bool
+}
+
+var redactionPresets = map[string]string{
+	"email": `[\w.+-]+@[\w-]+(?:\.[\w-]+)+`,
+	// international numbers start with +, national ones need separators
+	"phone": `\+\d{1,3}(?:[ .-]?\(?\d{1,4}\)?){2,5}\b|(?:\(\d{2,4}\)|\b\d{2,4})(?:[ .-]\(?\d{2,4}\)?){2,4}\b`,
+}
+
+// checks of values found by presets, which regular expressions cannot do
+var redactionChecks = map[string]func(string) bool{
+	"phone": isPhoneNumber,
+}
+
+// dates and IP addresses look like phone numbers with separators
+var notPhonePattern = regexp.MustCompile(`\d{4}-\d{2}-\d{2}|\b\d{1,2}[./-]\d{1,2}[./-]\d{4}\b|^\d{1,3}(?:\.\d{1,3}){3}$`)
+
+func isPhoneNumber(value string) bool {
+	digits := 0
+	for i := 0; i < len(value); i++ {
+		if value[i] >= '0' && value[i] <= '9' {
+			digits++
+		}
+	}
+	return digits >= 7 && digits <= 15 && !notPhonePattern.MatchString(value)
+}
+
+var redactionName = regexp.MustCompile(`^[A-Z][A-Z0-9_]*$`)
+
+func isWordByte(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z'
+}
+
+func compileWords(words []string) string {
+	sorted := make([]string, len(words))
+	copy(sorted, words)
+	// longer words first, so that they win over their prefixes
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return len(sorted[i]) > len(sorted[j])
+	})
+	alternatives := make([]string, len(sorted))
+	for i, word := range sorted {
+		alternative := regexp.QuoteMeta(word)
+		if isWordByte(word[0]) {
+			alternative = `\b` + alternative
+		}
+		if isWordByte(word[len(word)-1]) {
+			alternative += `\b`
+		}
+		alternatives[i] = alternative
+	}
+	return "(?:" + strings.Join(alternatives, "|") + ")"
+}
+
+func compileRedactionRule(rule *RedactionRule) error {
+	if !redactionName.MatchString(rule.Name) {
+		return fmt.Errorf("invalid name of redaction rule: %q", rule.Name)
+	}
+	var source string
+	kinds := 0
+	if len(rule.Preset) > 0 {
+		preset, ok := redactionPresets[rule.Preset]
+		if !ok {
+			return fmt.Errorf("unknown preset of redaction rule %s: %q", rule.Name, rule.Preset)
+		}
+		source = preset
+		rule.check = redactionChecks[rule.Preset]
+		kinds++
+	}
+	if len(rule.Pattern) > 0 {
+		source = rule.Pattern
+		kinds++
+	}
+	if len(rule.Words) > 0 {
+		for _, word := range rule.Words {
+			if len(word) == 0 {
+				return fmt.Errorf("empty word in redaction rule %s", rule.Name)
+			}
+		}
+		source = compileWords(rule.Words)
+		kinds++
+	}
+	if kinds != 1 {
+		return fmt.Errorf("redaction rule %s needs one of preset, pattern or words", rule.Name)
+	}
+	if rule.IgnoreCase {
+		source = "(?i)" + source
+	}
+	pattern, err := regexp.Compile(source)
+	if err != nil {
+		return fmt.Errorf("invalid pattern of redaction rule %s: %v", rule.Name, err)
+	}
+	rule.pattern = pattern
+	return nil
+}
+
+func compileRedactionRules(rules []RedactionRule) error {
+	names := make(map[string]bool, len(rules))
+	for i := range rules {
+		if err := compileRedactionRule(&rules[i]); err != nil {
+			return err
+		}
+		if names[rules[i].Name] {
+			return errors.New("duplicate redaction rule " + rules[i].Name)
+		}
+		names[rules[i].Name] = true
+	}
+	return nil
+}
+
+// Replace calls substitute for each value found in the text and replaces
+// the value with the result.
+func (r *RedactionRule) Replace(text string, substitute func(string) string) string {
+	return r.pattern.ReplaceAllStringFunc(text, func(value string) string {
+		if r.check != nil && !r.check(value) {
+			return value
+		}
+		return substitute(value)
+	})
+}
@@ -0,0 +1,41 @@
+package cfg
+
+import (
+	"testing"
+
+	"github.com/prantlf/ovai/internal/test"
+)
+
+func TestCompileRedactionRules(t *testing.T) {
+	rules := []RedactionRule{
+		{Name: "CUSTOMER", Words: []string{"Acme", "Acme Corp", "(c)"}, IgnoreCase: true},
+	}
+	test.Nil(t, compileRedactionRules(rules))
+	test.Equal(t, "<> and <> not Acmes <>", rules[0].Replace("ACME corp and acme not Acmes (c)", func(string) string {
+		return "<>"
+	}))
+
+	test.NotNil(t, compileRedactionRules([]RedactionRule{{Name: "email", Preset: "email"}}))
+	test.NotNil(t, compileRedactionRules([]RedactionRule{{Name: "EMAIL", Preset: "mail"}}))
+	test.NotNil(t, compileRedactionRules([]RedactionRule{{Name: "EMAIL"}}))
+	test.NotNil(t, compileRedactionRules([]RedactionRule{{Name: "EMAIL", Preset: "email", Pattern: "@"}}))
+	test.NotNil(t, compileRedactionRules([]RedactionRule{{Name: "EMAIL", Preset: "email"}, {Name: "EMAIL", Pattern: "@"}}))
+}
+
+func TestPhonePreset(t *testing.T) {
+	rules := []RedactionRule{{Name: "PHONE", Preset: "phone"}}
+	test.Nil(t, compileRedactionRules(rules))
+	replace := func(text string) string {
+		return rules[0].Replace(text, func(string) string {
+			return "<>"
+		})
+	}
+	test.Equal(t, "call <> or <>", replace("call +420 123 456 789 or +14155552671"))
+	test.Equal(t, "call <> or <>", replace("call (415) 555-2671 or 415.555.2671"))
+	test.Equal(t, "call <>", replace("call 602 123 456"))
+	// numbers, dates and addresses are kept
+	test.Equal(t, "paid 150000 on 2024-10-19", replace("paid 150000 on 2024-10-19"))
+	test.Equal(t, "on 2024-10-19 10:30 or 19.10.2024", replace("on 2024-10-19 10:30 or 19.10.2024"))
+	test.Equal(t, "host 192.168.100.200 port 8080", replace("host 192.168.100.200 port 8080"))
+	test.Equal(t, "code 12 34 56", replace("code 12 34 56"))
+}
@@ -0,0 +1,92 @@
+package cfg
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+type ModelRoute struct {
+	Match         string           `json:"match"`
+	Model         string           `json:"model,omitempty"`
+	Backend       string           `json:"backend,omitempty"`       // vertex, ollama
+	ResponseModel string           `json:"responseModel,omitempty"` // alias, target
+	Think         string           `json:"think,omitempty"`
+	Options       GenerationConfig `json:"options,omitempty"`
+	pattern       *regexp.Regexp
+}
+
+func compilePattern(match string) (*regexp.Regexp, error) {
+	if len(match) > 2 && strings.HasPrefix(match, "/") && strings.HasSuffix(match, "/") {
+		return regexp.Compile(match[1 : len(match)-1])
+	}
+	_, err := path.Match(match, "")
+	return nil, err
+}
+
+func matchPattern(pattern *regexp.Regexp, match string, name string) bool {
+	if pattern != nil {
+		return pattern.MatchString(name)
+	}
+	matched, err := path.Match(match, name)
+	return err == nil && matched
+}
+
+func (r *ModelRoute) Matches(name string) bool {
+	return matchPattern(r.pattern, r.Match, name)
+}
+
+func (r *ModelRoute) ReportsTarget() bool {
+	return r.ResponseModel == "target"
+}
+
+func compileModelRoute(route *ModelRoute) error {
+	if len(route.Match) == 0 {
+		return errors.New("model route without match")
+	}
+	if len(route.Model) == 0 && len(route.Backend) == 0 {
+		return fmt.Errorf("model route %q without model and backend", route.Match)
+	}
+	switch route.Backend {
+	case "", "vertex", "ollama":
+	default:
+		return fmt.Errorf("invalid backend of model route %q: %q", route.Match, route.Backend)
+	}
+	switch route.ResponseModel {
+	case "", "alias", "target":
+	default:
+		return fmt.Errorf("invalid response model of model route %q: %q", route.Match, route.ResponseModel)
+	}
+	switch route.Think {
+	case "", "none", "low", "medium", "high", "default":
+	default:
+		return fmt.Errorf("invalid thinking level of model route %q: %q", route.Match, route.Think)
+	}
+	pattern, err := compilePattern(route.Match)
+	if err != nil {
+		return fmt.Errorf("invalid pattern of model route %q: %v", route.Match, err)
+	}
+	route.pattern = pattern
+	return nil
+}
+
+func compileModelRoutes(routes []ModelRoute) error {
+	for i := range routes {
+		if err := compileModelRoute(&routes[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *Defaults) FindModelRoute(name string) *ModelRoute {
+	for i := range d.ModelRoutes {
+		route := &d.ModelRoutes[i]
+		if route.Matches(name) {
+			return route
+		}
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+package cfg
+
+import (
+	"testing"
+
+	"github.com/prantlf/ovai/internal/test"
+)
+
+func TestMatchGlob(t *testing.T) {
+	route := ModelRoute{Match: "gpt-4o*", Model: "gemini-2.5-flash"}
+	test.Nil(t, compileModelRoute(&route))
+	test.Equal(t, true, route.Matches("gpt-4o-mini"))
+	test.Equal(t, false, route.Matches("gpt-4"))
+}
+
+func TestMatchRegexp(t *testing.T) {
+	route := ModelRoute{Match: "/^text-embedding-3-(small|large)$/", Model: "gemini-embedding-001"}
+	test.Nil(t, compileModelRoute(&route))
+	test.Equal(t, true, route.Matches("text-embedding-3-small"))
+	test.Equal(t, false, route.Matches("text-embedding-005"))
+}
+
+func TestInvalidRoute(t *testing.T) {
+	test.NotNil(t, compileModelRoute(&ModelRoute{Match: "llama3"}))
+	test.NotNil(t, compileModelRoute(&ModelRoute{Match: "llama3", Backend: "openai"}))
+	test.NotNil(t, compileModelRoute(&ModelRoute{Match: "/(/", Model: "qwen3"}))
+}
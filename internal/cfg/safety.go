@@ -0,0 +1,98 @@
+package cfg
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// SafetyPolicy allows callers with the API keys to lower the thresholds
+// of safety settings in their requests down to the lowest threshold.
+type SafetyPolicy struct {
+	Name            string   `json:"name,omitempty"`
+	ApiKeys         []string `json:"apiKeys"` // plain or sha256:<hex>
+	LowestThreshold string   `json:"lowestThreshold"`
+}
+
+// strictness of thresholds, from the least strict one
+var thresholdLevels = map[string]int{
+	"OFF":                    0,
+	"BLOCK_NONE":             1,
+	"BLOCK_ONLY_HIGH":        2,
+	"BLOCK_MEDIUM_AND_ABOVE": 3,
+	"BLOCK_LOW_AND_ABOVE":    4,
+}
+
+func (p *SafetyPolicy) hasApiKey(apiKey string) bool {
+	hash := sha256.Sum256([]byte(apiKey))
+	hashed := "sha256:" + hex.EncodeToString(hash[:])
+	for _, key := range p.ApiKeys {
+		if strings.HasPrefix(key, "sha256:") {
+			if subtle.ConstantTimeCompare([]byte(strings.ToLower(key)), []byte(hashed)) == 1 {
+				return true
+			}
+		} else if subtle.ConstantTimeCompare([]byte(key), []byte(apiKey)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *Defaults) FindSafetyPolicy(apiKey string) *SafetyPolicy {
+	if len(apiKey) == 0 {
+		return nil
+	}
+	for i := range d.SafetyPolicies {
+		if policy := &d.SafetyPolicies[i]; policy.hasApiKey(apiKey) {
+			return policy
+		}
+	}
+	return nil
+}
+
+// threshold applied by Gemini to categories missing in the safety settings
+const defaultThreshold = "BLOCK_MEDIUM_AND_ABOVE"
+
+// CheckSafetyOverrides fails if an override lowers the threshold of a default
+// safety setting without a policy or below the lowest threshold of the policy.
+// Thresholds can be always raised. Categories missing in the defaults have
+// the default threshold of Gemini.
+func CheckSafetyOverrides(defaults []SafetySetting, overrides []SafetySetting, policy *SafetyPolicy) error {
+	for _, override := range overrides {
+		threshold := defaultThreshold
+		for _, setting := range defaults {
+			if setting.Category == override.Category {
+				threshold = setting.Threshold
+				break
+			}
+		}
+		level := thresholdLevels[override.Threshold]
+		if level >= thresholdLevels[threshold] {
+			continue
+		}
+		if policy == nil {
+			return fmt.Errorf("lowering %s below %s not allowed", override.Category, threshold)
+		}
+		if level < thresholdLevels[policy.LowestThreshold] {
+			return fmt.Errorf("lowering %s below %s not allowed by policy", override.Category, policy.LowestThreshold)
+		}
+	}
+	return nil
+}
+
+func validateSafetyPolicy(policy *SafetyPolicy, path string) error {
+	if len(policy.ApiKeys) == 0 {
+		return fmt.Errorf("%s.apiKeys missing", path)
+	}
+	if slices.Contains(policy.ApiKeys, "") {
+		return errors.New(path + ".apiKeys contains an empty key")
+	}
+	if _, ok := thresholdLevels[policy.LowestThreshold]; !ok {
+		return fmt.Errorf("%s.lowestThreshold invalid: %q", path, policy.LowestThreshold)
+	}
+	return nil
+}
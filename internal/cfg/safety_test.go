@@ -0,0 +1,45 @@
+package cfg
+
+import (
+	"testing"
+
+	"github.com/prantlf/ovai/internal/test"
+)
+
+func TestFindSafetyPolicy(t *testing.T) {
+	deflts := &Defaults{
+		SafetyPolicies: []SafetyPolicy{
+			{Name: "plain", ApiKeys: []string{"secret"}, LowestThreshold: "BLOCK_NONE"},
+			// sha256 of "hashed"
+			{Name: "hashed", ApiKeys: []string{"sha256:1a06df824ed741b53c785079a6347f00eec5af82f9850775409ca69dff4068a6"}, LowestThreshold: "OFF"},
+		},
+	}
+	test.Equal(t, "plain", deflts.FindSafetyPolicy("secret").Name)
+	test.Equal(t, "hashed", deflts.FindSafetyPolicy("hashed").Name)
+	test.Equal(t, (*SafetyPolicy)(nil), deflts.FindSafetyPolicy(""))
+	test.Equal(t, (*SafetyPolicy)(nil), deflts.FindSafetyPolicy("other"))
+}
+
+func TestCheckSafetyOverrides(t *testing.T) {
+	defaults := []SafetySetting{
+		{Category: "HARM_CATEGORY_HARASSMENT", Threshold: "BLOCK_ONLY_HIGH"},
+	}
+	raise := []SafetySetting{{Category: "HARM_CATEGORY_HARASSMENT", Threshold: "BLOCK_LOW_AND_ABOVE"}}
+	lower := []SafetySetting{{Category: "HARM_CATEGORY_HARASSMENT", Threshold: "BLOCK_NONE"}}
+	// categories missing in the defaults have the default threshold of Gemini
+	other := []SafetySetting{{Category: "HARM_CATEGORY_CIVIC_INTEGRITY", Threshold: "OFF"}}
+	otherRaise := []SafetySetting{{Category: "HARM_CATEGORY_CIVIC_INTEGRITY", Threshold: "BLOCK_LOW_AND_ABOVE"}}
+	test.Nil(t, CheckSafetyOverrides(defaults, raise, nil))
+	test.NotNil(t, CheckSafetyOverrides(defaults, other, nil))
+	test.Nil(t, CheckSafetyOverrides(defaults, otherRaise, nil))
+	test.Nil(t, CheckSafetyOverrides(defaults, other, &SafetyPolicy{LowestThreshold: "OFF"}))
+	test.NotNil(t, CheckSafetyOverrides(defaults, lower, nil))
+	test.Nil(t, CheckSafetyOverrides(defaults, lower, &SafetyPolicy{LowestThreshold: "BLOCK_NONE"}))
+	test.NotNil(t, CheckSafetyOverrides(defaults, lower, &SafetyPolicy{LowestThreshold: "BLOCK_ONLY_HIGH"}))
+}
+
+func TestValidateSafetyPolicy(t *testing.T) {
+	test.Nil(t, validateSafetyPolicy(&SafetyPolicy{ApiKeys: []string{"a"}, LowestThreshold: "OFF"}, "$"))
+	test.NotNil(t, validateSafetyPolicy(&SafetyPolicy{LowestThreshold: "OFF"}, "$"))
+	test.NotNil(t, validateSafetyPolicy(&SafetyPolicy{ApiKeys: []string{"a"}, LowestThreshold: "NONE"}, "$"))
+}
@@ -0,0 +1,229 @@
+package cfg
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/tidwall/jsonc"
+)
+
+var safetyCategories = []string{
+	"HARM_CATEGORY_HATE_SPEECH",
+	"HARM_CATEGORY_DANGEROUS_CONTENT",
+	"HARM_CATEGORY_SEXUALLY_EXPLICIT",
+	"HARM_CATEGORY_HARASSMENT",
+	"HARM_CATEGORY_CIVIC_INTEGRITY",
+}
+
+var safetyThresholds = []string{
+	"HARM_BLOCK_THRESHOLD_UNSPECIFIED",
+	"BLOCK_LOW_AND_ABOVE",
+	"BLOCK_MEDIUM_AND_ABOVE",
+	"BLOCK_ONLY_HIGH",
+	"BLOCK_NONE",
+	"OFF",
+}
+
+func jsonName(field reflect.StructField) string {
+	tag := field.Tag.Get("json")
+	if tag == "-" {
+		return ""
+	}
+	name, _, _ := strings.Cut(tag, ",")
+	if len(name) == 0 {
+		return field.Name
+	}
+	return name
+}
+
+func collectFields(typ reflect.Type, fields map[string]reflect.Type) {
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		// properties of embedded structs are promoted to the parent
+		if field.Anonymous && len(field.Tag.Get("json")) == 0 && field.Type.Kind() == reflect.Struct {
+			collectFields(field.Type, fields)
+		} else if field.IsExported() {
+			if name := jsonName(field); len(name) > 0 {
+				fields[name] = field.Type
+			}
+		}
+	}
+}
+
+// FindUnknownProperties returns JSON paths of properties in the decoded JSON
+// value, which don't exist in the type.
+func FindUnknownProperties(value interface{}, typ reflect.Type, path string) []string {
+	for typ.Kind() == reflect.Pointer {
+		typ = typ.Elem()
+	}
+	var unknown []string
+	switch typ.Kind() {
+	case reflect.Struct:
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		fields := make(map[string]reflect.Type)
+		collectFields(typ, fields)
+		keys := make([]string, 0, len(obj))
+		for key := range obj {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fieldType, ok := fields[key]
+			if !ok {
+				unknown = append(unknown, path+"."+key)
+				continue
+			}
+			unknown = append(unknown, FindUnknownProperties(obj[key], fieldType, path+"."+key)...)
+		}
+	case reflect.Slice:
+		arr, ok := value.([]interface{})
+		if !ok {
+			return nil
+		}
+		for i, item := range arr {
+			unknown = append(unknown, FindUnknownProperties(item, typ.Elem(), fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	}
+	return unknown
+}
+
+// FindUnknownKeys returns JSON paths of properties, which would be ignored.
+func FindUnknownKeys(defaultsJson []byte) ([]string, error) {
+	var value interface{}
+	if err := json.Unmarshal(jsonc.ToJSON(defaultsJson), &value); err != nil {
+		return nil, err
+	}
+	return FindUnknownProperties(value, reflect.TypeOf(Defaults{}), "$"), nil
+}
+
+// ThinkingBudgetRange returns the minimum and maximum thinking budget of the model.
+func ThinkingBudgetRange(model string) (int, int) {
+	if strings.HasPrefix(model, "gemini-2.5-pro") {
+		return 128, 32768
+	}
+	if strings.HasPrefix(model, "gemini-2.5-flash-lite") {
+		return 512, 24576
+	}
+	if strings.HasPrefix(model, "gemini-2.5-flash") {
+		return 0, 24576
+	}
+	return 0, 32768
+}
+
+// IsThinkingBudgetValid checks the thinking budget of the model. The budget
+// -1 enables the default behaviour and 0 disables thinking, unless the model
+// doesn't support it.
+func IsThinkingBudgetValid(model string, budget int) bool {
+	if budget == -1 || budget == 0 && !strings.HasPrefix(model, "gemini-2.5-pro") {
+		return true
+	}
+	min, max := ThinkingBudgetRange(model)
+	return budget >= min && budget <= max
+}
+
+// literalModel returns the model name, if the pattern matches only it.
+// Otherwise it returns an empty string to validate the generation config
+// against the limits of any model.
+func literalModel(match string) string {
+	if strings.HasPrefix(match, "/") || strings.ContainsAny(match, `*?[\`) {
+		return ""
+	}
+	return match
+}
+
+func validateGenerationConfig(config *GenerationConfig, model string, path string) error {
+	if config.MaxOutputTokens != nil && *config.MaxOutputTokens < 1 {
+		return fmt.Errorf("%s.maxOutputTokens out of range: %d", path, *config.MaxOutputTokens)
+	}
+	if config.Temperature != nil && (*config.Temperature < 0 || *config.Temperature > 2) {
+		return fmt.Errorf("%s.temperature out of range 0-2: %g", path, *config.Temperature)
+	}
+	if config.TopP != nil && (*config.TopP < 0 || *config.TopP > 1) {
+		return fmt.Errorf("%s.topP out of range 0-1: %g", path, *config.TopP)
+	}
+	if config.TopK != nil && *config.TopK < 1 {
+		return fmt.Errorf("%s.topK out of range: %d", path, *config.TopK)
+	}
+	if config.CandidateCount != nil && (*config.CandidateCount < 1 || *config.CandidateCount > 8) {
+		return fmt.Errorf("%s.candidateCount out of range 1-8: %d", path, *config.CandidateCount)
+	}
+	if len(config.StopSequences) > 5 {
+		return fmt.Errorf("%s.stopSequences longer than 5: %d", path, len(config.StopSequences))
+	}
+	if config.PresencePenalty != nil && (*config.PresencePenalty < -2 || *config.PresencePenalty >= 2) {
+		return fmt.Errorf("%s.presencePenalty out of range -2-2: %g", path, *config.PresencePenalty)
+	}
+	if config.FrequencyPenalty != nil && (*config.FrequencyPenalty < -2 || *config.FrequencyPenalty >= 2) {
+		return fmt.Errorf("%s.frequencyPenalty out of range -2-2: %g", path, *config.FrequencyPenalty)
+	}
+	if config.Logprobs != nil && (*config.Logprobs < 1 || *config.Logprobs > 20) {
+		return fmt.Errorf("%s.logprobs out of range 1-20: %d", path, *config.Logprobs)
+	}
+	if budget := config.ThinkingConfig.ThinkingBudget; budget != nil && !IsThinkingBudgetValid(model, *budget) {
+		min, max := ThinkingBudgetRange(model)
+		return fmt.Errorf("%s.thinkingConfig.thinkingBudget out of range %d-%d: %d", path, min, max, *budget)
+	}
+	return nil
+}
+
+func ValidateSafetySettings(settings []SafetySetting, path string) error {
+	for i, setting := range settings {
+		if !slices.Contains(safetyCategories, setting.Category) {
+			return fmt.Errorf("%s[%d].category invalid: %q", path, i, setting.Category)
+		}
+		if !slices.Contains(safetyThresholds, setting.Threshold) {
+			return fmt.Errorf("%s[%d].threshold invalid: %q", path, i, setting.Threshold)
+		}
+	}
+	return nil
+}
+
+func validateDefaults(deflts *Defaults) error {
+	if len(deflts.ApiLocation) == 0 {
+		return errors.New("$.apiLocation missing")
+	}
+	if len(deflts.ApiEndpoint) == 0 {
+		return errors.New("$.apiEndpoint missing")
+	}
+	if err := validateGenerationConfig(&deflts.GeminiDefaults.GenerationConfig, "", "$.geminiDefaults.generationConfig"); err != nil {
+		return err
+	}
+	if err := ValidateSafetySettings(deflts.GeminiDefaults.SafetySettings, "$.geminiDefaults.safetySettings"); err != nil {
+		return err
+	}
+	for i := range deflts.ModelDefaults {
+		model := &deflts.ModelDefaults[i]
+		path := fmt.Sprintf("$.modelDefaults[%d]", i)
+		if err := validateGenerationConfig(&model.GenerationConfig, literalModel(model.Match), path+".generationConfig"); err != nil {
+			return err
+		}
+		if err := ValidateSafetySettings(model.SafetySettings, path+".safetySettings"); err != nil {
+			return err
+		}
+	}
+	for i := range deflts.SafetyPolicies {
+		if err := validateSafetyPolicy(&deflts.SafetyPolicies[i], fmt.Sprintf("$.safetyPolicies[%d]", i)); err != nil {
+			return err
+		}
+	}
+	for i := range deflts.ModelRoutes {
+		route := &deflts.ModelRoutes[i]
+		path := fmt.Sprintf("$.modelRoutes[%d].options", i)
+		model := route.Model
+		if len(model) == 0 {
+			model = literalModel(route.Match)
+		}
+		if err := validateGenerationConfig(&route.Options, model, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
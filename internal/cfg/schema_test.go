@@ -0,0 +1,95 @@
+package cfg
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/prantlf/ovai/internal/test"
+)
+
+func TestFindUnknownKeys(t *testing.T) {
+	unknown, err := FindUnknownKeys([]byte(`{
+		"apiLocation": "global",
+		"geminiDefaults": { "generationConfig": { "temprature": 1 } },
+		// comment
+		"modelRoutes": [{ "match": "gpt-4o", "model": "gemini-2.5-flash", "backnd": "vertex" }],
+		"extra": true
+	}`))
+	test.Nil(t, err)
+	test.Equal(t, 3, len(unknown))
+	test.Equal(t, "$.extra", unknown[0])
+	test.Equal(t, "$.geminiDefaults.generationConfig.temprature", unknown[1])
+	test.Equal(t, "$.modelRoutes[0].backnd", unknown[2])
+}
+
+func TestFindUnknownPropertiesEmbedded(t *testing.T) {
+	type base struct {
+		Name string `json:"name"`
+	}
+	type derived struct {
+		base
+		Size int `json:"size"`
+	}
+	value := map[string]interface{}{"name": "a", "size": 1, "sise": 2}
+	unknown := FindUnknownProperties(value, reflect.TypeOf(derived{}), "$")
+	test.Equal(t, 1, len(unknown))
+	test.Equal(t, "$.sise", unknown[0])
+}
+
+func TestValidateDefaults(t *testing.T) {
+	deflts, err := readBuiltins()
+	test.Nil(t, err)
+	test.Nil(t, validateDefaults(deflts))
+
+	deflts.GeminiDefaults.SafetySettings = []SafetySetting{{Category: "HARM_CATEGORY_HARASSMENT", Threshold: "BLOCK_ALL"}}
+	test.NotNil(t, validateDefaults(deflts))
+
+	deflts, _ = readBuiltins()
+	budget := 64
+	deflts.ModelDefaults = []ModelDefaults{{Match: "gemini-2.5-pro"}}
+	deflts.ModelDefaults[0].GenerationConfig.ThinkingConfig.ThinkingBudget = &budget
+	test.NotNil(t, validateDefaults(deflts))
+	deflts.ModelDefaults[0].Match = "gemini-2.5-flash"
+	test.Nil(t, validateDefaults(deflts))
+	// patterns are checked against the limits of any model
+	budget = 0
+	deflts.ModelDefaults[0].Match = `/^gemini-2\.5-pro/`
+	test.Nil(t, validateDefaults(deflts))
+	deflts.ModelDefaults[0].Match = "gemini-2.5-pro*"
+	test.Nil(t, validateDefaults(deflts))
+	budget = 32769
+	test.NotNil(t, validateDefaults(deflts))
+
+	deflts, _ = readBuiltins()
+	count := 9
+	deflts.GeminiDefaults.GenerationConfig.CandidateCount = &count
+	test.NotNil(t, validateDefaults(deflts))
+
+	deflts, _ = readBuiltins()
+	penalty := 2.0
+	deflts.GeminiDefaults.GenerationConfig.PresencePenalty = &penalty
+	test.NotNil(t, validateDefaults(deflts))
+}
+
+func TestIsThinkingBudgetValid(t *testing.T) {
+	tests := []struct {
+		model  string
+		budget int
+		valid  bool
+	}{
+		{"gemini-2.5-flash-lite", 0, true},
+		{"gemini-2.5-flash-lite", -1, true},
+		{"gemini-2.5-flash-lite", 256, false},
+		{"gemini-2.5-flash-lite", 512, true},
+		{"gemini-2.5-flash-lite-preview-06-17", 24576, true},
+		{"gemini-2.5-flash-lite", 24577, false},
+		{"gemini-2.5-flash", 1, true},
+		{"gemini-2.5-flash", 24577, false},
+		{"gemini-2.5-pro", 0, false},
+		{"gemini-2.5-pro", 128, true},
+		{"gemini-2.5-pro", 32768, true},
+	}
+	for _, tt := range tests {
+		test.Equal(t, tt.valid, IsThinkingBudgetValid(tt.model, tt.budget))
+	}
+}
@@ -1,6 +1,7 @@
 package log
 
 import (
+	"fmt"
 	out "log"
 	"os"
 	"strings"
@@ -14,8 +15,19 @@ var _ = initLog()
 
 func initLog() bool {
 	out.SetFlags(out.Ldate | out.Lmicroseconds)
-	cfg := os.Getenv("DEBUG")
-	for _, part := range strings.Split(cfg, ",") {
+	return true
+}
+
+func Configure(debug string, logFile string) error {
+	if len(logFile) > 0 {
+		file, err := os.OpenFile(logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+		if err != nil {
+			return fmt.Errorf("opening %s failed: %v", logFile, err)
+		}
+		out.SetOutput(file)
+	}
+	IsDbg, IsSrv, IsNet = false, false, false
+	for _, part := range strings.Split(debug, ",") {
 		switch strings.ToLower(part) {
 		case "ovai":
 			IsDbg = true
@@ -32,7 +44,7 @@ func initLog() bool {
 			IsNet = true
 		}
 	}
-	return IsDbg || IsSrv || IsNet
+	return nil
 }
 
 func Log(format string, args ...any) {
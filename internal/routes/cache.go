@@ -0,0 +1,271 @@
+package routes
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prantlf/ovai/internal/cache"
+	"github.com/prantlf/ovai/internal/log"
+)
+
+type cachePolicy struct {
+	lookup bool
+	store  bool
+	force  bool
+}
+
+// preparingError is an error of finishing the request body, which happens
+// before the request is sent, but after the response wasn't found in the cache.
+type preparingError struct {
+	err error
+}
+
+func (e *preparingError) Error() string {
+	return e.err.Error()
+}
+
+func (e *preparingError) Unwrap() error {
+	return e.err
+}
+
+type cacheOutput struct {
+	Enabled bool  `json:"enabled"`
+	Hits    int64 `json:"hits"`
+	Misses  int64 `json:"misses"`
+	Bypass  int64 `json:"bypass"`
+	Entries int   `json:"entries"`
+	Size    int64 `json:"size"`
+}
+
+// recordingReader stores the stream in the cache, if it was read completely,
+// or if the rest of it can be read, when it is closed.
+type recordingReader struct {
+	reader   io.ReadCloser
+	buffer   bytes.Buffer
+	key      string
+	complete bool
+}
+
+var responseCache *cache.TieredStore
+var responseTtl time.Duration
+var cacheHits, cacheMisses, cacheBypass atomic.Int64
+
+func SetResponseCache(store *cache.TieredStore, ttl time.Duration) {
+	responseCache = store
+	responseTtl = ttl
+}
+
+func getCachePolicy(r *http.Request) *cachePolicy {
+	if responseCache == nil {
+		return nil
+	}
+	policy := &cachePolicy{
+		lookup: true,
+		store:  true,
+		force:  strings.EqualFold(r.Header.Get("X-Ovai-Cache"), "force"),
+	}
+	for _, directive := range strings.Split(r.Header.Get("Cache-Control"), ",") {
+		switch strings.ToLower(strings.TrimSpace(directive)) {
+		case "no-cache":
+			policy.lookup = false
+		case "no-store":
+			policy.lookup = false
+			policy.store = false
+		}
+	}
+	return policy
+}
+
+// isDeterministic checks if the same request is expected to get the same
+// response. Embeddings are always the same, generated text only without
+// randomness.
+func isDeterministic(input interface{}) bool {
+	if body, ok := input.(*geminiBody); ok {
+		temperature := body.GenerationConfig.Temperature
+		return temperature != nil && *temperature == 0
+	}
+	return true
+}
+
+func (p *cachePolicy) applies(input interface{}) bool {
+	return p != nil && (p.force || isDeterministic(input))
+}
+
+// finishBody completes the request body, once it's clear that it'll be sent.
+func finishBody(input interface{}) error {
+	if body, ok := input.(*geminiBody); ok && body.finish != nil {
+		if err := body.finish(); err != nil {
+			return &preparingError{err: err}
+		}
+	}
+	return nil
+}
+
+// getCacheKey computes the key from the body before it is finished, which
+// can include volatile names of context caches.
+func getCacheKey(urlSuffix string, input interface{}) (string, error) {
+	// struct fields are marshalled in a fixed order and map keys sorted
+	reqBody, err := json.Marshal(input)
+	if err != nil {
+		return "", err
+	}
+	// the model URL includes the project, location and model
+	url, err := getModelUrl(urlSuffix)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	hash.Write([]byte(url))
+	hash.Write([]byte{0})
+	hash.Write(reqBody)
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func reportCache(w http.ResponseWriter, result string) {
+	switch result {
+	case "hit":
+		cacheHits.Add(1)
+	case "miss":
+		cacheMisses.Add(1)
+	default:
+		cacheBypass.Add(1)
+	}
+	// a response composed from more requests is a hit only if all of them were
+	if w.Header().Get("X-Ovai-Cache") != "miss" {
+		w.Header().Set("X-Ovai-Cache", result)
+	}
+}
+
+// getCacheKeyIfApplies returns the cache key, if the response can be cached.
+func getCacheKeyIfApplies(policy *cachePolicy, urlSuffix string, input interface{}) string {
+	if !policy.applies(input) {
+		return ""
+	}
+	key, err := getCacheKey(urlSuffix, input)
+	if err != nil {
+		log.Dbg("! computing cache key failed: %v", err)
+		return ""
+	}
+	return key
+}
+
+func reportCacheMiss(w http.ResponseWriter, policy *cachePolicy) {
+	if policy.lookup {
+		reportCache(w, "miss")
+	} else {
+		reportCache(w, "bypass")
+	}
+}
+
+func forwardRequestCached(w http.ResponseWriter, policy *cachePolicy, urlSuffix string, input interface{}, output interface{}, timeout time.Duration) (int, time.Duration, error) {
+	key := getCacheKeyIfApplies(policy, urlSuffix, input)
+	if len(key) > 0 && policy.lookup {
+		if resBody, ok := responseCache.Get(key); ok {
+			if err := json.Unmarshal(resBody, output); err == nil {
+				log.Dbg("< cached %s", urlSuffix)
+				reportCache(w, "hit")
+				return http.StatusOK, 0, nil
+			}
+		}
+	}
+	if err := finishBody(input); err != nil {
+		return http.StatusBadRequest, 0, err
+	}
+	status, duration, err := forwardRequestWithin(urlSuffix, input, output, timeout)
+	if len(key) == 0 {
+		return status, duration, err
+	}
+	if err == nil && policy.store {
+		if resBody, err := json.Marshal(output); err == nil {
+			responseCache.Set(key, resBody, responseTtl)
+		}
+	}
+	reportCacheMiss(w, policy)
+	return status, duration, err
+}
+
+func (r *recordingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.buffer.Write(p[:n])
+	if err == io.EOF {
+		r.complete = true
+	}
+	return n, err
+}
+
+func (r *recordingReader) Close() error {
+	// the stream loops stop reading after the last finish reason
+	if !r.complete {
+		if _, err := io.Copy(io.Discard, r); err != nil {
+			log.Dbg("! reading rest of response body failed: %v", err)
+		}
+	}
+	if r.complete {
+		responseCache.Set(r.key, r.buffer.Bytes(), responseTtl)
+	}
+	return r.reader.Close()
+}
+
+func forwardStreamCached(w http.ResponseWriter, policy *cachePolicy, urlSuffix string, input interface{}, timeout time.Duration) (int, time.Time, io.ReadCloser, error) {
+	key := getCacheKeyIfApplies(policy, urlSuffix, input)
+	if len(key) > 0 && policy.lookup {
+		if resBody, ok := responseCache.Get(key); ok {
+			log.Dbg("< cached %s", urlSuffix)
+			reportCache(w, "hit")
+			// the stored stream is returned at once, the events are split by the stream loops
+			return http.StatusOK, time.Now(), io.NopCloser(bytes.NewReader(resBody)), nil
+		}
+	}
+	if err := finishBody(input); err != nil {
+		return http.StatusBadRequest, time.Time{}, nil, err
+	}
+	status, start, resReader, err := forwardStreamWithin(urlSuffix, input, timeout)
+	if len(key) == 0 {
+		return status, start, resReader, err
+	}
+	if err == nil && policy.store {
+		resReader = &recordingReader{reader: resReader, key: key}
+	}
+	reportCacheMiss(w, policy)
+	return status, start, resReader, err
+}
+
+func HandleCache(w http.ResponseWriter, r *http.Request) int {
+	if r.Method == "DELETE" {
+		log.Dbg(": clear cache")
+		if responseCache != nil {
+			if err := responseCache.Clear(); err != nil {
+				return failRequest(w, http.StatusInternalServerError, err.Error())
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return http.StatusNoContent
+	}
+	log.Dbg(": cache statistics")
+	output := &cacheOutput{
+		Enabled: responseCache != nil,
+		Hits:    cacheHits.Load(),
+		Misses:  cacheMisses.Load(),
+		Bypass:  cacheBypass.Load(),
+	}
+	if responseCache != nil {
+		stats := responseCache.Memory.Stats()
+		output.Entries = stats.Entries
+		output.Size = stats.Size
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if r.Method != "HEAD" {
+		if err := json.NewEncoder(w).Encode(output); err != nil {
+			log.Dbg("! encoding response body failed: %v", err)
+		}
+	}
+	return http.StatusOK
+}
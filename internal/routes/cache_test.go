@@ -0,0 +1,74 @@
+package routes
+
+import (
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prantlf/ovai/internal/auth"
+	"github.com/prantlf/ovai/internal/cache"
+	"github.com/prantlf/ovai/internal/test"
+)
+
+func TestForwardCachedSkipsFinishing(t *testing.T) {
+	accnt := auth.GetAccount()
+	auth.SetAccount(&auth.Account{ProjectId: "p"})
+	defer auth.SetAccount(accnt)
+	SetResponseCache(&cache.TieredStore{Memory: cache.NewMemoryStore(1024)}, time.Minute)
+	defer SetResponseCache(nil, 0)
+
+	temperature := 0.0
+	body := &geminiBody{}
+	body.GenerationConfig.Temperature = &temperature
+	key, err := getCacheKey("m:generateContent", body)
+	test.Nil(t, err)
+	responseCache.Set(key, []byte(`{"candidates":[{"finishReason":"STOP"}]}`), time.Minute)
+
+	// the context window and the context cache need no Vertex AI on a hit
+	finished := false
+	body.finish = func() error {
+		finished = true
+		body.CachedContent = "projects/p/locations/l/cachedContents/1"
+		return nil
+	}
+	policy := &cachePolicy{lookup: true, store: true}
+	var output geminiCompleteOutput
+	w := httptest.NewRecorder()
+	_, _, err = forwardRequestCached(w, policy, "m:generateContent", body, &output, 0)
+	test.Nil(t, err)
+	test.Equal(t, false, finished)
+	test.Equal(t, "hit", w.Header().Get("X-Ovai-Cache"))
+	test.Equal(t, "STOP", output.Candidates[0].FinishReason)
+
+	_, _, resReader, err := forwardStreamCached(httptest.NewRecorder(), policy, "m:generateContent", body, 0)
+	test.Nil(t, err)
+	test.Equal(t, false, finished)
+	content, _ := io.ReadAll(resReader)
+	test.Equal(t, `{"candidates":[{"finishReason":"STOP"}]}`, string(content))
+
+	// a failure of finishing is reported as a preparing error
+	body.finish = func() error {
+		return errors.New("too long")
+	}
+	policy.lookup = false
+	_, _, err = forwardRequestCached(httptest.NewRecorder(), policy, "m:generateContent", body, &output, 0)
+	var prepErr *preparingError
+	test.Equal(t, true, errors.As(err, &prepErr))
+}
+
+func TestRecordingReaderClosedEarly(t *testing.T) {
+	SetResponseCache(&cache.TieredStore{Memory: cache.NewMemoryStore(1024)}, time.Minute)
+	defer SetResponseCache(nil, 0)
+
+	reader := &recordingReader{reader: io.NopCloser(strings.NewReader("data: 1\r\n\r\ndata: 2\r\n\r\n")), key: "k"}
+	buf := make([]byte, 4)
+	_, err := reader.Read(buf)
+	test.Nil(t, err)
+	test.Nil(t, reader.Close())
+	content, ok := responseCache.Get("k")
+	test.Equal(t, true, ok)
+	test.Equal(t, "data: 1\r\n\r\ndata: 2\r\n\r\n", string(content))
+}
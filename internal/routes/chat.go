@@ -40,22 +40,35 @@ type FunctionTool struct {
 }
 
 type chatInput struct {
-	Model    string          `json:"model"`
-	Messages []message       `json:"messages"`
-	Tools    []FunctionTool  `json:"tools"`
-	Think    thinkLevel      `json:"think"`
-	Stream   bool            `json:"stream"`
-	Options  modelParameters `json:"options"`
+	Model        string          `json:"model"`
+	Messages     []message       `json:"messages"`
+	Tools        []FunctionTool  `json:"tools"`
+	Think        thinkLevel      `json:"think"`
+	Stream       bool            `json:"stream"`
+	Options      modelParameters `json:"options"`
+	ContextCache *int            `json:"context_cache,omitempty"`
 }
 
-func convertChatMessagesToGemini(messages []message) ([]geminiContent, error) {
+// convertChatMessagesToGemini returns the contents, the counts of messages
+// other than the leading system ones up to the end of each content and
+// the parts of the system instruction.
+func convertChatMessagesToGemini(messages []message) ([]geminiContent, []int, []geminiPart, error) {
 	systemMessages := make([]geminiPart, 0, 1)
 	chatMessages := make([]geminiContent, 0, len(messages))
 	for _, msg := range messages {
-		if msg.Role == "system" {
+		if msg.Role == "system" && len(chatMessages) == 0 {
 			systemMessages = append(systemMessages, geminiPart{
 				Text: msg.Content,
 			})
+		} else if msg.Role == "system" {
+			chatMessages = append(chatMessages, geminiContent{
+				Role: "user",
+				Parts: []geminiPart{
+					{
+						Text: msg.Content,
+					},
+				},
+			})
 		} else {
 			var role string
 			switch msg.Role {
@@ -66,11 +79,11 @@ func convertChatMessagesToGemini(messages []message) ([]geminiContent, error) {
 			case "tool":
 				role = "user"
 			default:
-				return nil, fmt.Errorf("invalid chat message role: %q", msg.Role)
+				return nil, nil, nil, fmt.Errorf("invalid chat message role: %q", msg.Role)
 			}
 			parts, err := convertContentToGeminiParts(msg.Content, msg.Images, msg.ToolCalls, msg.ToolName)
 			if err != nil {
-				return nil, err
+				return nil, nil, nil, err
 			}
 			chatMessages = append(chatMessages, geminiContent{
 				Role:  role,
@@ -79,12 +92,56 @@ func convertChatMessagesToGemini(messages []message) ([]geminiContent, error) {
 		}
 	}
 	if len(chatMessages) == 0 {
-		return []geminiContent{}, errors.New("no user message found")
+		return []geminiContent{}, nil, nil, errors.New("no user message found")
+	}
+	contents, ends := mergeTurns(chatMessages)
+	return contents, ends, systemMessages, nil
+}
+
+// mergeTurns joins consecutive contents with the same role, because Gemini
+// expects the user and model turns to alternate. It returns the merged
+// contents and the counts of the original contents up to the end of each.
+func mergeTurns(contents []geminiContent) ([]geminiContent, []int) {
+	merged := make([]geminiContent, 0, len(contents))
+	ends := make([]int, 0, len(contents))
+	for i, content := range contents {
+		last := len(merged) - 1
+		if last >= 0 && merged[last].Role == content.Role {
+			merged[last].Parts = append(merged[last].Parts, content.Parts...)
+			ends[last] = i + 1
+		} else {
+			merged = append(merged, geminiContent{
+				Role:  content.Role,
+				Parts: append([]geminiPart{}, content.Parts...),
+			})
+			ends = append(ends, i+1)
+		}
+	}
+	return merged, ends
+}
+
+// countCachedTurns converts the count of the leading messages to cache to
+// the count of the turns merged from them. A turn, which includes messages
+// after the count, isn't cached.
+func countCachedTurns(ends []int, messages *int) *int {
+	if messages == nil || *messages < 0 {
+		return messages
 	}
-	if len(systemMessages) > 0 {
-		chatMessages[0].Parts = append(systemMessages, chatMessages[0].Parts...)
+	turns := 0
+	for turns < len(ends) && ends[turns] <= *messages {
+		turns++
+	}
+	return &turns
+}
+
+func newSystemInstruction(systemParts []geminiPart) *geminiContent {
+	if len(systemParts) == 0 {
+		return nil
+	}
+	return &geminiContent{
+		Role:  "system",
+		Parts: systemParts,
 	}
-	return chatMessages, nil
 }
 
 func convertToolsToGemini(inputTools []FunctionTool) []toolsWrapper {
@@ -104,40 +161,68 @@ func convertToolsToGemini(inputTools []FunctionTool) []toolsWrapper {
 	return tools
 }
 
-func convertChatBodyToGemini(input *chatInput) (interface{}, error) {
-	chatMessages, err := convertChatMessagesToGemini(input.Messages)
+func convertChatBodyToGemini(input *chatInput, target *modelTarget) (*geminiBody, error) {
+	chatMessages, ends, systemParts, err := convertChatMessagesToGemini(input.Messages)
 	if err != nil {
 		return nil, err
 	}
-	generationConfig := cfg.Defaults.GeminiDefaults.GenerationConfig
+	generationConfig := target.generationConfig()
 	if err := mergeParameters(&generationConfig, input.Model, input.Think, &input.Options); err != nil {
 		return nil, err
 	}
 	tools := convertToolsToGemini(input.Tools)
 	body := &geminiBody{
-		Contents:         chatMessages,
-		GenerationConfig: generationConfig,
-		SafetySettings:   cfg.Defaults.GeminiDefaults.SafetySettings,
-		Tools:            tools,
+		Contents:          chatMessages,
+		SystemInstruction: newSystemInstruction(systemParts),
+		GenerationConfig:  generationConfig,
+		SafetySettings:    cfg.MergeSafetySettings(target.safetySettings(), input.Options.SafetySettings),
+		Tools:             tools,
+		cachedTurns:       countCachedTurns(ends, input.ContextCache),
 	}
+	target.Redaction.redactBody(body)
 	return body, nil
 }
 
-func prepareChatBody(input *chatInput) (string, interface{}, interface{}, error) {
+// finishChatBody makes the request fit the context window and moves the
+// leading contents to the context cache, if enabled, when the body is sent.
+// Both may call Vertex AI, which a response found in the cache doesn't need.
+func finishChatBody(body *geminiBody, model string, numCtx *int) {
+	body.finish = func() error {
+		count := len(body.Contents)
+		if err := guardContextWindow(body, model, numCtx); err != nil {
+			return err
+		}
+		cachedTurns := body.cachedTurns
+		// the turns dropped to fit the context window can't be cached
+		if dropped := count - len(body.Contents); dropped > 0 && cachedTurns != nil && *cachedTurns >= 0 {
+			turns := max(*cachedTurns-dropped, 0)
+			cachedTurns = &turns
+		}
+		applyContextCache(body, model, cachedTurns)
+		return nil
+	}
+}
+
+func prepareChatBody(input *chatInput, target *modelTarget) (string, interface{}, interface{}, error) {
 	urlPrefix := input.Model + ":generateContent"
-	body, err := convertChatBodyToGemini(input)
+	body, err := convertChatBodyToGemini(input, target)
 	if err != nil {
 		return "", nil, nil, err
 	}
+	finishChatBody(body, input.Model, input.Options.NumCtx)
 	return urlPrefix, body, &geminiCompleteOutput{}, nil
 }
 
-func prepareChatStream(input *chatInput) (string, interface{}, interface{}, interface{}, error) {
+func prepareChatStream(input *chatInput, target *modelTarget) (string, interface{}, interface{}, interface{}, error) {
 	urlPrefix := input.Model + ":streamGenerateContent?alt=sse"
-	body, err := convertChatBodyToGemini(input)
+	body, err := convertChatBodyToGemini(input, target)
 	if err != nil {
 		return "", nil, nil, nil, err
 	}
+	if getCandidateCount(body) > 1 {
+		return "", nil, nil, nil, errors.New("candidate_count greater than 1 not supported with streaming")
+	}
+	finishChatBody(body, input.Model, input.Options.NumCtx)
 	return urlPrefix, body, &geminiPartialOutput{}, &geminiFinalOutput{}, nil
 }
 
@@ -157,6 +242,37 @@ type chatCompleteResponse struct {
 	PromptEvalDuration int64  `json:"prompt_eval_duration"`
 	EvalCount          int    `json:"eval_count"`
 	EvalDuration       int64  `json:"eval_duration"`
+	candidateSafety
+	// all answers, if more than one was requested by candidate_count
+	Candidates []chatCandidate `json:"candidates,omitempty"`
+}
+
+type chatCandidate struct {
+	Index      int     `json:"index"`
+	Message    message `json:"message"`
+	DoneReason string  `json:"done_reason"`
+	candidateSafety
+}
+
+func convertCandidatesToChat(candidates []candidateParts) []chatCandidate {
+	if len(candidates) < 2 {
+		return nil
+	}
+	chatCandidates := make([]chatCandidate, len(candidates))
+	for i, candidate := range candidates {
+		chatCandidates[i] = chatCandidate{
+			Index: candidate.Index,
+			Message: message{
+				Role:      "assistant",
+				Thinking:  candidate.Thoughts,
+				Content:   candidate.Answer,
+				ToolCalls: convertFunctionCallsToToolCalls(candidate.FunctionCalls),
+			},
+			DoneReason:      convertDoneReason(candidate.Reason),
+			candidateSafety: candidate.Safety,
+		}
+	}
+	return chatCandidates
 }
 
 func convertFunctionCallsToToolCalls(functionCalls []functionCall) []toolCall {
@@ -175,12 +291,11 @@ func convertFunctionCallsToToolCalls(functionCalls []functionCall) []toolCall {
 func HandleChat(w http.ResponseWriter, r *http.Request) int {
 	input := chatInput{
 		Options: modelParameters{},
-		Think:   "none",
 		Stream:  true,
 	}
 	reqPayload, err := io.ReadAll(r.Body)
 	if err != nil {
-		return wrongInput(w, fmt.Sprintf("reading request body failed: %v", err))
+		return failReading(w, r, err)
 	}
 	if err := json.Unmarshal(reqPayload, &input); err != nil {
 		return wrongInput(w, fmt.Sprintf("decoding request body failed: %v", err))
@@ -195,33 +310,57 @@ func HandleChat(w http.ResponseWriter, r *http.Request) int {
 		return wrongInput(w, "messages missing")
 	}
 
-	var forward bool
-	if strings.HasPrefix(input.Model, "gemini") {
-		forward = true
-	} else if !canProxy {
-		return wrongInput(w, fmt.Sprintf("unrecognised model %q", input.Model))
+	target, err := resolveModel(input.Model, isGeminiModel)
+	if err != nil {
+		return wrongInput(w, err.Error())
 	}
 	if log.IsDbg {
 		log.Dbg("> ask with %d message%s using %s", len(input.Messages),
-			log.GetPlural(len(input.Messages)), input.Model)
+			log.GetPlural(len(input.Messages)), target.Model)
+	}
+	if status := validateRequest(w, r, reqPayload, &input, findUnsupportedOllama(reqPayload, unsupportedChatFields), target,
+		func() []validationProblem {
+			return checkOllamaOptions(&input.Options, target.Model)
+		}); status != 0 {
+		return status
 	}
 
-	if !forward {
+	if !target.Forward {
+		if reqPayload, err = target.proxyPayload(reqPayload, "model"); err != nil {
+			return wrongInput(w, err.Error())
+		}
 		if input.Stream {
-			return proxyStream("chat", reqPayload, w, r, "answer", input.Model)
+			return proxyStream("chat", reqPayload, w, r, "answer", target.Model, target.responseModel())
 		}
-		return proxyRequest("chat", reqPayload, w, "answer", input.Model)
+		return proxyRequest("chat", reqPayload, w, "answer", target.Model, target.responseModel())
+	}
+	if status := checkSafetySettings(w, r, target, input.Options.SafetySettings, "$.options.safety_settings"); status != 0 {
+		return status
+	}
+	input.Model = target.Model
+	if len(input.Think) == 0 {
+		input.Think = target.thinkLevel("none")
 	}
 
 	if input.Stream {
-		urlSuffix, reqBody, partialOutput, finalOutput, err := prepareChatStream(&input)
+		answered, start, resReader, partialOutput, finalOutput, status, err := forwardStreamWithFallback(w, getCachePolicy(r), target,
+			func(attempt *modelTarget) (string, interface{}, interface{}, interface{}, error) {
+				input.Model = attempt.Model
+				return prepareChatStream(&input, attempt)
+			})
 		if err != nil {
-			return wrongInput(w, err.Error())
+			if answered == nil {
+				return failPreparing(w, r, err)
+			}
+			return failForwarding(w, r, status, err)
 		}
-		status, start, resReader, err := forwardStream(urlSuffix, reqBody)
-		if err != nil {
-			return failRequest(w, status, err.Error())
+		if !answered.Forward {
+			if reqPayload, err = answered.proxyPayload(reqPayload, "model"); err != nil {
+				return wrongInput(w, err.Error())
+			}
+			return proxyStream("chat", reqPayload, w, r, "answer", answered.Model, answered.responseModel())
 		}
+		target = answered
 		defer func() {
 			if err := resReader.Close(); err != nil {
 				log.Dbg("closing response body stream failed: %v", err)
@@ -237,6 +376,7 @@ func HandleChat(w http.ResponseWriter, r *http.Request) int {
 		}
 		w.Header().Set("Content-Type", contentType)
 		w.WriteHeader(status)
+		var safety candidateSafety
 		var rest []byte
 		for {
 			if f, ok := w.(http.Flusher); ok {
@@ -260,13 +400,17 @@ func HandleChat(w http.ResponseWriter, r *http.Request) int {
 			if err != nil {
 				break
 			}
+			safety.collect(getStreamCandidate(len(reason) > 0, partialOutput, finalOutput))
+			thinking = target.Redaction.restoreChunk("thinking", thinking, len(reason) > 0)
+			content = target.Redaction.restoreChunk("content", content, len(reason) > 0)
+			target.Redaction.restoreFunctionCalls(functionCalls)
 			if len(reason) > 0 {
 				toolCalls := convertFunctionCallsToToolCalls(functionCalls)
 				duration := time.Since(start)
 				promptDuration := int64(math.Round(float64(int64(duration) / 4)))
 				resBody = &chatCompleteResponse{
 					chatResponse: chatResponse{
-						Model:     input.Model,
+						Model:     target.responseModel(),
 						CreatedAt: time.Now().UTC().Format(time.RFC3339),
 						Message: message{
 							Role:      "assistant",
@@ -276,7 +420,8 @@ func HandleChat(w http.ResponseWriter, r *http.Request) int {
 						},
 						Done: true,
 					},
-					DoneReason:         strings.ToLower(reason),
+					DoneReason:         convertDoneReason(reason),
+					candidateSafety:    safety,
 					TotalDuration:      int64(duration),
 					LoadDuration:       0,
 					PromptEvalCount:    promptTokens,
@@ -288,7 +433,7 @@ func HandleChat(w http.ResponseWriter, r *http.Request) int {
 			} else {
 				toolCalls := convertFunctionCallsToToolCalls(functionCalls)
 				resBody = &chatResponse{
-					Model:     input.Model,
+					Model:     target.responseModel(),
 					CreatedAt: time.Now().UTC().Format(time.RFC3339),
 					Message: message{
 						Role:      "assistant",
@@ -312,26 +457,62 @@ func HandleChat(w http.ResponseWriter, r *http.Request) int {
 				break
 			}
 		}
+		// the end of a placeholder held back by the redaction wouldn't come,
+		// if the stream ended without the finish reason
+		thinking := target.Redaction.restoreChunk("thinking", "", true)
+		content := target.Redaction.restoreChunk("content", "", true)
+		if len(thinking) > 0 || len(content) > 0 {
+			resBody := &chatResponse{
+				Model:     target.responseModel(),
+				CreatedAt: time.Now().UTC().Format(time.RFC3339),
+				Message: message{
+					Role:     "assistant",
+					Thinking: thinking,
+					Content:  content,
+				},
+				Done: false,
+			}
+			if sse {
+				web.WriteResponseString(w, "data: ")
+			}
+			if err = json.NewEncoder(w).Encode(resBody); err != nil {
+				log.Dbg("! encoding response body failed: %v", err)
+			}
+			if sse {
+				web.WriteResponseString(w, "\n\n")
+			}
+		}
 	} else {
-		urlSuffix, reqBody, output, err := prepareChatBody(&input)
+		answered, output, status, duration, err := forwardRequestWithFallback(w, getCachePolicy(r), target,
+			func(attempt *modelTarget) (string, interface{}, interface{}, error) {
+				input.Model = attempt.Model
+				return prepareChatBody(&input, attempt)
+			})
 		if err != nil {
-			return wrongInput(w, err.Error())
+			if answered == nil {
+				return failPreparing(w, r, err)
+			}
+			return failForwarding(w, r, status, err)
 		}
-		status, duration, err := forwardRequest(urlSuffix, reqBody, output)
-		if err != nil {
-			return failRequest(w, status, err.Error())
+		if !answered.Forward {
+			if reqPayload, err = answered.proxyPayload(reqPayload, "model"); err != nil {
+				return wrongInput(w, err.Error())
+			}
+			return proxyRequest("chat", reqPayload, w, "answer", answered.Model, answered.responseModel())
 		}
+		target = answered
+		target.Redaction.restoreOutput(output)
 		thinking, content, functionCalls, reason, promptTokens, contentTokens := extractCompleteGeminiResponse(output)
 		tokens := promptTokens + contentTokens
 		if log.IsDbg {
-			log.Dbg("< answer by %s with %d character%s and %d token%s", input.Model,
+			log.Dbg("< answer by %s with %d character%s and %d token%s", target.Model,
 				len(content), log.GetPlural(len(content)), tokens, log.GetPlural(tokens))
 		}
 		toolCalls := convertFunctionCallsToToolCalls(functionCalls)
 		promptDuration := int64(math.Round(float64(int64(duration) / 4)))
 		resBody := &chatCompleteResponse{
 			chatResponse: chatResponse{
-				Model:     input.Model,
+				Model:     target.responseModel(),
 				CreatedAt: time.Now().UTC().Format(time.RFC3339),
 				Message: message{
 					Role:      "assistant",
@@ -341,13 +522,15 @@ func HandleChat(w http.ResponseWriter, r *http.Request) int {
 				},
 				Done: true,
 			},
-			DoneReason:         strings.ToLower(reason),
+			DoneReason:         convertDoneReason(reason),
+			candidateSafety:    getCompleteSafety(output),
 			TotalDuration:      int64(duration),
 			LoadDuration:       0,
 			PromptEvalCount:    promptTokens,
 			PromptEvalDuration: promptDuration,
 			EvalCount:          contentTokens,
 			EvalDuration:       int64(duration) - promptDuration,
+			Candidates:         convertCandidatesToChat(extractCompleteGeminiCandidates(output)),
 		}
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(status)
@@ -0,0 +1,137 @@
+package routes
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/prantlf/ovai/internal/test"
+)
+
+func TestConvertChatMessagesSystem(t *testing.T) {
+	contents, _, systemParts, err := convertChatMessagesToGemini([]message{
+		{Role: "system", Content: "Be brief."},
+		{Role: "system", Content: "Be polite."},
+		{Role: "user", Content: "Hi!"},
+	})
+	test.Nil(t, err)
+	test.Equal(t, 2, len(systemParts))
+	test.Equal(t, "Be brief.", systemParts[0].Text)
+	test.Equal(t, "Be polite.", systemParts[1].Text)
+	test.Equal(t, 1, len(contents))
+	test.Equal(t, "user", contents[0].Role)
+	test.Equal(t, 1, len(contents[0].Parts))
+	test.Equal(t, "Hi!", contents[0].Parts[0].Text)
+}
+
+func TestConvertChatMessagesModelFirst(t *testing.T) {
+	contents, _, systemParts, err := convertChatMessagesToGemini([]message{
+		{Role: "system", Content: "Be brief."},
+		{Role: "assistant", Content: "How can I help?"},
+		{Role: "user", Content: "Hi!"},
+	})
+	test.Nil(t, err)
+	test.Equal(t, 1, len(systemParts))
+	test.Equal(t, 2, len(contents))
+	test.Equal(t, "model", contents[0].Role)
+	test.Equal(t, 1, len(contents[0].Parts))
+	test.Equal(t, "How can I help?", contents[0].Parts[0].Text)
+}
+
+func TestConvertChatMessagesMidSystem(t *testing.T) {
+	contents, _, systemParts, err := convertChatMessagesToGemini([]message{
+		{Role: "user", Content: "Hi!"},
+		{Role: "assistant", Content: "Hello!"},
+		{Role: "system", Content: "Answer in French."},
+		{Role: "user", Content: "How are you?"},
+	})
+	test.Nil(t, err)
+	test.Equal(t, 0, len(systemParts))
+	test.Equal(t, 3, len(contents))
+	test.Equal(t, "user", contents[2].Role)
+	test.Equal(t, 2, len(contents[2].Parts))
+	test.Equal(t, "Answer in French.", contents[2].Parts[0].Text)
+	test.Equal(t, "How are you?", contents[2].Parts[1].Text)
+}
+
+func TestConvertChatMessagesSameRole(t *testing.T) {
+	contents, _, _, err := convertChatMessagesToGemini([]message{
+		{Role: "user", Content: "Hi!"},
+		{Role: "user", Content: "Anybody here?"},
+		{Role: "assistant", Content: "Yes."},
+		{Role: "assistant", Content: "How can I help?"},
+	})
+	test.Nil(t, err)
+	test.Equal(t, 2, len(contents))
+	test.Equal(t, "user", contents[0].Role)
+	test.Equal(t, 2, len(contents[0].Parts))
+	test.Equal(t, "model", contents[1].Role)
+	test.Equal(t, 2, len(contents[1].Parts))
+}
+
+func TestConvertChatMessagesOnlySystem(t *testing.T) {
+	_, _, _, err := convertChatMessagesToGemini([]message{
+		{Role: "system", Content: "Be brief."},
+	})
+	test.NotNil(t, err)
+}
+
+func TestConvertCompletionsMessagesSystem(t *testing.T) {
+	var messages []completionsMessage
+	err := json.Unmarshal([]byte(`[
+		{ "role": "developer", "content": "Be brief." },
+		{ "role": "user", "content": [{ "type": "text", "text": "Hi!" }] },
+		{ "role": "assistant", "content": "Hello!" },
+		{ "role": "system", "content": "Answer in French." },
+		{ "role": "user", "content": "How are you?" }
+	]`), &messages)
+	test.Nil(t, err)
+	contents, _, systemParts, err := convertCompletionsMessagesToGemini(messages)
+	test.Nil(t, err)
+	test.Equal(t, 1, len(systemParts))
+	test.Equal(t, "Be brief.", systemParts[0].Text)
+	test.Equal(t, 3, len(contents))
+	test.Equal(t, "user", contents[0].Role)
+	test.Equal(t, "model", contents[1].Role)
+	test.Equal(t, "user", contents[2].Role)
+	test.Equal(t, 2, len(contents[2].Parts))
+	test.Equal(t, "Answer in French.", contents[2].Parts[0].Text)
+}
+
+func TestMergeTurnsKeepsInput(t *testing.T) {
+	contents := []geminiContent{
+		{Role: "user", Parts: []geminiPart{{Text: "a"}}},
+		{Role: "user", Parts: []geminiPart{{Text: "b"}}},
+	}
+	merged, _ := mergeTurns(contents)
+	test.Equal(t, 1, len(merged))
+	test.Equal(t, 2, len(merged[0].Parts))
+	test.Equal(t, 1, len(contents[0].Parts))
+}
+
+func TestCountCachedTurns(t *testing.T) {
+	contents, ends, _, err := convertChatMessagesToGemini([]message{
+		{Role: "system", Content: "Be brief."},
+		{Role: "user", Content: "Document 1"},
+		{Role: "user", Content: "Document 2"},
+		{Role: "assistant", Content: "I have read the documents."},
+		{Role: "user", Content: "Summarize them."},
+	})
+	test.Nil(t, err)
+	test.Equal(t, 3, len(contents))
+	tests := []struct {
+		messages int
+		turns    int
+	}{
+		{0, 0},
+		{1, 0}, // the first turn continues with the second message
+		{2, 1},
+		{3, 2},
+		{4, 3},
+		{5, 3},
+		{-1, -1},
+	}
+	for _, tt := range tests {
+		test.Equal(t, tt.turns, *countCachedTurns(ends, &tt.messages))
+	}
+	test.Equal(t, true, countCachedTurns(ends, nil) == nil)
+}
@@ -0,0 +1,58 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/prantlf/ovai/internal/web"
+)
+
+type versionOutput struct {
+	Version string `json:"version"`
+}
+
+func GetOllamaOrigin() string {
+	return ollamaOrigin
+}
+
+// ProbeVertex counts tokens of a short text to verify the endpoint,
+// the location, the project and the permissions of the google account.
+func ProbeVertex(model string, timeout time.Duration) (string, error) {
+	url, err := getModelUrl(model)
+	if err != nil {
+		return "", err
+	}
+	input := &countTokensBody{
+		Contents: []geminiContent{
+			{
+				Role:  "user",
+				Parts: []geminiPart{{Text: "ping"}},
+			},
+		},
+	}
+	var output tokenCount
+	if status, _, err := forwardRequestWithin(model+":countTokens", input, &output, timeout); err != nil {
+		return url, fmt.Errorf("%d: %v", status, err)
+	}
+	return url, nil
+}
+
+// ProbeOllama returns the version of the ollama server.
+func ProbeOllama(timeout time.Duration) (string, error) {
+	if !canProxy {
+		return "", errors.New("OLLAMA_ORIGIN not set")
+	}
+	req, err := web.CreateGetRequest(fmt.Sprintf("%s/api/version", ollamaOrigin))
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var output versionOutput
+	if status, err := web.DispatchRequest(web.Ollama, req.WithContext(ctx), &output); err != nil {
+		return "", fmt.Errorf("%d: %v", status, err)
+	}
+	return output.Version, nil
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
@@ -30,17 +31,40 @@ type completionsInput struct {
 	MaxTokens           *int                 `json:"max_tokens"`
 	Temperature         *float64             `json:"temperature"`
 	TopP                *float64             `json:"top_p"`
+	N                   *int                 `json:"n"`
+	Stop                stopSequences        `json:"stop"`
+	Seed                *int                 `json:"seed"`
+	PresencePenalty     *float64             `json:"presence_penalty"`
+	FrequencyPenalty    *float64             `json:"frequency_penalty"`
+	Logprobs            bool                 `json:"logprobs"`
+	TopLogprobs         *int                 `json:"top_logprobs"`
+	LogitBias           map[string]float64   `json:"logit_bias"`
 	ThinkingBudget      *int                 `json:"thinking_budget,omitempty"`
+	ContextCache        *int                 `json:"context_cache,omitempty"`
+	SafetySettings      []cfg.SafetySetting  `json:"safety_settings,omitempty"`
 }
 
 type imageUrl struct {
 	URL string `json:"url"`
 }
 
+type inputAudio struct {
+	Data   string `json:"data"`
+	Format string `json:"format"`
+}
+
+type inputFile struct {
+	FileData string `json:"file_data"`
+	FileId   string `json:"file_id"`
+	Filename string `json:"filename"`
+}
+
 type completionsContent struct {
-	Type     string   `json:"type"`
-	Text     string   `json:"text"`
-	ImageUrl imageUrl `json:"image_url"`
+	Type       string     `json:"type"`
+	Text       string     `json:"text"`
+	ImageUrl   imageUrl   `json:"image_url"`
+	InputAudio inputAudio `json:"input_audio"`
+	File       inputFile  `json:"file"`
 }
 
 type completionsContentArray []completionsContent
@@ -84,33 +108,25 @@ func convertCompletionsContentToGeminiParts(contents []completionsContent) ([]ge
 				Text: content.Text,
 			}
 		case "image_url":
-			url := content.ImageUrl.URL
-			if !strings.HasPrefix(content.ImageUrl.URL, "data:") {
-				return nil, fmt.Errorf("invalid data URI prefix: %s", url[:5])
-			}
-			semicolon := strings.IndexByte(url, ';')
-			if semicolon > 0 {
-				return nil, fmt.Errorf("missing comma in data URI: %s", url[:5])
-			}
-			mimeType := url[5:semicolon]
-			if !strings.HasPrefix(mimeType, "image/") {
-				return nil, fmt.Errorf("invalid image type: %s", mimeType)
-			}
-			comma := strings.IndexByte(url, ',')
-			if comma > 0 {
-				return nil, fmt.Errorf("missing comma in data URI: %s", url[:5])
+			var err error
+			if part, err = convertMediaUri(content.ImageUrl.URL, ""); err != nil {
+				return nil, err
 			}
-			encoding := url[semicolon:comma]
-			if encoding != "base64" {
-				return nil, fmt.Errorf("invalid image encoding: %s", encoding)
+		case "input_audio":
+			if len(content.InputAudio.Format) == 0 {
+				return nil, errors.New("missing input audio format")
 			}
-			image := url[comma:]
 			part = geminiPart{
 				InlineData: &inlineData{
-					MimeType: mimeType,
-					Data:     image,
+					MimeType: normalizeMimeType("audio/" + content.InputAudio.Format),
+					Data:     content.InputAudio.Data,
 				},
 			}
+		case "file":
+			var err error
+			if part, err = convertCompletionsFile(&content.File); err != nil {
+				return nil, err
+			}
 		default:
 			return nil, fmt.Errorf("invalid content type: %q", content.Type)
 		}
@@ -119,6 +135,18 @@ func convertCompletionsContentToGeminiParts(contents []completionsContent) ([]ge
 	return parts, nil
 }
 
+// convertCompletionsFile accepts an uploaded file, a data URI or
+// base64-encoded file content.
+func convertCompletionsFile(file *inputFile) (geminiPart, error) {
+	if len(file.FileId) > 0 {
+		return resolveFile(file.FileId)
+	}
+	if strings.HasPrefix(file.FileData, "data:") {
+		return convertMediaUri(file.FileData, "")
+	}
+	return convertEncodedMedia(file.FileData, file.Filename)
+}
+
 func convertCompletionsToolContentToGeminiParts(contents []completionsContent, toolName string) ([]geminiPart, error) {
 	parts := []geminiPart{}
 	var builder strings.Builder
@@ -143,15 +171,22 @@ func convertCompletionsToolContentToGeminiParts(contents []completionsContent, t
 	return parts, nil
 }
 
-func convertCompletionsMessagesToGemini(messages []completionsMessage) ([]geminiContent, error) {
+func convertCompletionsMessagesToGemini(messages []completionsMessage) ([]geminiContent, []int, []geminiPart, error) {
 	systemMessages := make([]geminiPart, 0, 1)
 	chatMessages := make([]geminiContent, 0, len(messages))
 	for _, msg := range messages {
 		if msg.Role == "system" || msg.Role == "developer" {
-			if parts, err := convertCompletionsContentToGeminiParts(msg.Content); err == nil {
+			parts, err := convertCompletionsContentToGeminiParts(msg.Content)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			if len(chatMessages) == 0 {
 				systemMessages = append(systemMessages, parts...)
 			} else {
-				return nil, err
+				chatMessages = append(chatMessages, geminiContent{
+					Role:  "user",
+					Parts: parts,
+				})
 			}
 		} else {
 			var role string
@@ -163,7 +198,7 @@ func convertCompletionsMessagesToGemini(messages []completionsMessage) ([]gemini
 			case "tool":
 				role = "user"
 			default:
-				return nil, fmt.Errorf("invalid chat message role: %q", msg.Role)
+				return nil, nil, nil, fmt.Errorf("invalid chat message role: %q", msg.Role)
 			}
 			var parts []geminiPart
 			var err error
@@ -173,7 +208,7 @@ func convertCompletionsMessagesToGemini(messages []completionsMessage) ([]gemini
 				parts, err = convertCompletionsContentToGeminiParts(msg.Content)
 			}
 			if err != nil {
-				return nil, err
+				return nil, nil, nil, err
 			}
 			chatMessages = append(chatMessages, geminiContent{
 				Role:  role,
@@ -182,12 +217,10 @@ func convertCompletionsMessagesToGemini(messages []completionsMessage) ([]gemini
 		}
 	}
 	if len(chatMessages) == 0 {
-		return []geminiContent{}, errors.New("no user message found")
+		return []geminiContent{}, nil, nil, errors.New("no user message found")
 	}
-	if len(systemMessages) > 0 {
-		chatMessages[0].Parts = append(systemMessages, chatMessages[0].Parts...)
-	}
-	return chatMessages, nil
+	contents, ends := mergeTurns(chatMessages)
+	return contents, ends, systemMessages, nil
 }
 
 func mergeCompletionsParameters(target *cfg.GenerationConfig, source *completionsInput) error {
@@ -203,6 +236,27 @@ func mergeCompletionsParameters(target *cfg.GenerationConfig, source *completion
 	if source.TopP != nil {
 		target.TopP = source.TopP
 	}
+	if source.N != nil {
+		target.CandidateCount = source.N
+	}
+	if len(source.Stop) > 0 {
+		target.StopSequences = source.Stop
+	}
+	if source.Seed != nil {
+		target.Seed = source.Seed
+	}
+	if source.PresencePenalty != nil {
+		target.PresencePenalty = source.PresencePenalty
+	}
+	if source.FrequencyPenalty != nil {
+		target.FrequencyPenalty = source.FrequencyPenalty
+	}
+	if source.Logprobs {
+		target.ResponseLogprobs = true
+		if source.TopLogprobs != nil && *source.TopLogprobs > 0 {
+			target.Logprobs = source.TopLogprobs
+		}
+	}
 	if len(source.ReasoningEffort) > 0 {
 		var think thinkLevel
 		if source.ReasoningEffort == "minimal" {
@@ -238,40 +292,45 @@ func mergeCompletionsParameters(target *cfg.GenerationConfig, source *completion
 	return nil
 }
 
-func convertCompletionsBodyToGemini(input *completionsInput) (interface{}, error) {
-	chatMessages, err := convertCompletionsMessagesToGemini(input.Messages)
+func convertCompletionsBodyToGemini(input *completionsInput, target *modelTarget) (*geminiBody, error) {
+	chatMessages, ends, systemParts, err := convertCompletionsMessagesToGemini(input.Messages)
 	if err != nil {
 		return nil, err
 	}
-	generationConfig := cfg.Defaults.GeminiDefaults.GenerationConfig
+	generationConfig := target.generationConfig()
 	if err := mergeCompletionsParameters(&generationConfig, input); err != nil {
 		return nil, err
 	}
 	tools := convertToolsToGemini(input.Tools)
 	body := &geminiBody{
-		Contents:         chatMessages,
-		GenerationConfig: generationConfig,
-		SafetySettings:   cfg.Defaults.GeminiDefaults.SafetySettings,
-		Tools:            tools,
+		Contents:          chatMessages,
+		SystemInstruction: newSystemInstruction(systemParts),
+		GenerationConfig:  generationConfig,
+		SafetySettings:    cfg.MergeSafetySettings(target.safetySettings(), input.SafetySettings),
+		Tools:             tools,
+		cachedTurns:       countCachedTurns(ends, input.ContextCache),
 	}
+	target.Redaction.redactBody(body)
 	return body, nil
 }
 
-func prepareCompletionsBody(input *completionsInput) (string, interface{}, interface{}, error) {
+func prepareCompletionsBody(input *completionsInput, target *modelTarget) (string, interface{}, interface{}, error) {
 	urlPrefix := input.Model + ":generateContent"
-	body, err := convertCompletionsBodyToGemini(input)
+	body, err := convertCompletionsBodyToGemini(input, target)
 	if err != nil {
 		return "", nil, nil, err
 	}
+	finishChatBody(body, input.Model, nil)
 	return urlPrefix, body, &geminiCompleteOutput{}, nil
 }
 
-func prepareCompletionsStream(input *completionsInput) (string, interface{}, interface{}, interface{}, error) {
+func prepareCompletionsStream(input *completionsInput, target *modelTarget) (string, interface{}, interface{}, interface{}, error) {
 	urlPrefix := input.Model + ":streamGenerateContent?alt=sse"
-	body, err := convertCompletionsBodyToGemini(input)
+	body, err := convertCompletionsBodyToGemini(input, target)
 	if err != nil {
 		return "", nil, nil, nil, err
 	}
+	finishChatBody(body, input.Model, nil)
 	return urlPrefix, body, &geminiPartialOutput{}, &geminiFinalOutput{}, nil
 }
 
@@ -282,15 +341,19 @@ type outputMessage struct {
 }
 
 type deltaChoice struct {
-	Index        int           `json:"index"`
-	Delta        outputMessage `json:"delta"`
-	FinishReason *string       `json:"finish_reason"`
+	Index        int             `json:"index"`
+	Delta        outputMessage   `json:"delta"`
+	Logprobs     *choiceLogprobs `json:"logprobs"`
+	FinishReason *string         `json:"finish_reason"`
+	candidateSafety
 }
 
 type completeChoice struct {
-	Index        int           `json:"index"`
-	Message      outputMessage `json:"message"`
-	FinishReason *string       `json:"finish_reason"`
+	Index        int             `json:"index"`
+	Message      outputMessage   `json:"message"`
+	Logprobs     *choiceLogprobs `json:"logprobs"`
+	FinishReason *string         `json:"finish_reason"`
+	candidateSafety
 }
 
 type completionsResponse struct {
@@ -301,10 +364,29 @@ type completionsResponse struct {
 	SystemFingerprint string `json:"system_fingerprint"`
 }
 
+type promptTokensDetails struct {
+	CachedTokens int `json:"cached_tokens"`
+}
+
 type completionsUsage struct {
-	CompletionTokens int `json:"completion_tokens"`
-	PromptTokens     int `json:"prompt_tokens"`
-	TotalTokens      int `json:"total_tokens"`
+	CompletionTokens    int                  `json:"completion_tokens"`
+	PromptTokens        int                  `json:"prompt_tokens"`
+	TotalTokens         int                  `json:"total_tokens"`
+	PromptTokensDetails *promptTokensDetails `json:"prompt_tokens_details,omitempty"`
+}
+
+func createCompletionsUsage(promptTokens int, contentTokens int, cachedTokens int) completionsUsage {
+	usage := completionsUsage{
+		CompletionTokens: contentTokens,
+		PromptTokens:     promptTokens,
+		TotalTokens:      promptTokens + contentTokens,
+	}
+	if cachedTokens > 0 {
+		usage.PromptTokensDetails = &promptTokensDetails{
+			CachedTokens: cachedTokens,
+		}
+	}
+	return usage
 }
 
 type completionsCompleteResponse struct {
@@ -337,12 +419,11 @@ func createCompletionsResponse(model string, chunked bool) completionsResponse {
 
 func HandleCompletions(w http.ResponseWriter, r *http.Request) int {
 	input := completionsInput{
-		ReasoningEffort: "medium",
-		Stream:          false,
+		Stream: false,
 	}
 	reqPayload, err := io.ReadAll(r.Body)
 	if err != nil {
-		return wrongInput(w, fmt.Sprintf("reading request body failed: %v", err))
+		return failReading(w, r, err)
 	}
 	if err := json.Unmarshal(reqPayload, &input); err != nil {
 		return wrongInput(w, fmt.Sprintf("decoding request body failed: %v", err))
@@ -357,33 +438,65 @@ func HandleCompletions(w http.ResponseWriter, r *http.Request) int {
 		return wrongInput(w, "messages missing")
 	}
 
-	var forward bool
-	if strings.HasPrefix(input.Model, "gemini") {
-		forward = true
-	} else if !canProxy {
-		return wrongInput(w, fmt.Sprintf("unrecognised model %q", input.Model))
+	target, err := resolveModel(input.Model, isGeminiModel)
+	if err != nil {
+		return wrongInput(w, err.Error())
 	}
 	if log.IsDbg {
 		log.Dbg("> ask with %d message%s using %s", len(input.Messages),
-			log.GetPlural(len(input.Messages)), input.Model)
+			log.GetPlural(len(input.Messages)), target.Model)
+	}
+	if status := validateRequest(w, r, reqPayload, &input, findUnsupported(reqPayload, unsupportedCompletionsFields, ""), target,
+		func() []validationProblem {
+			return checkCompletionsParameters(&input, target.Model)
+		}); status != 0 {
+		return status
 	}
 
-	if !forward {
+	if !target.Forward {
+		if reqPayload, err = target.proxyPayload(reqPayload, "model"); err != nil {
+			return wrongInput(w, err.Error())
+		}
 		if input.Stream {
-			return proxyStream("chat/completions", reqPayload, w, r, "answer", input.Model)
+			return proxyStream("chat/completions", reqPayload, w, r, "answer", target.Model, target.responseModel())
 		}
-		return proxyRequest("chat/completions", reqPayload, w, "answer", input.Model)
+		return proxyRequest("chat/completions", reqPayload, w, "answer", target.Model, target.responseModel())
+	}
+	if len(input.LogitBias) > 0 {
+		return rejectRequest(w, r, http.StatusBadRequest, "logit_bias not supported by gemini models", "unsupported_parameter")
+	}
+	if status := checkSafetySettings(w, r, target, input.SafetySettings, "$.safety_settings"); status != 0 {
+		return status
+	}
+	input.Model = target.Model
+	if len(input.ReasoningEffort) == 0 {
+		input.ReasoningEffort = string(target.thinkLevel("medium"))
 	}
 
 	if input.Stream {
-		urlSuffix, reqBody, partialOutput, finalOutput, err := prepareCompletionsStream(&input)
+		candidateCount := 1
+		answered, _, resReader, _, _, status, err := forwardStreamWithFallback(w, getCachePolicy(r), target,
+			func(attempt *modelTarget) (string, interface{}, interface{}, interface{}, error) {
+				input.Model = attempt.Model
+				urlPrefix, body, partialOutput, finalOutput, err := prepareCompletionsStream(&input, attempt)
+				if err == nil {
+					candidateCount = getCandidateCount(body)
+				}
+				return urlPrefix, body, partialOutput, finalOutput, err
+			})
 		if err != nil {
-			return wrongInput(w, err.Error())
+			if answered == nil {
+				return failPreparing(w, r, err)
+			}
+			return failForwarding(w, r, status, err)
 		}
-		status, _, resReader, err := forwardStream(urlSuffix, reqBody)
-		if err != nil {
-			return failRequest(w, status, err.Error())
+		if !answered.Forward {
+			if reqPayload, err = answered.proxyPayload(reqPayload, "model"); err != nil {
+				return wrongInput(w, err.Error())
+			}
+			return proxyStream("chat/completions", reqPayload, w, r, "answer", answered.Model, answered.responseModel())
 		}
+		target = answered
 		defer func() {
 			if err := resReader.Close(); err != nil {
 				log.Dbg("closing response body stream failed: %v", err)
@@ -399,47 +512,59 @@ func HandleCompletions(w http.ResponseWriter, r *http.Request) int {
 		}
 		w.Header().Set("Content-Type", contentType)
 		w.WriteHeader(status)
+		// candidates finish independently, the stream ends when all of them did
+		finished := 0
+		// the finish reason may come in a later chunk than the tool calls
+		calledTools := make(map[int]bool)
+		var metadata geminiMetadata
 		var rest []byte
 		for {
 			if f, ok := w.(http.Flusher); ok {
 				f.Flush()
 			}
-			var content string
-			var functionCalls []functionCall
-			var reason string
-			var promptTokens int
-			var contentTokens int
+			var candidates []candidateParts
+			var usage *geminiMetadata
 			var reader io.Reader
 			if len(rest) > 0 {
 				reader = bytes.NewReader(rest)
 			} else {
 				reader = resReader
 			}
-			_, content, functionCalls, reason, rest, promptTokens, contentTokens, err = extractStreamGeminiResponse(reader, partialOutput, finalOutput)
-			var resBody any
-			final := false
+			candidates, usage, rest, err = readStreamCandidates(reader)
 			if err != nil {
 				break
 			}
-			toolCalls := convertFunctionCallsToToolCalls(functionCalls)
-			final = len(reason) > 0
-			var outputReason *string
-			if final {
-				stringReason := strings.ToLower(reason)
-				outputReason = &stringReason
-			}
-			resBody = &completionsDeltaResponse{
-				completionsResponse: createCompletionsResponse(input.Model, true),
-				Choices: []deltaChoice{
-					{
-						Delta: outputMessage{
-							Role:      "assistant",
-							Content:   content,
-							ToolCalls: toolCalls,
-						},
-						FinishReason: outputReason,
+			if *usage != (geminiMetadata{}) {
+				metadata = *usage
+			}
+			choices := make([]deltaChoice, len(candidates))
+			for i, candidate := range candidates {
+				if len(candidate.FunctionCalls) > 0 {
+					calledTools[candidate.Index] = true
+				}
+				target.Redaction.restoreFunctionCalls(candidate.FunctionCalls)
+				answer := target.Redaction.restoreChunk(strconv.Itoa(candidate.Index), candidate.Answer, len(candidate.Reason) > 0)
+				var outputReason *string
+				if len(candidate.Reason) > 0 {
+					stringReason := convertFinishReason(candidate.Reason, calledTools[candidate.Index])
+					outputReason = &stringReason
+					finished++
+				}
+				choices[i] = deltaChoice{
+					Index: candidate.Index,
+					Delta: outputMessage{
+						Role:      "assistant",
+						Content:   answer,
+						ToolCalls: convertFunctionCallsToToolCalls(candidate.FunctionCalls),
 					},
-				},
+					Logprobs:        convertLogprobs(candidate.Logprobs),
+					FinishReason:    outputReason,
+					candidateSafety: candidate.Safety,
+				}
+			}
+			resBody := &completionsDeltaResponse{
+				completionsResponse: createCompletionsResponse(target.responseModel(), true),
+				Choices:             choices,
 			}
 			if sse {
 				web.WriteResponseString(w, "data: ")
@@ -450,73 +575,113 @@ func HandleCompletions(w http.ResponseWriter, r *http.Request) int {
 			if sse {
 				web.WriteResponseString(w, "\n\n")
 			}
-			if final {
-				if input.StreamOptions.IncludeUsage {
-					resBody = &completionsCompleteResponse{
-						completionsResponse: createCompletionsResponse(input.Model, true),
-						Choices:             []completeChoice{},
-						Usage: completionsUsage{
-							CompletionTokens: contentTokens,
-							PromptTokens:     promptTokens,
-							TotalTokens:      promptTokens + contentTokens,
-						},
-					}
-					if f, ok := w.(http.Flusher); ok {
-						f.Flush()
-					}
-					if sse {
-						web.WriteResponseString(w, "data: ")
-					}
-					if err = json.NewEncoder(w).Encode(resBody); err != nil {
-						log.Dbg("! encoding response body failed: %v", err)
-					}
-					if sse {
-						web.WriteResponseString(w, "\n\n")
-					}
-				}
-				if sse {
-					if f, ok := w.(http.Flusher); ok {
-						f.Flush()
-					}
-					web.WriteResponseString(w, "data: [DONE]\n\n")
-				}
+			if finished >= candidateCount {
 				break
 			}
 		}
+		// the end of a placeholder held back by the redaction wouldn't come,
+		// if the stream ended without the finish reason
+		var choices []deltaChoice
+		for index := range candidateCount {
+			if answer := target.Redaction.restoreChunk(strconv.Itoa(index), "", true); len(answer) > 0 {
+				choices = append(choices, deltaChoice{
+					Index: index,
+					Delta: outputMessage{
+						Role:    "assistant",
+						Content: answer,
+					},
+				})
+			}
+		}
+		if len(choices) > 0 {
+			resBody := &completionsDeltaResponse{
+				completionsResponse: createCompletionsResponse(target.responseModel(), true),
+				Choices:             choices,
+			}
+			if sse {
+				web.WriteResponseString(w, "data: ")
+			}
+			if err = json.NewEncoder(w).Encode(resBody); err != nil {
+				log.Dbg("! encoding response body failed: %v", err)
+			}
+			if sse {
+				web.WriteResponseString(w, "\n\n")
+			}
+		}
+		// the stream can end before all candidates finished, if some were
+		// blocked or the stream was interrupted, the client needs the end anyway
+		if input.StreamOptions.IncludeUsage {
+			resBody := &completionsCompleteResponse{
+				completionsResponse: createCompletionsResponse(target.responseModel(), true),
+				Choices:             []completeChoice{},
+				Usage: createCompletionsUsage(metadata.PromptTokenCount, metadata.CandidatesTokenCount,
+					metadata.CachedContentTokenCount),
+			}
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
+			if sse {
+				web.WriteResponseString(w, "data: ")
+			}
+			if err = json.NewEncoder(w).Encode(resBody); err != nil {
+				log.Dbg("! encoding response body failed: %v", err)
+			}
+			if sse {
+				web.WriteResponseString(w, "\n\n")
+			}
+		}
+		if sse {
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
+			web.WriteResponseString(w, "data: [DONE]\n\n")
+		}
 	} else {
-		urlSuffix, reqBody, output, err := prepareCompletionsBody(&input)
+		answered, output, status, _, err := forwardRequestWithFallback(w, getCachePolicy(r), target,
+			func(attempt *modelTarget) (string, interface{}, interface{}, error) {
+				input.Model = attempt.Model
+				return prepareCompletionsBody(&input, attempt)
+			})
 		if err != nil {
-			return wrongInput(w, err.Error())
+			if answered == nil {
+				return failPreparing(w, r, err)
+			}
+			return failForwarding(w, r, status, err)
 		}
-		status, _, err := forwardRequest(urlSuffix, reqBody, output)
-		if err != nil {
-			return failRequest(w, status, err.Error())
+		if !answered.Forward {
+			if reqPayload, err = answered.proxyPayload(reqPayload, "model"); err != nil {
+				return wrongInput(w, err.Error())
+			}
+			return proxyRequest("chat/completions", reqPayload, w, "answer", answered.Model, answered.responseModel())
 		}
-		_, content, functionCalls, reason, promptTokens, contentTokens := extractCompleteGeminiResponse(output)
+		target = answered
+		target.Redaction.restoreOutput(output)
+		_, content, _, _, promptTokens, contentTokens := extractCompleteGeminiResponse(output)
 		tokens := promptTokens + contentTokens
 		if log.IsDbg {
-			log.Dbg("< answer by %s with %d character%s and %d token%s", input.Model,
+			log.Dbg("< answer by %s with %d character%s and %d token%s", target.Model,
 				len(content), log.GetPlural(len(content)), tokens, log.GetPlural(tokens))
 		}
-		toolCalls := convertFunctionCallsToToolCalls(functionCalls)
-		outputReason := strings.ToLower(reason)
-		resBody := &completionsCompleteResponse{
-			completionsResponse: createCompletionsResponse(input.Model, false),
-			Choices: []completeChoice{
-				{
-					Message: outputMessage{
-						Role:      "assistant",
-						Content:   content,
-						ToolCalls: toolCalls,
-					},
-					FinishReason: &outputReason,
+		candidates := extractCompleteGeminiCandidates(output)
+		choices := make([]completeChoice, len(candidates))
+		for i, candidate := range candidates {
+			outputReason := convertFinishReason(candidate.Reason, len(candidate.FunctionCalls) > 0)
+			choices[i] = completeChoice{
+				Index: candidate.Index,
+				Message: outputMessage{
+					Role:      "assistant",
+					Content:   candidate.Answer,
+					ToolCalls: convertFunctionCallsToToolCalls(candidate.FunctionCalls),
 				},
-			},
-			Usage: completionsUsage{
-				CompletionTokens: contentTokens,
-				PromptTokens:     promptTokens,
-				TotalTokens:      promptTokens + contentTokens,
-			},
+				Logprobs:        convertLogprobs(candidate.Logprobs),
+				FinishReason:    &outputReason,
+				candidateSafety: candidate.Safety,
+			}
+		}
+		resBody := &completionsCompleteResponse{
+			completionsResponse: createCompletionsResponse(target.responseModel(), false),
+			Choices:             choices,
+			Usage:               createCompletionsUsage(promptTokens, contentTokens, getCachedTokens(output)),
 		}
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(status)
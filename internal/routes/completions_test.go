@@ -0,0 +1,31 @@
+package routes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prantlf/ovai/internal/test"
+)
+
+func TestCompletionsStreamUnfinishedCandidates(t *testing.T) {
+	newTestVertex(t, func(w http.ResponseWriter, r *http.Request) {
+		// the second candidate never finishes
+		writeTestEvents(w,
+			`{"candidates":[{"index":0,"content":{"role":"model","parts":[{"text":"A"}]}},{"index":1,"content":{"role":"model","parts":[{"text":"B"}]}}]}`,
+			`{"candidates":[{"index":0,"content":{"role":"model","parts":[{"text":"."}]},"finishReason":"STOP"}],"usageMetadata":{"promptTokenCount":3,"candidatesTokenCount":2}}`)
+	})
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{
+		"model": "gemini-2.5-flash",
+		"messages": [{ "role": "user", "content": "Hi!" }],
+		"n": 2,
+		"stream": true,
+		"stream_options": { "include_usage": true }
+	}`))
+	test.Equal(t, http.StatusOK, HandleCompletions(w, r))
+	body := w.Body.String()
+	test.Equal(t, true, strings.Contains(body, `"usage":{"completion_tokens":2,"prompt_tokens":3`))
+	test.Equal(t, true, strings.HasSuffix(body, "data: [DONE]\n\n"))
+}
@@ -0,0 +1,344 @@
+package routes
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prantlf/ovai/internal/auth"
+	"github.com/prantlf/ovai/internal/log"
+	"github.com/prantlf/ovai/internal/web"
+)
+
+type cachedContentBody struct {
+	Model             string          `json:"model"`
+	Contents          []geminiContent `json:"contents,omitempty"`
+	SystemInstruction *geminiContent  `json:"systemInstruction,omitempty"`
+	Tools             []toolsWrapper  `json:"tools,omitempty"`
+	Ttl               string          `json:"ttl"`
+}
+
+type cachedContentTtl struct {
+	Ttl string `json:"ttl"`
+}
+
+type cachedContentMetadata struct {
+	TotalTokenCount int `json:"totalTokenCount"`
+}
+
+type cachedContentOutput struct {
+	Name          string                `json:"name"`
+	ExpireTime    time.Time             `json:"expireTime"`
+	UsageMetadata cachedContentMetadata `json:"usageMetadata"`
+}
+
+type contextInfo struct {
+	Name      string    `json:"name"`
+	Model     string    `json:"model"`
+	Messages  int       `json:"messages"`
+	Tokens    int       `json:"tokens"`
+	Uses      int       `json:"uses"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// contextCache tracks a cachedContents resource created in Vertex AI.
+type contextCache struct {
+	lock sync.Mutex
+	contextInfo
+}
+
+type contextsOutput struct {
+	Contexts []contextInfo `json:"contexts"`
+}
+
+var contextCacheAuto bool
+var contextCacheMinSize int
+var contextCacheTtl = time.Hour
+var contextCaches = make(map[string]*contextCache)
+var contextCachesLock sync.Mutex
+
+func SetContextCache(auto bool, minSize int, ttl time.Duration) {
+	contextCacheAuto = auto
+	contextCacheMinSize = minSize
+	contextCacheTtl = ttl
+}
+
+func formatTtl(ttl time.Duration) string {
+	return fmt.Sprintf("%ds", int(ttl.Seconds()))
+}
+
+func dispatchVertexRequest(createRequest func() (*http.Request, error), output interface{}) (int, error) {
+	dispatchRequest := func() (int, error) {
+		accessToken, err := auth.UseAccessToken()
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		req, err := createRequest()
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+		return web.DispatchRequest(web.Vertex, req, output)
+	}
+
+	status, err := dispatchRequest()
+	if err != nil && status == 401 {
+		auth.RefreshAccessToken()
+		status, err = dispatchRequest()
+	}
+	return status, err
+}
+
+// countLeadingContents returns the count of contents to cache automatically.
+// The first user message usually carries the shared documents. At least one
+// content has to stay in the request.
+func countLeadingContents(contents []geminiContent) int {
+	for i, content := range contents {
+		if content.Role == "user" {
+			if i+1 < len(contents) {
+				return i + 1
+			}
+			return i
+		}
+	}
+	return 0
+}
+
+// applyContextCache replaces the system instruction, the leading contents and
+// tools with a reference to the cached content, if the request qualifies for
+// caching. The explicit count of leading messages is nil for the automatic
+// mode and negative to disable caching.
+func applyContextCache(body *geminiBody, model string, leadingMessages *int) bool {
+	var count int
+	if leadingMessages != nil {
+		count = *leadingMessages
+		if count < 0 {
+			return false
+		}
+		if count >= len(body.Contents) {
+			count = len(body.Contents) - 1
+		}
+	} else {
+		if !contextCacheAuto {
+			return false
+		}
+		count = countLeadingContents(body.Contents)
+	}
+	if count == 0 && body.SystemInstruction == nil {
+		return false
+	}
+	locationPath, err := getLocationPath()
+	if err != nil {
+		return false
+	}
+	modelPath, err := getModelPath(model)
+	if err != nil {
+		return false
+	}
+	cacheBody := &cachedContentBody{
+		Contents:          body.Contents[:count],
+		SystemInstruction: body.SystemInstruction,
+		Tools:             body.Tools,
+	}
+	cacheJson, err := json.Marshal(cacheBody)
+	if err != nil {
+		log.Dbg("! encoding cached content failed: %v", err)
+		return false
+	}
+	if leadingMessages == nil && len(cacheJson) < contextCacheMinSize {
+		return false
+	}
+	hash := sha256.New()
+	hash.Write([]byte(modelPath))
+	hash.Write([]byte{0})
+	hash.Write(cacheJson)
+	key := hex.EncodeToString(hash.Sum(nil))
+	cacheBody.Model = modelPath
+	cacheBody.Ttl = formatTtl(contextCacheTtl)
+
+	cache := getContextCache(key, model, count)
+	name, err := cache.use(locationPath, cacheBody)
+	if err != nil {
+		log.Log("caching context for %s failed: %v", model, err)
+		return false
+	}
+	body.CachedContent = name
+	body.Contents = body.Contents[count:]
+	body.SystemInstruction = nil
+	body.Tools = nil
+	return true
+}
+
+func getContextCache(key string, model string, messages int) *contextCache {
+	contextCachesLock.Lock()
+	defer contextCachesLock.Unlock()
+	cache, ok := contextCaches[key]
+	if !ok {
+		cache = &contextCache{
+			contextInfo: contextInfo{
+				Model:    model,
+				Messages: messages,
+			},
+		}
+		contextCaches[key] = cache
+	}
+	return cache
+}
+
+// use creates the cached content, if it doesn't exist or expired, and
+// extends its lifetime, if more than a half of it passed.
+func (c *contextCache) use(locationPath string, cacheBody *cachedContentBody) (string, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := time.Now()
+	if len(c.Name) > 0 && now.Before(c.ExpiresAt) {
+		if c.ExpiresAt.Sub(now) > contextCacheTtl/2 {
+			c.Uses++
+			return c.Name, nil
+		}
+		var output cachedContentOutput
+		_, err := dispatchVertexRequest(func() (*http.Request, error) {
+			return web.CreatePatchRequest(getApiUrl(c.Name), &cachedContentTtl{Ttl: cacheBody.Ttl})
+		}, &output)
+		if err == nil {
+			log.Dbg(": extended cached context %s", c.Name)
+			c.ExpiresAt = output.ExpireTime
+			c.Uses++
+			return c.Name, nil
+		}
+		log.Dbg("! extending cached context %s failed: %v", c.Name, err)
+	}
+	var output cachedContentOutput
+	_, err := dispatchVertexRequest(func() (*http.Request, error) {
+		return web.CreatePostRequest(getApiUrl(locationPath+"/cachedContents"), cacheBody)
+	}, &output)
+	if err != nil {
+		c.Name = ""
+		return "", err
+	}
+	log.Dbg(": cached context %s with %d tokens", output.Name, output.UsageMetadata.TotalTokenCount)
+	c.Name = output.Name
+	c.Tokens = output.UsageMetadata.TotalTokenCount
+	c.CreatedAt = now
+	c.ExpiresAt = output.ExpireTime
+	c.Uses = 1
+	return c.Name, nil
+}
+
+func getCachedTokens(output interface{}) int {
+	switch output := output.(type) {
+	case *geminiCompleteOutput:
+		return output.UsageMetadata.CachedContentTokenCount
+	case *geminiFinalOutput:
+		return output.UsageMetadata.CachedContentTokenCount
+	}
+	return 0
+}
+
+func listContextCaches() []contextInfo {
+	contextCachesLock.Lock()
+	defer contextCachesLock.Unlock()
+	now := time.Now()
+	caches := make([]contextInfo, 0, len(contextCaches))
+	for key, cache := range contextCaches {
+		cache.lock.Lock()
+		info := cache.contextInfo
+		cache.lock.Unlock()
+		if len(info.Name) == 0 || now.After(info.ExpiresAt) {
+			delete(contextCaches, key)
+		} else {
+			caches = append(caches, info)
+		}
+	}
+	slices.SortFunc(caches, func(a, b contextInfo) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+	return caches
+}
+
+func forgetContextCache(name string) {
+	contextCachesLock.Lock()
+	defer contextCachesLock.Unlock()
+	for key, cache := range contextCaches {
+		cache.lock.Lock()
+		found := cache.Name == name
+		cache.lock.Unlock()
+		if found {
+			delete(contextCaches, key)
+		}
+	}
+}
+
+var contextNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// checkContextCacheName accepts only names of cachedContents resources in the
+// configured project and location, to make sure that no other resource will
+// be deleted.
+func checkContextCacheName(name string) error {
+	locationPath, err := getLocationPath()
+	if err != nil {
+		return err
+	}
+	id, found := strings.CutPrefix(name, locationPath+"/cachedContents/")
+	if !found || !contextNamePattern.MatchString(id) {
+		return fmt.Errorf("invalid cached content name: %s", name)
+	}
+	return nil
+}
+
+func deleteContextCache(name string) (int, error) {
+	var output struct{}
+	status, err := dispatchVertexRequest(func() (*http.Request, error) {
+		return web.CreateDeleteRequest(getApiUrl(name))
+	}, &output)
+	// a cache deleted or expired in Vertex AI will not be used any more
+	if err == nil || status == http.StatusNotFound {
+		forgetContextCache(name)
+	}
+	return status, err
+}
+
+func HandleContexts(w http.ResponseWriter, r *http.Request) int {
+	caches := listContextCaches()
+	if r.Method == "DELETE" {
+		name := r.URL.Query().Get("name")
+		if len(name) > 0 {
+			if err := checkContextCacheName(name); err != nil {
+				return wrongInput(w, err.Error())
+			}
+			log.Dbg(": delete cached context %s", name)
+			if status, err := deleteContextCache(name); err != nil {
+				return failRequest(w, status, err.Error())
+			}
+		} else {
+			log.Dbg(": delete %d cached context%s", len(caches), log.GetPlural(len(caches)))
+			for _, cache := range caches {
+				if status, err := deleteContextCache(cache.Name); err != nil && status != http.StatusNotFound {
+					return failRequest(w, status, err.Error())
+				}
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return http.StatusNoContent
+	}
+	log.Dbg(": list %d cached context%s", len(caches), log.GetPlural(len(caches)))
+	output := &contextsOutput{
+		Contexts: caches,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if r.Method != "HEAD" {
+		if err := json.NewEncoder(w).Encode(output); err != nil {
+			log.Dbg("! encoding response body failed: %v", err)
+		}
+	}
+	return http.StatusOK
+}
@@ -0,0 +1,26 @@
+package routes
+
+import (
+	"testing"
+
+	"github.com/prantlf/ovai/internal/auth"
+	"github.com/prantlf/ovai/internal/cfg"
+	"github.com/prantlf/ovai/internal/test"
+)
+
+func TestCheckContextCacheName(t *testing.T) {
+	accnt := auth.GetAccount()
+	auth.SetAccount(&auth.Account{ProjectId: "p"})
+	defer auth.SetAccount(accnt)
+	location := cfg.GetDefaults().ApiLocation
+
+	test.Nil(t, checkContextCacheName("projects/p/locations/"+location+"/cachedContents/123"))
+	test.NotNil(t, checkContextCacheName("projects/p/locations/"+location+"/endpoints/123?x=/cachedContents/"))
+	test.NotNil(t, checkContextCacheName("projects/p/locations/"+location+"/cachedContents/123/x"))
+	test.NotNil(t, checkContextCacheName("projects/p/locations/"+location+"/cachedContents/123?x=1"))
+	test.NotNil(t, checkContextCacheName("projects/q/locations/"+location+"/cachedContents/123"))
+	test.NotNil(t, checkContextCacheName("projects/p/locations/"+location+"/cachedContents/"))
+	test.NotNil(t, checkContextCacheName("projects/p/locations/"+location+"/cachedContents/.."))
+	test.NotNil(t, checkContextCacheName("projects/p/locations/"+location+"/cachedContents/%2e%2e"))
+	test.NotNil(t, checkContextCacheName("projects/p/locations/"+location+"/cachedContents/..%2Fendpoints%2F123"))
+}
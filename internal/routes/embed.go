@@ -6,7 +6,6 @@ import (
 	"io"
 	"net/http"
 	"strconv"
-	"strings"
 
 	"github.com/prantlf/ovai/internal/log"
 )
@@ -46,7 +45,7 @@ func HandleEmbed(w http.ResponseWriter, r *http.Request) int {
 	var input embedInput
 	reqPayload, err := io.ReadAll(r.Body)
 	if err != nil {
-		return wrongInput(w, fmt.Sprintf("reading request body failed: %v", err))
+		return failReading(w, r, err)
 	}
 	if err := json.Unmarshal(reqPayload, &input); err != nil {
 		return wrongInput(w, fmt.Sprintf("decoding request body failed: %v", err))
@@ -68,31 +67,35 @@ func HandleEmbed(w http.ResponseWriter, r *http.Request) int {
 		totalChars += len(text)
 	}
 
-	var forward bool
-	if strings.HasPrefix(input.Model, "textembedding-gecko") ||
-		strings.HasPrefix(input.Model, "textembedding-gecko-multilingual") ||
-		strings.HasPrefix(input.Model, "text-embedding") ||
-		strings.HasPrefix(input.Model, "multimodalembedding") ||
-		strings.HasPrefix(input.Model, "text-multilingual-embedding") ||
-		strings.HasPrefix(input.Model, "gemini-embedding") {
-		forward = true
-	} else if !canProxy {
-		return wrongInput(w, fmt.Sprintf("unrecognised model %q", input.Model))
+	target, err := resolveModel(input.Model, isEmbeddingModel)
+	if err != nil {
+		return wrongInput(w, err.Error())
 	}
 	if log.IsDbg {
 		log.Dbg("> vectorise %d text%s with %d character%s using %s", len(input.Input),
-			log.GetPlural(len(input.Input)), totalChars, log.GetPlural(totalChars), input.Model)
+			log.GetPlural(len(input.Input)), totalChars, log.GetPlural(totalChars), target.Model)
+	}
+	if status := validateRequest(w, r, reqPayload, &input, findUnsupported(reqPayload, unsupportedEmbedFields, ""), target, nil); status != 0 {
+		return status
 	}
 
-	if !forward {
-		return proxyRequest("embed", reqPayload, w, "embeddings", input.Model)
+	if !target.Forward {
+		if reqPayload, err = target.proxyPayload(reqPayload, "model"); err != nil {
+			return wrongInput(w, err.Error())
+		}
+		return proxyRequest("embed", reqPayload, w, "embeddings", target.Model, target.responseModel())
+	}
+	input.Model = target.Model
+	if input.Dimensionality == 0 {
+		input.Dimensionality = target.dimensionality()
 	}
+	policy := getCachePolicy(r)
 	embeddings := make([][]float64, len(input.Input))
 	for i, text := range input.Input {
 		reqBody := &embeddingsBody{
 			Instances: []instance{
 				{
-					Content: text,
+					Content: target.Redaction.redact(text),
 				},
 			},
 		}
@@ -102,7 +105,7 @@ func HandleEmbed(w http.ResponseWriter, r *http.Request) int {
 			}
 		}
 		var resBody embeddingsResponse
-		status, _, err := forwardRequest(input.Model+":predict", reqBody, &resBody)
+		status, _, err := forwardRequestCached(w, policy, input.Model+":predict", reqBody, &resBody, 0)
 		if err != nil {
 			return failRequest(w, status, err.Error())
 		}
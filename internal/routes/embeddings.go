@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"io"
 	"net/http"
-	"strings"
 
 	"github.com/prantlf/ovai/internal/log"
 )
@@ -61,7 +60,7 @@ func HandleEmbeddings(w http.ResponseWriter, r *http.Request) int {
 	var input embeddingsInput
 	reqPayload, err := io.ReadAll(r.Body)
 	if err != nil {
-		return wrongInput(w, fmt.Sprintf("reading request body failed: %v", err))
+		return failReading(w, r, err)
 	}
 	if err := json.Unmarshal(reqPayload, &input); err != nil {
 		return wrongInput(w, fmt.Sprintf("decoding request body failed: %v", err))
@@ -76,34 +75,39 @@ func HandleEmbeddings(w http.ResponseWriter, r *http.Request) int {
 		return wrongInput(w, "prompt missing")
 	}
 
-	var forward bool
-	if strings.HasPrefix(input.Model, "textembedding-gecko") ||
-		strings.HasPrefix(input.Model, "textembedding-gecko-multilingual") ||
-		strings.HasPrefix(input.Model, "text-embedding") ||
-		strings.HasPrefix(input.Model, "multimodalembedding") ||
-		strings.HasPrefix(input.Model, "text-multilingual-embedding") ||
-		strings.HasPrefix(input.Model, "gemini-embedding") {
-		forward = true
-	} else if !canProxy {
-		return wrongInput(w, fmt.Sprintf("unrecognised model %q", input.Model))
+	target, err := resolveModel(input.Model, isEmbeddingModel)
+	if err != nil {
+		return wrongInput(w, err.Error())
 	}
 	if log.IsDbg {
 		log.Dbg("> vectorise %d character%s using %s", len(input.Prompt),
-			log.GetPlural(len(input.Prompt)), input.Model)
+			log.GetPlural(len(input.Prompt)), target.Model)
+	}
+	if status := validateRequest(w, r, reqPayload, &input, findUnsupported(reqPayload, unsupportedEmbeddingsFields, ""), target, nil); status != 0 {
+		return status
 	}
 
-	if !forward {
-		return proxyRequest("embeddings", reqPayload, w, "embedding", input.Model)
+	if !target.Forward {
+		if reqPayload, err = target.proxyPayload(reqPayload, "model"); err != nil {
+			return wrongInput(w, err.Error())
+		}
+		return proxyRequest("embeddings", reqPayload, w, "embedding", target.Model, target.responseModel())
 	}
+	input.Model = target.Model
 	reqBody := &embeddingsBody{
 		Instances: []instance{
 			{
-				Content: input.Prompt,
+				Content: target.Redaction.redact(input.Prompt),
 			},
 		},
 	}
+	if dimensionality := target.dimensionality(); dimensionality > 0 {
+		reqBody.Parameters = &embeddingParameters{
+			OutputDimensionality: dimensionality,
+		}
+	}
 	var resBody embeddingsResponse
-	status, _, err := forwardRequest(input.Model+":predict", reqBody, &resBody)
+	status, _, err := forwardRequestCached(w, getCachePolicy(r), input.Model+":predict", reqBody, &resBody, 0)
 	if err != nil {
 		return failRequest(w, status, err.Error())
 	}
@@ -0,0 +1,243 @@
+package routes
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/prantlf/ovai/internal/cfg"
+	"github.com/prantlf/ovai/internal/log"
+)
+
+type replayingReader struct {
+	io.Reader
+	io.Closer
+}
+
+type prepareBodyFunc func(*modelTarget) (string, interface{}, interface{}, error)
+
+type prepareStreamFunc func(*modelTarget) (string, interface{}, interface{}, interface{}, error)
+
+func resolveFallbacks(target *modelTarget, isVertexModel func(string) bool) (*cfg.ModelFallback, []*modelTarget) {
+	chain := []*modelTarget{target}
+	fallback := target.Defaults.FindModelFallback(target.Model)
+	if fallback == nil {
+		return nil, chain
+	}
+	for _, model := range fallback.Models {
+		forward := isVertexModel(model)
+		if !forward && !canProxy {
+			log.Dbg("! skip fallback %s without ollama", model)
+			continue
+		}
+		chain = append(chain, &modelTarget{
+			Name:      target.Name,
+			Model:     model,
+			Forward:   forward,
+			Route:     target.Route,
+			Defaults:  target.Defaults,
+			Redaction: target.Redaction,
+		})
+	}
+	return fallback, chain
+}
+
+func getFinishReason(output interface{}) string {
+	if output, ok := output.(*geminiCompleteOutput); ok && len(output.Candidates) > 0 {
+		return output.Candidates[0].FinishReason
+	}
+	return ""
+}
+
+// the first event is inspected only within the limit
+const maxFirstEventSize = 1024 * 1024
+
+func hasCompleteEvent(chunk []byte) bool {
+	chunk = bytes.TrimLeft(chunk, " \r\n")
+	return bytes.Contains(chunk, []byte("\n\n")) || bytes.Contains(chunk, []byte("\r\n\r\n"))
+}
+
+// readFirstEvent reads the response until the first event is complete,
+// the response ends or the limit is exceeded. A single read can return
+// only a part of the event.
+func readFirstEvent(reader io.Reader) ([]byte, error) {
+	chunk := make([]byte, 0, 64*1024)
+	buf := make([]byte, 64*1024)
+	for {
+		size, err := reader.Read(buf)
+		chunk = append(chunk, buf[0:size]...)
+		if err != nil || hasCompleteEvent(chunk) || len(chunk) >= maxFirstEventSize {
+			return chunk, err
+		}
+	}
+}
+
+func peekFirstEvent(chunk []byte) *geminiFinalOutput {
+	resBody := bytes.TrimSpace(chunk)
+	resBody = bytes.TrimPrefix(resBody, []byte("data: "))
+	if lineBreakPos := bytes.IndexByte(resBody, byte('\n')); lineBreakPos >= 0 {
+		resBody = resBody[0:lineBreakPos]
+	}
+	var output geminiFinalOutput
+	if err := json.Unmarshal(resBody, &output); err != nil {
+		return nil
+	}
+	return &output
+}
+
+func peekFinishReason(output *geminiFinalOutput) string {
+	if output == nil || len(output.Candidates) == 0 {
+		return ""
+	}
+	return output.Candidates[0].FinishReason
+}
+
+func advancesOnError(fallback *cfg.ModelFallback, status int, err error) bool {
+	return errors.Is(err, errTimeout) || fallback.AdvancesOnStatus(status)
+}
+
+func reportAnsweringModel(w http.ResponseWriter, target *modelTarget, attempt int) {
+	w.Header().Set("X-Ovai-Model", target.Model)
+	if attempt > 0 {
+		log.Log("fallback %s answered for %s", target.Model, target.Name)
+	}
+}
+
+func forwardRequestWithFallback(w http.ResponseWriter, policy *cachePolicy, target *modelTarget, prepare prepareBodyFunc) (*modelTarget, interface{}, int, time.Duration, error) {
+	fallback, chain := resolveFallbacks(target, isGeminiModel)
+	var timeout time.Duration
+	if fallback != nil {
+		timeout = fallback.GetTimeout()
+	}
+	var status int
+	var err error
+	for i, attempt := range chain {
+		last := i == len(chain)-1
+		if !attempt.Forward {
+			reportAnsweringModel(w, attempt, i)
+			return attempt, nil, http.StatusOK, 0, nil
+		}
+		urlSuffix, reqBody, output, errPrep := prepare(attempt)
+		if errPrep != nil {
+			if i == 0 {
+				return nil, nil, http.StatusBadRequest, 0, errPrep
+			}
+			log.Dbg("! skip fallback %s: %v", attempt.Model, errPrep)
+			continue
+		}
+		statusFwd, duration, errFwd := forwardRequestCached(w, policy, urlSuffix, reqBody, output, timeout)
+		var prepErr *preparingError
+		if errors.As(errFwd, &prepErr) {
+			if i == 0 {
+				return nil, nil, http.StatusBadRequest, 0, prepErr.err
+			}
+			log.Dbg("! skip fallback %s: %v", attempt.Model, prepErr.err)
+			continue
+		}
+		status, err = statusFwd, errFwd
+		if err != nil {
+			if fallback != nil && !last && advancesOnError(fallback, status, err) {
+				log.Log("%s failed with %d: %v", attempt.Model, status, err)
+				continue
+			}
+			return attempt, nil, status, 0, err
+		}
+		if output, ok := output.(*geminiCompleteOutput); ok {
+			if err := getPromptBlock(&output.geminiOutput); err != nil {
+				return attempt, nil, http.StatusBadRequest, 0, err
+			}
+		}
+		if fallback != nil && !last {
+			if reason := getFinishReason(output); fallback.AdvancesOnReason(reason) {
+				log.Log("%s finished with %s", attempt.Model, reason)
+				continue
+			}
+		}
+		reportAnsweringModel(w, attempt, i)
+		return attempt, output, status, duration, nil
+	}
+	if err == nil {
+		err = errors.New("no model answered")
+		status = http.StatusBadGateway
+	}
+	return target, nil, status, 0, err
+}
+
+func forwardStreamWithFallback(w http.ResponseWriter, policy *cachePolicy, target *modelTarget, prepare prepareStreamFunc) (*modelTarget, time.Time, io.ReadCloser, interface{}, interface{}, int, error) {
+	fallback, chain := resolveFallbacks(target, isGeminiModel)
+	var timeout time.Duration
+	if fallback != nil {
+		timeout = fallback.GetTimeout()
+	}
+	var status int
+	var err error
+	for i, attempt := range chain {
+		last := i == len(chain)-1
+		if !attempt.Forward {
+			reportAnsweringModel(w, attempt, i)
+			return attempt, time.Time{}, nil, nil, nil, http.StatusOK, nil
+		}
+		urlSuffix, reqBody, partialOutput, finalOutput, errPrep := prepare(attempt)
+		if errPrep != nil {
+			if i == 0 {
+				return nil, time.Time{}, nil, nil, nil, http.StatusBadRequest, errPrep
+			}
+			log.Dbg("! skip fallback %s: %v", attempt.Model, errPrep)
+			continue
+		}
+		statusFwd, start, resReader, errFwd := forwardStreamCached(w, policy, urlSuffix, reqBody, timeout)
+		var prepErr *preparingError
+		if errors.As(errFwd, &prepErr) {
+			if i == 0 {
+				return nil, time.Time{}, nil, nil, nil, http.StatusBadRequest, prepErr.err
+			}
+			log.Dbg("! skip fallback %s: %v", attempt.Model, prepErr.err)
+			continue
+		}
+		status, err = statusFwd, errFwd
+		if err != nil {
+			if fallback != nil && !last && advancesOnError(fallback, status, err) {
+				log.Log("%s failed with %d: %v", attempt.Model, status, err)
+				continue
+			}
+			return attempt, time.Time{}, nil, nil, nil, status, err
+		}
+		// nothing has been written to the client yet, the first event can be
+		// inspected; finish reasons in the later events cannot make a fallback
+		chunk, errRead := readFirstEvent(resReader)
+		if errRead == nil || errRead == io.EOF {
+			first := peekFirstEvent(chunk)
+			if first != nil {
+				if err := getPromptBlock(&first.geminiOutput); err != nil {
+					if err := resReader.Close(); err != nil {
+						log.Dbg("closing response body stream failed: %v", err)
+					}
+					return attempt, time.Time{}, nil, nil, nil, http.StatusBadRequest, err
+				}
+			}
+			if fallback != nil && !last && len(fallback.FinishReasons) > 0 {
+				if reason := peekFinishReason(first); fallback.AdvancesOnReason(reason) {
+					if err := resReader.Close(); err != nil {
+						log.Dbg("closing response body stream failed: %v", err)
+					}
+					log.Log("%s finished with %s", attempt.Model, reason)
+					continue
+				}
+			}
+		}
+		resReader = &replayingReader{
+			Reader: io.MultiReader(bytes.NewReader(chunk), resReader),
+			Closer: resReader,
+		}
+		reportAnsweringModel(w, attempt, i)
+		return attempt, start, resReader, partialOutput, finalOutput, status, nil
+	}
+	if err == nil {
+		err = errors.New("no model answered")
+		status = http.StatusBadGateway
+	}
+	return target, time.Time{}, nil, nil, nil, status, err
+}
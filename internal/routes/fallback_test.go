@@ -0,0 +1,130 @@
+package routes
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prantlf/ovai/internal/cfg"
+	"github.com/prantlf/ovai/internal/test"
+)
+
+func useTestFallbacks(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "model-defaults.json")
+	test.Nil(t, os.WriteFile(file, []byte(`{
+		"modelFallbacks": [
+			{ "match": "gemini-a", "models": ["gemini-b"], "finishReasons": ["SAFETY"] }
+		]
+	}`), 0o600))
+	deflts, err := cfg.LoadDefaults(file)
+	test.Nil(t, err)
+	original := cfg.GetDefaults()
+	cfg.SetDefaults(deflts)
+	t.Cleanup(func() { cfg.SetDefaults(original) })
+}
+
+func newTestTarget(t *testing.T) *modelTarget {
+	target, err := resolveModel("gemini-a", isGeminiModel)
+	test.Nil(t, err)
+	return target
+}
+
+func prepareTestBody(attempt *modelTarget) (string, interface{}, interface{}, error) {
+	return attempt.Model + ":generateContent", &geminiBody{}, &geminiCompleteOutput{}, nil
+}
+
+func prepareTestStream(attempt *modelTarget) (string, interface{}, interface{}, interface{}, error) {
+	return attempt.Model + ":streamGenerateContent?alt=sse", &geminiBody{}, &geminiPartialOutput{}, &geminiFinalOutput{}, nil
+}
+
+func TestRequestFallbackOnStatus(t *testing.T) {
+	useTestFallbacks(t)
+	newTestVertex(t, func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/gemini-a:") {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`{"error":{"message":"overloaded"}}`))
+			return
+		}
+		w.Write([]byte(`{"candidates":[{"content":{"parts":[{"text":"b"}]},"finishReason":"STOP"}]}`))
+	})
+	w := httptest.NewRecorder()
+	answered, output, status, _, err := forwardRequestWithFallback(w, nil, newTestTarget(t), prepareTestBody)
+	test.Nil(t, err)
+	test.Equal(t, http.StatusOK, status)
+	test.Equal(t, "gemini-b", answered.Model)
+	test.Equal(t, "gemini-b", w.Header().Get("X-Ovai-Model"))
+	test.Equal(t, "b", output.(*geminiCompleteOutput).Candidates[0].Content.Parts[0].Text)
+}
+
+func TestRequestFallbackOnReason(t *testing.T) {
+	useTestFallbacks(t)
+	newTestVertex(t, func(w http.ResponseWriter, r *http.Request) {
+		reason := "STOP"
+		if strings.Contains(r.URL.Path, "/gemini-a:") {
+			reason = "SAFETY"
+		}
+		w.Write([]byte(`{"candidates":[{"finishReason":"` + reason + `"}]}`))
+	})
+	answered, _, _, _, err := forwardRequestWithFallback(httptest.NewRecorder(), nil, newTestTarget(t), prepareTestBody)
+	test.Nil(t, err)
+	test.Equal(t, "gemini-b", answered.Model)
+}
+
+func TestRequestFallbackExhausted(t *testing.T) {
+	useTestFallbacks(t)
+	newTestVertex(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(`{"error":{"message":"overloaded"}}`))
+	})
+	answered, _, status, _, err := forwardRequestWithFallback(httptest.NewRecorder(), nil, newTestTarget(t), prepareTestBody)
+	test.NotNil(t, err)
+	test.Equal(t, http.StatusServiceUnavailable, status)
+	test.Equal(t, "gemini-b", answered.Model)
+}
+
+func TestStreamFallbackOnReasonInSplitEvent(t *testing.T) {
+	useTestFallbacks(t)
+	newTestVertex(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		if strings.Contains(r.URL.Path, "/gemini-a:") {
+			// the first event arrives in two parts
+			w.Write([]byte(`data: {"candidates":[{"content":{"parts":[{"text":"a"}]},`))
+			w.(http.Flusher).Flush()
+			w.Write([]byte(`"finishReason":"SAFETY"}]}` + "\r\n\r\n"))
+			return
+		}
+		writeTestEvents(w, `{"candidates":[{"content":{"parts":[{"text":"b"}]},"finishReason":"STOP"}]}`)
+	})
+	answered, _, resReader, _, _, _, err := forwardStreamWithFallback(httptest.NewRecorder(), nil, newTestTarget(t), prepareTestStream)
+	test.Nil(t, err)
+	defer resReader.Close()
+	test.Equal(t, "gemini-b", answered.Model)
+	content, err := io.ReadAll(resReader)
+	test.Nil(t, err)
+	test.Equal(t, true, strings.Contains(string(content), `"text":"b"`))
+}
+
+func TestStreamFallbackOnlyFirstEvent(t *testing.T) {
+	useTestFallbacks(t)
+	newTestVertex(t, func(w http.ResponseWriter, r *http.Request) {
+		writeTestEvents(w,
+			`{"candidates":[{"content":{"parts":[{"text":"a"}]}}]}`,
+			`{"candidates":[{"finishReason":"SAFETY"}]}`)
+	})
+	answered, _, resReader, _, _, _, err := forwardStreamWithFallback(httptest.NewRecorder(), nil, newTestTarget(t), prepareTestStream)
+	test.Nil(t, err)
+	defer resReader.Close()
+	// the answer was already being streamed, when the finish reason came
+	test.Equal(t, "gemini-a", answered.Model)
+}
+
+func TestReadFirstEvent(t *testing.T) {
+	reader := io.MultiReader(strings.NewReader("data: {\"a\""), strings.NewReader(":1}\n\ndata: {}\n\n"))
+	chunk, err := readFirstEvent(reader)
+	test.Nil(t, err)
+	test.Equal(t, "data: {\"a\":1}\n\ndata: {}\n\n", string(chunk))
+}
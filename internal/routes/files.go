@@ -0,0 +1,421 @@
+package routes
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/prantlf/ovai/internal/auth"
+	"github.com/prantlf/ovai/internal/log"
+	"github.com/prantlf/ovai/internal/web"
+)
+
+type fileObject struct {
+	ID        string `json:"id"`
+	Object    string `json:"object"`
+	Bytes     int    `json:"bytes"`
+	CreatedAt int64  `json:"created_at"`
+	Filename  string `json:"filename"`
+	Purpose   string `json:"purpose"`
+	Status    string `json:"status"`
+	MimeType  string `json:"mime_type"`
+	FileUri   string `json:"file_uri,omitempty"`
+}
+
+type filesOutput struct {
+	Object  string       `json:"object"`
+	Data    []fileObject `json:"data"`
+	HasMore bool         `json:"has_more"`
+}
+
+type fileDeletedOutput struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Deleted bool   `json:"deleted"`
+}
+
+const storageApiUrl = "https://storage.googleapis.com"
+
+// metadata and, without a bucket, content of uploaded files
+var filesDir = "files"
+
+// Cloud Storage bucket and the prefix of object names for the content
+var filesBucket string
+var filesPrefix string
+
+var fileIdPattern = regexp.MustCompile(`^file-[0-9a-f]{24}$`)
+
+var errUnknownFile = errors.New("unknown file")
+
+func SetFileStorage(dir string, bucket string) error {
+	if len(dir) > 0 {
+		filesDir = dir
+	}
+	filesBucket, filesPrefix = "", ""
+	if len(bucket) > 0 {
+		path, ok := strings.CutPrefix(bucket, "gs://")
+		name, prefix, _ := strings.Cut(path, "/")
+		if !ok || len(name) == 0 {
+			return fmt.Errorf("invalid files bucket: %s", bucket)
+		}
+		if len(prefix) > 0 && !strings.HasSuffix(prefix, "/") {
+			prefix += "/"
+		}
+		filesBucket, filesPrefix = name, prefix
+	}
+	return nil
+}
+
+func isFileId(id string) bool {
+	return fileIdPattern.MatchString(id)
+}
+
+func newFileId() string {
+	var id [12]byte
+	_, _ = rand.Read(id[:])
+	return "file-" + hex.EncodeToString(id[:])
+}
+
+func getFileMetadataPath(id string) string {
+	return filepath.Join(filesDir, id+".json")
+}
+
+func getFileContentPath(id string) string {
+	return filepath.Join(filesDir, id)
+}
+
+func getObjectUrl(name string) string {
+	return fmt.Sprintf("%s/storage/v1/b/%s/o/%s", storageApiUrl, filesBucket, url.PathEscape(name))
+}
+
+// writeFileSafely writes to a temporary file first to prevent reading
+// incomplete content.
+func writeFileSafely(path string, data []byte) error {
+	temp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = temp.Write(data)
+	if errClose := temp.Close(); err == nil {
+		err = errClose
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(temp.Name())
+	}
+	return err
+}
+
+func beginStorageRequest(method string, url string, content []byte, contentType string) (int, io.ReadCloser, error) {
+	dispatchRequest := func() (int, io.ReadCloser, error) {
+		accessToken, err := auth.UseAccessToken()
+		if err != nil {
+			return http.StatusInternalServerError, nil, err
+		}
+		log.Net("send %s %s", method, url)
+		req, err := http.NewRequest(method, url, bytes.NewReader(content))
+		if err != nil {
+			log.Dbg("preparing request failed: %v", err)
+			return http.StatusInternalServerError, nil, errors.New("preparing request failed")
+		}
+		if len(contentType) > 0 {
+			req.Header.Set("Content-Type", contentType)
+		}
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+		return web.BeginRawRequest(web.Storage, req)
+	}
+
+	status, resReader, err := dispatchRequest()
+	if err != nil && status == 401 {
+		auth.RefreshAccessToken()
+		status, resReader, err = dispatchRequest()
+	}
+	return status, resReader, err
+}
+
+func closeStorageResponse(resReader io.ReadCloser) {
+	if err := resReader.Close(); err != nil {
+		log.Dbg("closing response body stream failed: %v", err)
+	}
+}
+
+func uploadObject(name string, mimeType string, content []byte) (int, error) {
+	url := fmt.Sprintf("%s/upload/storage/v1/b/%s/o?uploadType=media&name=%s",
+		storageApiUrl, filesBucket, url.QueryEscape(name))
+	status, resReader, err := beginStorageRequest("POST", url, content, mimeType)
+	if err != nil {
+		return status, err
+	}
+	closeStorageResponse(resReader)
+	return status, nil
+}
+
+func deleteObject(name string) (int, error) {
+	status, resReader, err := beginStorageRequest("DELETE", getObjectUrl(name), nil, "")
+	// the deletion succeeds with 204, which isn't expected by BeginRawRequest
+	if status == http.StatusNoContent || status == http.StatusNotFound {
+		return status, nil
+	}
+	if err != nil {
+		return status, err
+	}
+	closeStorageResponse(resReader)
+	return status, nil
+}
+
+func loadFileObject(id string) (*fileObject, error) {
+	if !isFileId(id) {
+		return nil, errUnknownFile
+	}
+	data, err := os.ReadFile(getFileMetadataPath(id))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, errUnknownFile
+		}
+		return nil, err
+	}
+	var file fileObject
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("decoding %s failed: %v", id, err)
+	}
+	return &file, nil
+}
+
+func listFileObjects(purpose string) ([]fileObject, error) {
+	entries, err := os.ReadDir(filesDir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return []fileObject{}, nil
+		}
+		return nil, err
+	}
+	files := []fileObject{}
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok || !isFileId(id) {
+			continue
+		}
+		file, err := loadFileObject(id)
+		if err != nil {
+			log.Dbg("! %v", err)
+			continue
+		}
+		if len(purpose) == 0 || file.Purpose == purpose {
+			files = append(files, *file)
+		}
+	}
+	slices.SortFunc(files, func(a, b fileObject) int {
+		return int(b.CreatedAt - a.CreatedAt)
+	})
+	return files, nil
+}
+
+// storeFile saves the content to the bucket, if configured, or to the
+// local directory, and the metadata to the local directory.
+func storeFile(filename string, purpose string, content []byte) (*fileObject, int, error) {
+	mimeType := normalizeMimeType(http.DetectContentType(content))
+	if guessed := guessMimeType(filename); !isSupportedMedia(mimeType) && len(guessed) > 0 {
+		mimeType = guessed
+	}
+	file := &fileObject{
+		ID:        newFileId(),
+		Object:    "file",
+		Bytes:     len(content),
+		CreatedAt: time.Now().Unix(),
+		Filename:  filename,
+		Purpose:   purpose,
+		Status:    "processed",
+		MimeType:  mimeType,
+	}
+	if err := os.MkdirAll(filesDir, 0o755); err != nil {
+		return nil, http.StatusInternalServerError, fmt.Errorf("creating %s failed: %v", filesDir, err)
+	}
+	if len(filesBucket) > 0 {
+		name := filesPrefix + file.ID
+		if status, err := uploadObject(name, mimeType, content); err != nil {
+			return nil, status, err
+		}
+		file.FileUri = fmt.Sprintf("gs://%s/%s", filesBucket, name)
+	} else if err := writeFileSafely(getFileContentPath(file.ID), content); err != nil {
+		return nil, http.StatusInternalServerError, fmt.Errorf("writing %s failed: %v", file.ID, err)
+	}
+	data, err := json.Marshal(file)
+	if err == nil {
+		err = writeFileSafely(getFileMetadataPath(file.ID), data)
+	}
+	if err != nil {
+		return nil, http.StatusInternalServerError, fmt.Errorf("writing %s failed: %v", file.ID, err)
+	}
+	return file, http.StatusOK, nil
+}
+
+func removeFile(file *fileObject) (int, error) {
+	if len(file.FileUri) > 0 {
+		_, name, _ := strings.Cut(strings.TrimPrefix(file.FileUri, "gs://"), "/")
+		if status, err := deleteObject(name); err != nil {
+			return status, err
+		}
+	} else if err := os.Remove(getFileContentPath(file.ID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return http.StatusInternalServerError, err
+	}
+	if err := os.Remove(getFileMetadataPath(file.ID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, nil
+}
+
+// resolveFile converts an uploaded file to a part with the media. Files in
+// a bucket are referenced by their URI, local files are sent inline.
+func resolveFile(id string) (geminiPart, error) {
+	file, err := loadFileObject(id)
+	if err != nil {
+		if err == errUnknownFile {
+			return geminiPart{}, fmt.Errorf("unknown file: %s", id)
+		}
+		return geminiPart{}, err
+	}
+	if !isSupportedMedia(file.MimeType) {
+		return geminiPart{}, fmt.Errorf("invalid media type of %s: %s", id, file.MimeType)
+	}
+	if len(file.FileUri) > 0 {
+		return geminiPart{
+			FileData: &fileData{
+				MimeType: file.MimeType,
+				FileUri:  file.FileUri,
+			},
+		}, nil
+	}
+	content, err := os.ReadFile(getFileContentPath(id))
+	if err != nil {
+		return geminiPart{}, fmt.Errorf("reading %s failed: %v", id, err)
+	}
+	return newInlinePart(file.MimeType, base64.StdEncoding.EncodeToString(content))
+}
+
+func writeFileOutput(w http.ResponseWriter, r *http.Request, output interface{}) int {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if r.Method != "HEAD" {
+		if err := json.NewEncoder(w).Encode(output); err != nil {
+			log.Dbg("! encoding response body failed: %v", err)
+		}
+	}
+	return http.StatusOK
+}
+
+func uploadFile(w http.ResponseWriter, r *http.Request) int {
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		return failReading(w, r, err)
+	}
+	defer func() {
+		if err := r.MultipartForm.RemoveAll(); err != nil {
+			log.Dbg("! removing uploaded files failed: %v", err)
+		}
+	}()
+	reader, header, err := r.FormFile("file")
+	if err != nil {
+		return rejectRequest(w, r, http.StatusBadRequest, "missing file", "")
+	}
+	defer reader.Close()
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		return failReading(w, r, err)
+	}
+	purpose := r.FormValue("purpose")
+	if len(purpose) == 0 {
+		purpose = "user_data"
+	}
+	file, status, err := storeFile(header.Filename, purpose, content)
+	if err != nil {
+		return rejectRequest(w, r, status, err.Error(), "")
+	}
+	log.Dbg(": stored %s with %d byte%s of %s", file.ID, file.Bytes, log.GetPlural(file.Bytes), file.MimeType)
+	return writeFileOutput(w, r, file)
+}
+
+func sendFileContent(w http.ResponseWriter, r *http.Request, file *fileObject) int {
+	var reader io.ReadCloser
+	if len(file.FileUri) > 0 {
+		_, name, _ := strings.Cut(strings.TrimPrefix(file.FileUri, "gs://"), "/")
+		status, resReader, err := beginStorageRequest("GET", getObjectUrl(name)+"?alt=media", nil, "")
+		if err != nil {
+			return rejectRequest(w, r, status, err.Error(), "")
+		}
+		reader = resReader
+	} else {
+		content, err := os.Open(getFileContentPath(file.ID))
+		if err != nil {
+			return rejectRequest(w, r, http.StatusInternalServerError, fmt.Sprintf("reading %s failed: %v", file.ID, err), "")
+		}
+		reader = content
+	}
+	defer closeStorageResponse(reader)
+	w.Header().Set("Content-Type", file.MimeType)
+	w.WriteHeader(http.StatusOK)
+	if _, err := io.Copy(w, reader); err != nil {
+		log.Dbg("! writing response body failed: %v", err)
+	}
+	return http.StatusOK
+}
+
+func HandleFiles(w http.ResponseWriter, r *http.Request) int {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/files"), "/")
+	id, content := strings.CutSuffix(path, "/content")
+	if len(id) == 0 {
+		if r.Method == "POST" {
+			return uploadFile(w, r)
+		}
+		if r.Method != "DELETE" {
+			files, err := listFileObjects(r.URL.Query().Get("purpose"))
+			if err != nil {
+				return rejectRequest(w, r, http.StatusInternalServerError, err.Error(), "")
+			}
+			log.Dbg(": list %d file%s", len(files), log.GetPlural(len(files)))
+			return writeFileOutput(w, r, &filesOutput{
+				Object: "list",
+				Data:   files,
+			})
+		}
+	} else if r.Method != "POST" {
+		file, err := loadFileObject(id)
+		if err != nil {
+			if err == errUnknownFile {
+				return rejectRequest(w, r, http.StatusNotFound, "unknown file: "+id, "")
+			}
+			return rejectRequest(w, r, http.StatusInternalServerError, err.Error(), "")
+		}
+		if content {
+			if r.Method == "GET" {
+				return sendFileContent(w, r, file)
+			}
+		} else if r.Method == "DELETE" {
+			if status, err := removeFile(file); err != nil {
+				return rejectRequest(w, r, status, err.Error(), "")
+			}
+			log.Dbg(": deleted %s", id)
+			return writeFileOutput(w, r, &fileDeletedOutput{
+				ID:      id,
+				Object:  "file",
+				Deleted: true,
+			})
+		} else {
+			return writeFileOutput(w, r, file)
+		}
+	}
+	return rejectRequest(w, r, http.StatusMethodNotAllowed, fmt.Sprintf("%s not allowed for %s", r.Method, r.URL.Path), "")
+}
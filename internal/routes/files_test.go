@@ -0,0 +1,80 @@
+package routes
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prantlf/ovai/internal/test"
+)
+
+func TestSetFileStorage(t *testing.T) {
+	defer SetFileStorage("files", "")
+	test.Nil(t, SetFileStorage("", "gs://bucket/uploads"))
+	test.Equal(t, "bucket", filesBucket)
+	test.Equal(t, "uploads/", filesPrefix)
+	test.NotNil(t, SetFileStorage("", "bucket"))
+}
+
+func TestStoreFile(t *testing.T) {
+	defer SetFileStorage("files", "")
+	test.Nil(t, SetFileStorage(t.TempDir(), ""))
+
+	file, _, err := storeFile("report.pdf", "user_data", []byte("%PDF-1.4\n"))
+	test.Nil(t, err)
+	test.Equal(t, true, isFileId(file.ID))
+	test.Equal(t, "application/pdf", file.MimeType)
+
+	files, err := listFileObjects("")
+	test.Nil(t, err)
+	test.Equal(t, 1, len(files))
+	files, err = listFileObjects("batch")
+	test.Nil(t, err)
+	test.Equal(t, 0, len(files))
+
+	part, err := resolveFile(file.ID)
+	test.Nil(t, err)
+	test.Equal(t, "application/pdf", part.InlineData.MimeType)
+	part, err = convertOllamaMedia(file.ID)
+	test.Nil(t, err)
+	test.Equal(t, "application/pdf", part.InlineData.MimeType)
+
+	_, err = removeFile(file)
+	test.Nil(t, err)
+	_, err = resolveFile(file.ID)
+	test.NotNil(t, err)
+}
+
+func TestHandleFiles(t *testing.T) {
+	defer SetFileStorage("files", "")
+	test.Nil(t, SetFileStorage(t.TempDir(), ""))
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	test.Nil(t, form.WriteField("purpose", "user_data"))
+	part, err := form.CreateFormFile("file", "report.pdf")
+	test.Nil(t, err)
+	_, err = part.Write([]byte("%PDF-1.4\n"))
+	test.Nil(t, err)
+	test.Nil(t, form.Close())
+	req := httptest.NewRequest("POST", "/v1/files", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	res := httptest.NewRecorder()
+	test.Equal(t, http.StatusOK, HandleFiles(res, req))
+	var file fileObject
+	test.Nil(t, json.Unmarshal(res.Body.Bytes(), &file))
+	test.Equal(t, "report.pdf", file.Filename)
+	test.Equal(t, 9, file.Bytes)
+
+	res = httptest.NewRecorder()
+	test.Equal(t, http.StatusOK, HandleFiles(res, httptest.NewRequest("GET", "/v1/files/"+file.ID+"/content", nil)))
+	test.Equal(t, "%PDF-1.4\n", res.Body.String())
+
+	res = httptest.NewRecorder()
+	test.Equal(t, http.StatusOK, HandleFiles(res, httptest.NewRequest("DELETE", "/v1/files/"+file.ID, nil)))
+	res = httptest.NewRecorder()
+	test.Equal(t, http.StatusNotFound, HandleFiles(res, httptest.NewRequest("GET", "/v1/files/"+file.ID, nil)))
+}
@@ -1,7 +1,9 @@
 package routes
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -13,9 +15,56 @@ import (
 	"github.com/prantlf/ovai/internal/web"
 )
 
+var errTimeout = errors.New("request timed out")
+
+type cancelingReader struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (r *cancelingReader) Close() error {
+	defer r.cancel()
+	return r.ReadCloser.Close()
+}
+
+func getLocationPath() (string, error) {
+	accnt := auth.GetAccount()
+	if accnt == nil {
+		return "", errors.New("google account missing")
+	}
+	deflts := cfg.GetDefaults()
+	return fmt.Sprintf("projects/%s/locations/%s", accnt.ProjectId, deflts.ApiLocation), nil
+}
+
+func getApiUrl(path string) string {
+	return fmt.Sprintf("https://%s/v1/%s", cfg.GetDefaults().ApiEndpoint, path)
+}
+
+func getModelPath(model string) (string, error) {
+	locationPath, err := getLocationPath()
+	if err != nil {
+		return "", err
+	}
+	return locationPath + "/publishers/google/models/" + model, nil
+}
+
+func getModelUrl(urlSuffix string) (string, error) {
+	modelPath, err := getModelPath(urlSuffix)
+	if err != nil {
+		return "", err
+	}
+	return getApiUrl(modelPath), nil
+}
+
 func forwardRequest(urlSuffix string, input interface{}, output interface{}) (int, time.Duration, error) {
-	url := fmt.Sprintf("https://%s/v1/projects/%s/locations/%s/publishers/google/models/%s",
-		cfg.Defaults.ApiEndpoint, auth.Account.ProjectId, cfg.Defaults.ApiLocation, urlSuffix)
+	return forwardRequestWithin(urlSuffix, input, output, 0)
+}
+
+func forwardRequestWithin(urlSuffix string, input interface{}, output interface{}, timeout time.Duration) (int, time.Duration, error) {
+	url, err := getModelUrl(urlSuffix)
+	if err != nil {
+		return http.StatusInternalServerError, 0, err
+	}
 	accessToken, err := auth.UseAccessToken()
 	if err != nil {
 		return http.StatusInternalServerError, 0, err
@@ -28,8 +77,17 @@ func forwardRequest(urlSuffix string, input interface{}, output interface{}) (in
 			return http.StatusInternalServerError, 0, err
 		}
 		req.Header.Set("Authorization", "Bearer "+accessToken)
-		status, err := web.DispatchRequest(req, output)
+		ctx, cancel := context.WithCancel(context.Background())
+		if timeout > 0 {
+			ctx, cancel = context.WithTimeout(context.Background(), timeout)
+		}
+		defer cancel()
+		status, err := web.DispatchRequest(web.Vertex, req.WithContext(ctx), output)
 		duration := time.Since(start)
+		if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			log.Dbg("! no response in %s", timeout)
+			return http.StatusGatewayTimeout, duration, errTimeout
+		}
 		return status, duration, err
 	}
 
@@ -42,8 +100,14 @@ func forwardRequest(urlSuffix string, input interface{}, output interface{}) (in
 }
 
 func forwardStream(urlSuffix string, input interface{}) (int, time.Time, io.ReadCloser, error) {
-	url := fmt.Sprintf("https://%s/v1/projects/%s/locations/%s/publishers/google/models/%s",
-		cfg.Defaults.ApiEndpoint, auth.Account.ProjectId, cfg.Defaults.ApiLocation, urlSuffix)
+	return forwardStreamWithin(urlSuffix, input, 0)
+}
+
+func forwardStreamWithin(urlSuffix string, input interface{}, timeout time.Duration) (int, time.Time, io.ReadCloser, error) {
+	url, err := getModelUrl(urlSuffix)
+	if err != nil {
+		return http.StatusInternalServerError, time.Time{}, nil, err
+	}
 	accessToken, err := auth.UseAccessToken()
 	if err != nil {
 		return http.StatusInternalServerError, time.Time{}, nil, err
@@ -56,12 +120,27 @@ func forwardStream(urlSuffix string, input interface{}) (int, time.Time, io.Read
 			return http.StatusInternalServerError, time.Time{}, nil, err
 		}
 		req.Header.Set("Authorization", "Bearer "+accessToken)
+		// the timeout applies only to waiting for the response headers
+		ctx, cancel := context.WithCancel(context.Background())
+		var timer *time.Timer
+		if timeout > 0 {
+			timer = time.AfterFunc(timeout, cancel)
+		}
 		var status int
-		status, resReader, err := web.BeginRawRequest(req)
+		status, resReader, err := web.BeginRawRequest(web.Vertex, req.WithContext(ctx))
+		if timer != nil && !timer.Stop() {
+			if err == nil {
+				resReader.Close()
+			}
+			cancel()
+			log.Dbg("! no response in %s", timeout)
+			return http.StatusGatewayTimeout, time.Time{}, nil, errTimeout
+		}
 		if err != nil {
+			cancel()
 			return status, time.Time{}, nil, err
 		}
-		return status, start, resReader, err
+		return status, start, &cancelingReader{resReader, cancel}, err
 	}
 
 	status, start, resReader, err := forwardStream()
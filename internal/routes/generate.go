@@ -2,7 +2,6 @@ package routes
 
 import (
 	"bytes"
-	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -18,22 +17,34 @@ import (
 )
 
 type modelParameters struct {
-	MaxOutputTokens *int     `json:"num_predict,omitempty"`
-	Temperature     *float64 `json:"temperature,omitempty"`
-	TopP            *float64 `json:"top_p,omitempty"`
-	TopK            *int     `json:"top_k,omitempty"`
-	ThinkingBudget  *int     `json:"thinking_budget,omitempty"`
+	MaxOutputTokens  *int                `json:"num_predict,omitempty"`
+	Temperature      *float64            `json:"temperature,omitempty"`
+	TopP             *float64            `json:"top_p,omitempty"`
+	TopK             *int                `json:"top_k,omitempty"`
+	ThinkingBudget   *int                `json:"thinking_budget,omitempty"`
+	NumCtx           *int                `json:"num_ctx,omitempty"`
+	CandidateCount   *int                `json:"candidate_count,omitempty"`
+	Stop             []string            `json:"stop,omitempty"`
+	Seed             *int                `json:"seed,omitempty"`
+	PresencePenalty  *float64            `json:"presence_penalty,omitempty"`
+	FrequencyPenalty *float64            `json:"frequency_penalty,omitempty"`
+	SafetySettings   []cfg.SafetySetting `json:"safety_settings,omitempty"`
 }
 
 type thinkLevel string
 
 type generateInput struct {
-	Model   string          `json:"model"`
-	Prompt  string          `json:"prompt"`
-	Images  []string        `json:"images"`
-	Think   thinkLevel      `json:"think"`
-	Stream  bool            `json:"stream"`
-	Options modelParameters `json:"options"`
+	Model    string          `json:"model"`
+	Prompt   string          `json:"prompt"`
+	Suffix   string          `json:"suffix"`
+	System   string          `json:"system"`
+	Template string          `json:"template"`
+	Context  []int           `json:"context"`
+	Raw      bool            `json:"raw"`
+	Images   []string        `json:"images"`
+	Think    thinkLevel      `json:"think"`
+	Stream   bool            `json:"stream"`
+	Options  modelParameters `json:"options"`
 }
 
 type inlineData struct {
@@ -55,6 +66,7 @@ type geminiPart struct {
 	Text             string            `json:"text,omitempty"`
 	Thought          bool              `json:"thought,omitempty"`
 	InlineData       *inlineData       `json:"inlineData,omitempty"`
+	FileData         *fileData         `json:"fileData,omitempty"`
 	FunctionCall     *functionCall     `json:"functionCall,omitempty"`
 	FunctionResponse *functionResponse `json:"functionResponse,omitempty"`
 }
@@ -69,34 +81,45 @@ type toolsWrapper struct {
 }
 
 type geminiBody struct {
-	Contents         []geminiContent      `json:"contents"`
-	GenerationConfig cfg.GenerationConfig `json:"generationConfig"`
-	SafetySettings   []cfg.SafetySetting  `json:"safetySettings"`
-	Tools            []toolsWrapper       `json:"tools,omitempty"`
+	Contents          []geminiContent      `json:"contents"`
+	SystemInstruction *geminiContent       `json:"systemInstruction,omitempty"`
+	GenerationConfig  cfg.GenerationConfig `json:"generationConfig"`
+	SafetySettings    []cfg.SafetySetting  `json:"safetySettings"`
+	Tools             []toolsWrapper       `json:"tools,omitempty"`
+	CachedContent     string               `json:"cachedContent,omitempty"`
+	// count of the leading contents to cache, set explicitly by the request
+	cachedTurns *int
+	// finish is called only if the response is not found in the cache
+	finish func() error
 }
 
 type geminiCandidate struct {
-	Content geminiContent `json:"content"`
+	Index            int               `json:"index"`
+	Content          geminiContent     `json:"content"`
+	LogprobsResult   *logprobsResult   `json:"logprobsResult,omitempty"`
+	SafetyRatings    []safetyRating    `json:"safetyRatings,omitempty"`
+	CitationMetadata *citationMetadata `json:"citationMetadata,omitempty"`
 }
 
-type safetyRating struct {
-	Category         string  `json:"category"`
-	Probability      string  `json:"probability"`
-	ProbabilityScore float64 `json:"probabilityScore"`
-	Severity         string  `json:"severity"`
-	SeverityScore    float64 `json:"severityScore"`
+// candidateParts is the answer of one of more candidates in a response.
+type candidateParts struct {
+	Index         int
+	Thoughts      string
+	Answer        string
+	FunctionCalls []functionCall
+	Reason        string
+	Logprobs      *logprobsResult
+	Safety        candidateSafety
 }
 
 type geminiCompleteCandidate struct {
 	geminiCandidate
-	FinishReason  string         `json:"finishReason"`
-	SafetyRatings []safetyRating `json:"safetyRatings"`
-	AvgLogProbs   float64        `json:"avgLogprobs"`
+	FinishReason string  `json:"finishReason"`
+	AvgLogProbs  float64 `json:"avgLogprobs"`
 }
 
 type geminiPartialCandidate struct {
 	geminiCandidate
-	SafetyRatings []safetyRating `json:"safetyRatings"`
 }
 
 type geminiFinalCandidate struct {
@@ -105,13 +128,15 @@ type geminiFinalCandidate struct {
 }
 
 type geminiMetadata struct {
-	PromptTokenCount     int `json:"promptTokenCount"`
-	CandidatesTokenCount int `json:"candidatesTokenCount"`
-	TotalTokenCount      int `json:"totalTokenCount"`
+	PromptTokenCount        int `json:"promptTokenCount"`
+	CandidatesTokenCount    int `json:"candidatesTokenCount"`
+	TotalTokenCount         int `json:"totalTokenCount"`
+	CachedContentTokenCount int `json:"cachedContentTokenCount"`
 }
 
 type geminiOutput struct {
-	ModelVersion string `json:"modelVersion"`
+	ModelVersion   string          `json:"modelVersion"`
+	PromptFeedback *promptFeedback `json:"promptFeedback,omitempty"`
 }
 
 func (t *thinkLevel) UnmarshalJSON(data []byte) error {
@@ -241,6 +266,21 @@ func mergeParameters(target *cfg.GenerationConfig, model string, think thinkLeve
 	if source.TopK != nil {
 		target.TopK = source.TopK
 	}
+	if source.CandidateCount != nil {
+		target.CandidateCount = source.CandidateCount
+	}
+	if len(source.Stop) > 0 {
+		target.StopSequences = source.Stop
+	}
+	if source.Seed != nil {
+		target.Seed = source.Seed
+	}
+	if source.PresencePenalty != nil {
+		target.PresencePenalty = source.PresencePenalty
+	}
+	if source.FrequencyPenalty != nil {
+		target.FrequencyPenalty = source.FrequencyPenalty
+	}
 	if len(think) > 0 {
 		var thoughts bool
 		if think != "none" {
@@ -270,6 +310,13 @@ func mergeParameters(target *cfg.GenerationConfig, model string, think thinkLeve
 	return nil
 }
 
+func getCandidateCount(body interface{}) int {
+	if body, ok := body.(*geminiBody); ok && body.GenerationConfig.CandidateCount != nil {
+		return *body.GenerationConfig.CandidateCount
+	}
+	return 1
+}
+
 func convertContentToGeminiParts(content string, images []string, toolCalls []toolCall, toolName string) ([]geminiPart, error) {
 	parts := []geminiPart{}
 	if len(toolName) > 0 {
@@ -299,86 +346,118 @@ func convertContentToGeminiParts(content string, images []string, toolCalls []to
 		parts = append(parts, part)
 	}
 	for _, image := range images {
-		bytes, err := base64.StdEncoding.DecodeString(image)
+		part, err := convertOllamaMedia(image)
 		if err != nil {
-			return nil, fmt.Errorf("invalid image encoding: %s", err.Error())
-		}
-		mimeType := http.DetectContentType(bytes)
-		if !strings.HasPrefix(mimeType, "image/") {
-			return nil, fmt.Errorf("invalid image type: %s", mimeType)
-		}
-		part := geminiPart{
-			InlineData: &inlineData{
-				MimeType: mimeType,
-				Data:     image,
-			},
+			return nil, err
 		}
 		parts = append(parts, part)
 	}
 	return parts, nil
 }
 
-func convertGenerateBodyToGemini(input *generateInput) (interface{}, error) {
-	generationConfig := cfg.Defaults.GeminiDefaults.GenerationConfig
+func convertGenerateBodyToGemini(input *generateInput, target *modelTarget) (*geminiBody, error) {
+	generationConfig := target.generationConfig()
 	if err := mergeParameters(&generationConfig, input.Model, input.Think, &input.Options); err != nil {
 		return nil, err
 	}
-	parts, err := convertContentToGeminiParts(input.Prompt, input.Images, nil, "")
+	prompt, system, err := formatGeneratePrompt(input)
 	if err != nil {
 		return nil, err
 	}
+	parts, err := convertContentToGeminiParts(prompt, input.Images, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	contents := append(loadGenerateContext(input.Context), geminiContent{
+		Role:  "user",
+		Parts: parts,
+	})
 	body := &geminiBody{
-		Contents: []geminiContent{
+		Contents:         contents,
+		GenerationConfig: generationConfig,
+		SafetySettings:   cfg.MergeSafetySettings(target.safetySettings(), input.Options.SafetySettings),
+	}
+	if len(system) > 0 {
+		body.SystemInstruction = newSystemInstruction([]geminiPart{
 			{
-				Role:  "user",
-				Parts: parts,
+				Text: system,
 			},
-		},
-		GenerationConfig: generationConfig,
-		SafetySettings:   cfg.Defaults.GeminiDefaults.SafetySettings,
+		})
 	}
+	target.Redaction.redactBody(body)
 	return body, nil
 }
 
-func prepareGenerateBody(input *generateInput) (string, interface{}, interface{}, error) {
+func prepareGenerateBody(input *generateInput, target *modelTarget) (string, interface{}, interface{}, error) {
 	urlPrefix := input.Model + ":generateContent"
-	body, err := convertGenerateBodyToGemini(input)
+	body, err := convertGenerateBodyToGemini(input, target)
 	if err != nil {
 		return "", nil, nil, err
 	}
 	return urlPrefix, body, &geminiCompleteOutput{}, nil
 }
 
-func prepareGenerateStream(input *generateInput) (string, interface{}, interface{}, interface{}, error) {
+func prepareGenerateStream(input *generateInput, target *modelTarget) (string, interface{}, interface{}, interface{}, error) {
 	urlPrefix := input.Model + ":streamGenerateContent?alt=sse"
-	body, err := convertGenerateBodyToGemini(input)
+	body, err := convertGenerateBodyToGemini(input, target)
 	if err != nil {
 		return "", nil, nil, nil, err
 	}
+	if getCandidateCount(body) > 1 {
+		return "", nil, nil, nil, errors.New("candidate_count greater than 1 not supported with streaming")
+	}
 	return urlPrefix, body, &geminiPartialOutput{}, &geminiFinalOutput{}, nil
 }
 
-func extractGeminiResponseParts(candidates []geminiCandidate) (string, string, []functionCall) {
+func extractCandidateParts(candidate *geminiCandidate) (string, string, []functionCall) {
 	thoughts := ""
 	answer := ""
 	functionCalls := []functionCall{}
-	if len(candidates) > 0 {
-		candidate := candidates[0]
-		parts := candidate.Content.Parts
-		for _, part := range parts {
-			if part.Thought {
-				thoughts += part.Text
-			} else {
-				answer += part.Text
-			}
-			if part.FunctionCall != nil {
-				functionCalls = append(functionCalls, *part.FunctionCall)
-			}
+	for _, part := range candidate.Content.Parts {
+		if part.Thought {
+			thoughts += part.Text
+		} else {
+			answer += part.Text
+		}
+		if part.FunctionCall != nil {
+			functionCalls = append(functionCalls, *part.FunctionCall)
 		}
 	}
 	return thoughts, answer, functionCalls
 }
 
+func newCandidateParts(candidate *geminiCandidate, reason string) candidateParts {
+	thoughts, answer, functionCalls := extractCandidateParts(candidate)
+	return candidateParts{
+		Index:         candidate.Index,
+		Thoughts:      thoughts,
+		Answer:        answer,
+		FunctionCalls: functionCalls,
+		Reason:        reason,
+		Logprobs:      candidate.LogprobsResult,
+		Safety:        newCandidateSafety(candidate),
+	}
+}
+
+func extractGeminiResponseParts(candidates []geminiCandidate) (string, string, []functionCall) {
+	if len(candidates) > 0 {
+		return extractCandidateParts(&candidates[0])
+	}
+	return "", "", []functionCall{}
+}
+
+func extractCompleteGeminiCandidates(data interface{}) []candidateParts {
+	output, ok := data.(*geminiCompleteOutput)
+	if !ok {
+		log.Ftl("invalid gemini complete response type")
+	}
+	candidates := make([]candidateParts, len(output.Candidates))
+	for i, candidate := range output.Candidates {
+		candidates[i] = newCandidateParts(&candidate.geminiCandidate, candidate.FinishReason)
+	}
+	return candidates
+}
+
 func extractCompleteGeminiResponse(data interface{}) (string, string, []functionCall, string, int, int) {
 	output, ok := data.(*geminiCompleteOutput)
 	if !ok {
@@ -395,13 +474,13 @@ func extractCompleteGeminiResponse(data interface{}) (string, string, []function
 	return thoughts, answer, functionCalls, reason, metadata.PromptTokenCount, metadata.CandidatesTokenCount
 }
 
-func extractStreamGeminiResponse(resReader io.Reader, partialData interface{}, finalData interface{}) (string, string, []functionCall, string, []byte, int, int, error) {
+func readStreamEvent(resReader io.Reader) ([]byte, []byte, error) {
 	buf := make([]byte, 1024*1024)
 	size, err := resReader.Read(buf)
 	if err == io.EOF {
 		if size == 0 {
 			log.Dbg("response body stream ended unexpectedly")
-			return "", "", nil, "", nil, 0, 0, errors.New("response body stream ended unexpectedly")
+			return nil, nil, errors.New("response body stream ended unexpectedly")
 		} else {
 			if log.IsDbg {
 				log.Dbg("< %d byte%s and EOF", size, log.GetPlural(size))
@@ -409,7 +488,7 @@ func extractStreamGeminiResponse(resReader io.Reader, partialData interface{}, f
 		}
 	} else if err != nil {
 		log.Dbg("reading response body stream failed: %v", err)
-		return "", "", nil, "", nil, 0, 0, fmt.Errorf("reading response body stream failed: %v", err)
+		return nil, nil, fmt.Errorf("reading response body stream failed: %v", err)
 	} else {
 		if log.IsDbg {
 			log.Dbg("< %d byte%s", size, log.GetPlural(size))
@@ -425,6 +504,42 @@ func extractStreamGeminiResponse(resReader io.Reader, partialData interface{}, f
 		rest = bytes.TrimSpace(resBody[lineBreakPos:])
 		resBody = resBody[0:lineBreakPos]
 	}
+	return resBody, rest, nil
+}
+
+// readStreamCandidates reads an event with all candidates, which may finish
+// at different events.
+func readStreamCandidates(resReader io.Reader) ([]candidateParts, *geminiMetadata, []byte, error) {
+	resBody, rest, err := readStreamEvent(resReader)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var output geminiFinalOutput
+	if err = json.Unmarshal(resBody, &output); err != nil {
+		log.Dbg("receive response %s", resBody)
+		log.Dbg("decoding response body failed: %v", err)
+		return nil, nil, rest, errors.New("decoding response body failed")
+	}
+	log.Net("receive response %s", resBody)
+	candidates := make([]candidateParts, len(output.Candidates))
+	for i, candidate := range output.Candidates {
+		candidates[i] = newCandidateParts(&candidate.geminiCandidate, candidate.FinishReason)
+	}
+	return candidates, &output.UsageMetadata, rest, nil
+}
+
+func extractStreamGeminiResponse(resReader io.Reader, partialData interface{}, finalData interface{}) (string, string, []functionCall, string, []byte, int, int, error) {
+	resBody, rest, err := readStreamEvent(resReader)
+	if err != nil {
+		return "", "", nil, "", nil, 0, 0, err
+	}
+	// properties missing in the event would keep values of the previous one
+	if output, ok := partialData.(*geminiPartialOutput); ok {
+		*output = geminiPartialOutput{}
+	}
+	if output, ok := finalData.(*geminiFinalOutput); ok {
+		*output = geminiFinalOutput{}
+	}
 	final := true
 	if err = json.Unmarshal(resBody, finalData); err != nil {
 		final = false
@@ -474,10 +589,6 @@ func extractStreamGeminiResponse(resReader io.Reader, partialData interface{}, f
 	return thoughts, answer, functionCalls, "", rest, 0, 0, nil
 }
 
-type tokenCount struct {
-	TotalTokens int `json:"totalTokens"`
-}
-
 type generateResponse struct {
 	Model     string `json:"model"`
 	CreatedAt string `json:"created_at"`
@@ -496,17 +607,44 @@ type generateCompleteResponse struct {
 	PromptEvalDuration int64  `json:"prompt_eval_duration"`
 	EvalCount          int    `json:"eval_count"`
 	EvalDuration       int64  `json:"eval_duration"`
+	candidateSafety
+	// all answers, if more than one was requested by candidate_count
+	Candidates []generateCandidate `json:"candidates,omitempty"`
+}
+
+type generateCandidate struct {
+	Index      int    `json:"index"`
+	Thinking   string `json:"thinking,omitempty"`
+	Response   string `json:"response"`
+	DoneReason string `json:"done_reason"`
+	candidateSafety
+}
+
+func convertCandidatesToGenerate(candidates []candidateParts) []generateCandidate {
+	if len(candidates) < 2 {
+		return nil
+	}
+	generateCandidates := make([]generateCandidate, len(candidates))
+	for i, candidate := range candidates {
+		generateCandidates[i] = generateCandidate{
+			Index:           candidate.Index,
+			Thinking:        candidate.Thoughts,
+			Response:        candidate.Answer,
+			DoneReason:      convertDoneReason(candidate.Reason),
+			candidateSafety: candidate.Safety,
+		}
+	}
+	return generateCandidates
 }
 
 func HandleGenerate(w http.ResponseWriter, r *http.Request) int {
 	input := generateInput{
 		Options: modelParameters{},
-		Think:   "none",
 		Stream:  true,
 	}
 	reqPayload, err := io.ReadAll(r.Body)
 	if err != nil {
-		return wrongInput(w, fmt.Sprintf("reading request body failed: %v", err))
+		return failReading(w, r, err)
 	}
 	if err := json.Unmarshal(reqPayload, &input); err != nil {
 		return wrongInput(w, fmt.Sprintf("decoding request body failed: %v", err))
@@ -521,33 +659,63 @@ func HandleGenerate(w http.ResponseWriter, r *http.Request) int {
 		return wrongInput(w, "prompt missing")
 	}
 
-	var forward bool
-	if strings.HasPrefix(input.Model, "gemini") {
-		forward = true
-	} else if !canProxy {
-		return wrongInput(w, fmt.Sprintf("unrecognised model %q", input.Model))
+	target, err := resolveModel(input.Model, isGeminiModel)
+	if err != nil {
+		return wrongInput(w, err.Error())
 	}
 	if log.IsDbg {
 		log.Dbg("> generate from %d character%s using %s", len(input.Prompt),
-			log.GetPlural(len(input.Prompt)), input.Model)
+			log.GetPlural(len(input.Prompt)), target.Model)
+	}
+	if status := validateRequest(w, r, reqPayload, &input, findUnsupportedOllama(reqPayload, unsupportedGenerateFields), target,
+		func() []validationProblem {
+			return checkOllamaOptions(&input.Options, target.Model)
+		}); status != 0 {
+		return status
 	}
 
-	if !forward {
+	if !target.Forward {
+		if reqPayload, err = target.proxyPayload(reqPayload, "model"); err != nil {
+			return wrongInput(w, err.Error())
+		}
 		if input.Stream {
-			return proxyStream("generate", reqPayload, w, r, "result", input.Model)
+			return proxyStream("generate", reqPayload, w, r, "result", target.Model, target.responseModel())
 		}
-		return proxyRequest("generate", reqPayload, w, "result", input.Model)
+		return proxyRequest("generate", reqPayload, w, "result", target.Model, target.responseModel())
+	}
+	if status := checkSafetySettings(w, r, target, input.Options.SafetySettings, "$.options.safety_settings"); status != 0 {
+		return status
+	}
+	input.Model = target.Model
+	if len(input.Think) == 0 {
+		input.Think = target.thinkLevel("none")
 	}
 
+	// the contents sent to the model are remembered for the context of the answer
+	var contents []geminiContent
 	if input.Stream {
-		urlSuffix, reqBody, partialOutput, finalOutput, err := prepareGenerateStream(&input)
+		answered, start, resReader, partialOutput, finalOutput, status, err := forwardStreamWithFallback(w, getCachePolicy(r), target,
+			func(attempt *modelTarget) (string, interface{}, interface{}, interface{}, error) {
+				input.Model = attempt.Model
+				urlPrefix, body, partialOutput, finalOutput, err := prepareGenerateStream(&input, attempt)
+				if err == nil {
+					contents = body.(*geminiBody).Contents
+				}
+				return urlPrefix, body, partialOutput, finalOutput, err
+			})
 		if err != nil {
-			return wrongInput(w, err.Error())
+			if answered == nil {
+				return failPreparing(w, r, err)
+			}
+			return failForwarding(w, r, status, err)
 		}
-		status, start, resReader, err := forwardStream(urlSuffix, reqBody)
-		if err != nil {
-			return failRequest(w, status, err.Error())
+		if !answered.Forward {
+			if reqPayload, err = answered.proxyPayload(reqPayload, "model"); err != nil {
+				return wrongInput(w, err.Error())
+			}
+			return proxyStream("generate", reqPayload, w, r, "result", answered.Model, answered.responseModel())
 		}
+		target = answered
 		defer func() {
 			if err := resReader.Close(); err != nil {
 				log.Dbg("closing response body stream failed: %v", err)
@@ -563,6 +731,8 @@ func HandleGenerate(w http.ResponseWriter, r *http.Request) int {
 		}
 		w.Header().Set("Content-Type", contentType)
 		w.WriteHeader(status)
+		var answer strings.Builder
+		var safety candidateSafety
 		var rest []byte
 		for {
 			if f, ok := w.(http.Flusher); ok {
@@ -585,18 +755,24 @@ func HandleGenerate(w http.ResponseWriter, r *http.Request) int {
 			if err != nil {
 				break
 			}
+			safety.collect(getStreamCandidate(len(reason) > 0, partialOutput, finalOutput))
+			thinking = target.Redaction.restoreChunk("thinking", thinking, len(reason) > 0)
+			content = target.Redaction.restoreChunk("content", content, len(reason) > 0)
+			answer.WriteString(content)
 			if len(reason) > 0 {
 				duration := time.Since(start)
 				promptDuration := int64(math.Round(float64(int64(duration) / 4)))
 				resBody = &generateCompleteResponse{
 					generateResponse: generateResponse{
-						Model:     input.Model,
+						Model:     target.responseModel(),
 						CreatedAt: time.Now().UTC().Format(time.RFC3339),
 						Thinking:  thinking,
 						Response:  content,
 						Done:      true,
 					},
-					DoneReason:         strings.ToLower(reason),
+					DoneReason:         convertDoneReason(reason),
+					candidateSafety:    safety,
+					Context:            storeGenerateContext(target.Redaction.restoreContents(contents), answer.String()),
 					TotalDuration:      int64(duration),
 					LoadDuration:       0,
 					PromptEvalCount:    promptTokens,
@@ -607,7 +783,7 @@ func HandleGenerate(w http.ResponseWriter, r *http.Request) int {
 				final = true
 			} else {
 				resBody = &generateResponse{
-					Model:     input.Model,
+					Model:     target.responseModel(),
 					CreatedAt: time.Now().UTC().Format(time.RFC3339),
 					Thinking:  thinking,
 					Response:  content,
@@ -627,39 +803,79 @@ func HandleGenerate(w http.ResponseWriter, r *http.Request) int {
 				break
 			}
 		}
+		// the end of a placeholder held back by the redaction wouldn't come,
+		// if the stream ended without the finish reason
+		thinking := target.Redaction.restoreChunk("thinking", "", true)
+		content := target.Redaction.restoreChunk("content", "", true)
+		if len(thinking) > 0 || len(content) > 0 {
+			resBody := &generateResponse{
+				Model:     target.responseModel(),
+				CreatedAt: time.Now().UTC().Format(time.RFC3339),
+				Thinking:  thinking,
+				Response:  content,
+				Done:      false,
+			}
+			if sse {
+				web.WriteResponseString(w, "data: ")
+			}
+			if err = json.NewEncoder(w).Encode(resBody); err != nil {
+				log.Dbg("! encoding response body failed: %v", err)
+			}
+			if sse {
+				web.WriteResponseString(w, "\n\n")
+			}
+		}
 	} else {
-		urlSuffix, reqBody, output, err := prepareGenerateBody(&input)
+		answered, output, status, duration, err := forwardRequestWithFallback(w, getCachePolicy(r), target,
+			func(attempt *modelTarget) (string, interface{}, interface{}, error) {
+				input.Model = attempt.Model
+				urlPrefix, body, output, err := prepareGenerateBody(&input, attempt)
+				if err == nil {
+					contents = body.(*geminiBody).Contents
+				}
+				return urlPrefix, body, output, err
+			})
 		if err != nil {
-			return wrongInput(w, err.Error())
+			if answered == nil {
+				return failPreparing(w, r, err)
+			}
+			return failForwarding(w, r, status, err)
 		}
-		status, duration, err := forwardRequest(urlSuffix, reqBody, output)
-		if err != nil {
-			return failRequest(w, status, err.Error())
+		if !answered.Forward {
+			if reqPayload, err = answered.proxyPayload(reqPayload, "model"); err != nil {
+				return wrongInput(w, err.Error())
+			}
+			return proxyRequest("generate", reqPayload, w, "result", answered.Model, answered.responseModel())
 		}
+		target = answered
+		target.Redaction.restoreOutput(output)
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(status)
 		thinking, content, _, reason, promptTokens, contentTokens := extractCompleteGeminiResponse(output)
 		tokens := promptTokens + contentTokens
 		if log.IsDbg {
-			log.Dbg("< result by %s with %d character%s and %d token%s", input.Model,
+			log.Dbg("< result by %s with %d character%s and %d token%s", target.Model,
 				len(content), log.GetPlural(len(content)), tokens, log.GetPlural(tokens))
 		}
 		promptDuration := int64(math.Round(float64(int64(duration) / 4)))
 		resBody := &generateCompleteResponse{
 			generateResponse: generateResponse{
-				Model:     input.Model,
+				Model:     target.responseModel(),
 				CreatedAt: time.Now().UTC().Format(time.RFC3339),
 				Thinking:  thinking,
 				Response:  content,
 				Done:      true,
 			},
-			DoneReason:         strings.ToLower(reason),
+			DoneReason:         convertDoneReason(reason),
+			candidateSafety:    getCompleteSafety(output),
+			Context:            storeGenerateContext(target.Redaction.restoreContents(contents), content),
 			TotalDuration:      int64(duration),
 			LoadDuration:       0,
 			PromptEvalCount:    promptTokens,
 			PromptEvalDuration: promptDuration,
 			EvalCount:          contentTokens,
 			EvalDuration:       int64(duration) - promptDuration,
+			Candidates:         convertCandidatesToGenerate(extractCompleteGeminiCandidates(output)),
 		}
 		if err = json.NewEncoder(w).Encode(resBody); err != nil {
 			log.Dbg("! encoding response body failed: %v", err)
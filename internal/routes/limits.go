@@ -0,0 +1,127 @@
+package routes
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/prantlf/ovai/internal/log"
+	"github.com/prantlf/ovai/internal/web"
+)
+
+type openaiError struct {
+	Message string  `json:"message"`
+	Type    string  `json:"type"`
+	Code    *string `json:"code"`
+}
+
+type openaiFailResponse struct {
+	Error openaiError `json:"error"`
+}
+
+var upstreamSlots chan struct{}
+
+func SetUpstreamLimit(limit int) {
+	if limit > 0 {
+		upstreamSlots = make(chan struct{}, limit)
+	} else {
+		upstreamSlots = nil
+	}
+}
+
+func isOpenAIRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, "/v1/")
+}
+
+func failOpenAIRequest(w http.ResponseWriter, status int, msg string, code string) int {
+	errType := "invalid_request_error"
+	if status >= 500 {
+		errType = "server_error"
+	}
+	resObj := &openaiFailResponse{
+		Error: openaiError{
+			Message: msg,
+			Type:    errType,
+		},
+	}
+	if len(code) > 0 {
+		resObj.Error.Code = &code
+	}
+	resBody, err := json.Marshal(resObj)
+	if err != nil {
+		w.Header().Set("Content-Type", "text/plain")
+		resBody = []byte(msg)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.WriteHeader(status)
+	if _, err := w.Write(resBody); err != nil {
+		log.Dbg("! writing response body failed: %v", err)
+	}
+	return status
+}
+
+// rejectRequest fails in the error shape of the API, which the request was sent to.
+func rejectRequest(w http.ResponseWriter, r *http.Request, status int, msg string, code string) int {
+	log.Dbg("! %s", msg)
+	if isOpenAIRequest(r) {
+		return failOpenAIRequest(w, status, msg, code)
+	}
+	return failRequest(w, status, msg)
+}
+
+func failReading(w http.ResponseWriter, r *http.Request, err error) int {
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		return rejectRequest(w, r, http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("request body larger than %d bytes", maxErr.Limit), "request_too_large")
+	}
+	return wrongInput(w, fmt.Sprintf("reading request body failed: %v", err))
+}
+
+// LimitBody makes reading of the request body fail after the limit is exceeded.
+func LimitBody(fn web.LoggedHandlerFunc, limit int64) web.LoggedHandlerFunc {
+	if limit <= 0 {
+		return fn
+	}
+	return func(w http.ResponseWriter, r *http.Request) int {
+		if r.ContentLength > limit {
+			return rejectRequest(w, r, http.StatusRequestEntityTooLarge,
+				fmt.Sprintf("request body larger than %d bytes", limit), "request_too_large")
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		return fn(w, r)
+	}
+}
+
+// LimitUpstream rejects the request, if too many requests are being
+// forwarded to Vertex AI or ollama at the same time. The request body
+// is read before, so that slow clients don't hold the slots.
+func LimitUpstream(fn web.LoggedHandlerFunc) web.LoggedHandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) int {
+		slots := upstreamSlots
+		if slots == nil {
+			return fn(w, r)
+		}
+		if r.Body != nil && r.Body != http.NoBody {
+			reqBody, err := io.ReadAll(r.Body)
+			if err != nil {
+				return failReading(w, r, err)
+			}
+			r.Body = io.NopCloser(bytes.NewReader(reqBody))
+		}
+		select {
+		case slots <- struct{}{}:
+			defer func() { <-slots }()
+			return fn(w, r)
+		default:
+			w.Header().Set("Retry-After", "1")
+			return rejectRequest(w, r, http.StatusServiceUnavailable,
+				fmt.Sprintf("more than %d requests in progress", cap(slots)), "server_overloaded")
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package routes
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prantlf/ovai/internal/test"
+)
+
+func TestLimitUpstream(t *testing.T) {
+	SetUpstreamLimit(1)
+	defer SetUpstreamLimit(0)
+	entered := make(chan string)
+	release := make(chan struct{})
+	handler := LimitUpstream(func(w http.ResponseWriter, r *http.Request) int {
+		body, _ := io.ReadAll(r.Body)
+		entered <- string(body)
+		<-release
+		w.WriteHeader(http.StatusOK)
+		return http.StatusOK
+	})
+
+	done := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		done <- handler(w, httptest.NewRequest("POST", "/api/chat", strings.NewReader(`{"model":"m"}`)))
+	}()
+	// the body was read before the slot was taken
+	test.Equal(t, `{"model":"m"}`, <-entered)
+
+	w := httptest.NewRecorder()
+	status := handler(w, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{}`)))
+	test.Equal(t, http.StatusServiceUnavailable, status)
+	test.Equal(t, "1", w.Header().Get("Retry-After"))
+	test.Equal(t, true, strings.Contains(w.Body.String(), `"code":"server_overloaded"`))
+
+	close(release)
+	test.Equal(t, http.StatusOK, <-done)
+	go func() { <-entered }()
+	test.Equal(t, http.StatusOK, handler(httptest.NewRecorder(), httptest.NewRequest("POST", "/api/chat", strings.NewReader(`{}`))))
+}
+
+func TestLimitUpstreamBodyTooLarge(t *testing.T) {
+	SetUpstreamLimit(1)
+	defer SetUpstreamLimit(0)
+	handler := LimitBody(LimitUpstream(func(w http.ResponseWriter, r *http.Request) int {
+		return http.StatusOK
+	}), 4)
+	req := httptest.NewRequest("POST", "/api/chat", io.NopCloser(strings.NewReader(`{"model":"m"}`)))
+	req.ContentLength = -1
+	test.Equal(t, http.StatusRequestEntityTooLarge, handler(httptest.NewRecorder(), req))
+	// the slot was not taken
+	test.Equal(t, 0, len(upstreamSlots))
+}
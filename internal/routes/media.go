@@ -0,0 +1,215 @@
+package routes
+
+import (
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/prantlf/ovai/internal/log"
+	"github.com/prantlf/ovai/internal/web"
+)
+
+type fileData struct {
+	MimeType string `json:"mimeType"`
+	FileUri  string `json:"fileUri"`
+}
+
+// media types of common extensions, which may be missing in the system
+var mediaExtensions = map[string]string{
+	".aac":  "audio/aac",
+	".flac": "audio/flac",
+	".m4a":  "audio/mp4",
+	".mp3":  "audio/mpeg",
+	".ogg":  "audio/ogg",
+	".wav":  "audio/wav",
+	".avi":  "video/x-msvideo",
+	".mov":  "video/quicktime",
+	".mp4":  "video/mp4",
+	".mpeg": "video/mpeg",
+	".webm": "video/webm",
+	".pdf":  "application/pdf",
+}
+
+var mediaHosts []string
+var mediaMaxSize int64 = 20 * 1024 * 1024
+
+func SetMediaFetching(hosts []string, maxSize int) {
+	mediaHosts = hosts
+	if maxSize > 0 {
+		mediaMaxSize = int64(maxSize)
+	}
+}
+
+// isSupportedMedia checks the media types accepted by gemini models.
+func isSupportedMedia(mimeType string) bool {
+	return strings.HasPrefix(mimeType, "image/") || strings.HasPrefix(mimeType, "audio/") ||
+		strings.HasPrefix(mimeType, "video/") || mimeType == "application/pdf"
+}
+
+func normalizeMimeType(mimeType string) string {
+	mimeType, _, _ = strings.Cut(mimeType, ";")
+	mimeType = strings.ToLower(strings.TrimSpace(mimeType))
+	switch mimeType {
+	case "application/ogg":
+		return "audio/ogg"
+	case "audio/wave", "audio/x-wav":
+		return "audio/wav"
+	}
+	return mimeType
+}
+
+func guessMimeType(name string) string {
+	ext := strings.ToLower(path.Ext(name))
+	if mimeType, ok := mediaExtensions[ext]; ok {
+		return mimeType
+	}
+	return normalizeMimeType(mime.TypeByExtension(ext))
+}
+
+// isAllowedHost matches the host with the allow-list, which can contain
+// exact host names and wildcards like *.example.com.
+func isAllowedHost(host string) bool {
+	for _, allowed := range mediaHosts {
+		if suffix, ok := strings.CutPrefix(allowed, "*"); ok {
+			if strings.HasSuffix(host, suffix) {
+				return true
+			}
+		} else if host == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+func shortenUri(uri string) string {
+	if len(uri) > 32 {
+		return uri[:32] + "..."
+	}
+	return uri
+}
+
+func newInlinePart(mimeType string, data string) (geminiPart, error) {
+	if !isSupportedMedia(mimeType) {
+		return geminiPart{}, fmt.Errorf("invalid media type: %s", mimeType)
+	}
+	return geminiPart{
+		InlineData: &inlineData{
+			MimeType: mimeType,
+			Data:     data,
+		},
+	}, nil
+}
+
+// parseDataUri parses data:[<media type>][;base64],<data> and returns
+// the media type and the base64-encoded data.
+func parseDataUri(uri string) (string, string, error) {
+	header, data, ok := strings.Cut(strings.TrimPrefix(uri, "data:"), ",")
+	if !ok {
+		return "", "", fmt.Errorf("missing comma in data URI: %s", shortenUri(uri))
+	}
+	mimeType, encoded := strings.CutSuffix(header, ";base64")
+	if !encoded {
+		decoded, err := url.PathUnescape(data)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid data URI encoding: %v", err)
+		}
+		data = base64.StdEncoding.EncodeToString([]byte(decoded))
+	}
+	return normalizeMimeType(mimeType), data, nil
+}
+
+// convertMediaUri converts a data URI, a Cloud Storage URI or a HTTPS URL
+// allowed for fetching to a part with the media. The media type is guessed,
+// if not provided.
+func convertMediaUri(uri string, mimeType string) (geminiPart, error) {
+	switch {
+	case strings.HasPrefix(uri, "data:"):
+		dataType, data, err := parseDataUri(uri)
+		if err != nil {
+			return geminiPart{}, err
+		}
+		return newInlinePart(dataType, data)
+	case strings.HasPrefix(uri, "gs://"):
+		if len(mimeType) == 0 {
+			mimeType = guessMimeType(uri)
+		}
+		if !isSupportedMedia(mimeType) {
+			return geminiPart{}, fmt.Errorf("unknown media type of %s", uri)
+		}
+		return geminiPart{
+			FileData: &fileData{
+				MimeType: mimeType,
+				FileUri:  uri,
+			},
+		}, nil
+	case strings.HasPrefix(uri, "https://"):
+		return fetchMedia(uri)
+	}
+	return geminiPart{}, fmt.Errorf("invalid media URI: %s", shortenUri(uri))
+}
+
+// checkMediaUrl allows fetching only from the allowed hosts using https,
+// including every redirect.
+func checkMediaUrl(parsed *url.URL) error {
+	if parsed.Scheme != "https" {
+		return fmt.Errorf("fetching media from %s not allowed", parsed.Redacted())
+	}
+	if !isAllowedHost(parsed.Hostname()) {
+		return fmt.Errorf("fetching media from %s not allowed", parsed.Hostname())
+	}
+	return nil
+}
+
+func fetchMedia(uri string) (geminiPart, error) {
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return geminiPart{}, fmt.Errorf("invalid media URL: %v", err)
+	}
+	if err := checkMediaUrl(parsed); err != nil {
+		return geminiPart{}, err
+	}
+	contentType, content, err := web.FetchContent(web.Media, uri, mediaMaxSize, func(req *http.Request) error {
+		return checkMediaUrl(req.URL)
+	})
+	if err != nil {
+		return geminiPart{}, err
+	}
+	mimeType := normalizeMimeType(contentType)
+	if !isSupportedMedia(mimeType) {
+		mimeType = guessMimeType(parsed.Path)
+	}
+	if !isSupportedMedia(mimeType) {
+		mimeType = normalizeMimeType(http.DetectContentType(content))
+	}
+	log.Dbg(": fetched %s with %d byte%s of %s", uri, len(content), log.GetPlural(len(content)), mimeType)
+	return newInlinePart(mimeType, base64.StdEncoding.EncodeToString(content))
+}
+
+// convertEncodedMedia detects the type of base64-encoded media.
+func convertEncodedMedia(encoded string, name string) (geminiPart, error) {
+	bytes, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return geminiPart{}, fmt.Errorf("invalid media encoding: %s", err.Error())
+	}
+	mimeType := normalizeMimeType(http.DetectContentType(bytes))
+	if !isSupportedMedia(mimeType) && len(name) > 0 {
+		mimeType = guessMimeType(name)
+	}
+	return newInlinePart(mimeType, encoded)
+}
+
+// convertOllamaMedia accepts base64-encoded media, media URIs or IDs
+// of uploaded files in place of ollama images.
+func convertOllamaMedia(image string) (geminiPart, error) {
+	if isFileId(image) {
+		return resolveFile(image)
+	}
+	if strings.HasPrefix(image, "data:") || strings.HasPrefix(image, "gs://") || strings.HasPrefix(image, "https://") {
+		return convertMediaUri(image, "")
+	}
+	return convertEncodedMedia(image, "")
+}
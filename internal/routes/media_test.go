@@ -0,0 +1,63 @@
+package routes
+
+import (
+	"encoding/base64"
+	"net/url"
+	"testing"
+
+	"github.com/prantlf/ovai/internal/test"
+)
+
+func TestParseDataUri(t *testing.T) {
+	mimeType, data, err := parseDataUri("data:image/png;base64,iVBORw0KGgo=")
+	test.Nil(t, err)
+	test.Equal(t, "image/png", mimeType)
+	test.Equal(t, "iVBORw0KGgo=", data)
+
+	mimeType, data, err = parseDataUri("data:text/plain;charset=utf-8,a%20b")
+	test.Nil(t, err)
+	test.Equal(t, "text/plain", mimeType)
+	test.Equal(t, base64.StdEncoding.EncodeToString([]byte("a b")), data)
+
+	_, _, err = parseDataUri("data:image/png;base64")
+	test.NotNil(t, err)
+}
+
+func TestConvertMediaUri(t *testing.T) {
+	part, err := convertMediaUri("gs://bucket/report.pdf", "")
+	test.Nil(t, err)
+	test.Equal(t, "application/pdf", part.FileData.MimeType)
+	test.Equal(t, "gs://bucket/report.pdf", part.FileData.FileUri)
+
+	_, err = convertMediaUri("data:text/plain,hello", "")
+	test.NotNil(t, err)
+
+	_, err = convertMediaUri("http://example.com/a.png", "")
+	test.NotNil(t, err)
+}
+
+func TestFetchMediaNotAllowed(t *testing.T) {
+	SetMediaFetching([]string{"images.example.com", "*.example.org"}, 0)
+	defer SetMediaFetching(nil, 0)
+	test.Equal(t, true, isAllowedHost("images.example.com"))
+	test.Equal(t, true, isAllowedHost("cdn.example.org"))
+	test.Equal(t, false, isAllowedHost("example.com"))
+
+	_, err := convertMediaUri("https://localhost/a.png", "")
+	test.NotNil(t, err)
+
+	// redirects are checked the same way
+	test.Nil(t, checkMediaUrl(&url.URL{Scheme: "https", Host: "images.example.com"}))
+	test.NotNil(t, checkMediaUrl(&url.URL{Scheme: "http", Host: "images.example.com"}))
+	test.NotNil(t, checkMediaUrl(&url.URL{Scheme: "https", Host: "169.254.169.254"}))
+}
+
+func TestConvertOllamaMedia(t *testing.T) {
+	pdf := base64.StdEncoding.EncodeToString([]byte("%PDF-1.4\n"))
+	part, err := convertOllamaMedia(pdf)
+	test.Nil(t, err)
+	test.Equal(t, "application/pdf", part.InlineData.MimeType)
+
+	_, err = convertOllamaMedia(base64.StdEncoding.EncodeToString([]byte("hello")))
+	test.NotNil(t, err)
+}
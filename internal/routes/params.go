@@ -0,0 +1,147 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/prantlf/ovai/internal/log"
+)
+
+// stopSequences accepts either a single string or an array of strings.
+type stopSequences []string
+
+type logprobsCandidate struct {
+	Token          string  `json:"token"`
+	LogProbability float64 `json:"logProbability"`
+}
+
+type logprobsTopCandidates struct {
+	Candidates []logprobsCandidate `json:"candidates"`
+}
+
+type logprobsResult struct {
+	TopCandidates    []logprobsTopCandidates `json:"topCandidates"`
+	ChosenCandidates []logprobsCandidate     `json:"chosenCandidates"`
+}
+
+type tokenLogprob struct {
+	Token   string  `json:"token"`
+	Logprob float64 `json:"logprob"`
+	Bytes   []int   `json:"bytes"`
+}
+
+type contentLogprob struct {
+	tokenLogprob
+	TopLogprobs []tokenLogprob `json:"top_logprobs"`
+}
+
+type choiceLogprobs struct {
+	Content []contentLogprob `json:"content"`
+}
+
+// properties of ollama requests and options, which have no equivalent in Gemini
+var unsupportedChatFields = []string{"format", "keep_alive"}
+var unsupportedGenerateFields = []string{"format", "keep_alive"}
+var unsupportedEmbedFields = []string{"truncate", "options", "keep_alive", "dimensions"}
+var unsupportedEmbeddingsFields = []string{"options", "keep_alive"}
+var unsupportedOllamaOptions = []string{
+	"num_keep", "typical_p", "repeat_last_n", "repeat_penalty", "min_p",
+	"mirostat", "mirostat_tau", "mirostat_eta", "tfs_z", "penalize_newline",
+	"num_batch", "num_gpu", "main_gpu", "num_thread", "numa", "use_mmap",
+	"use_mlock", "low_vram", "vocab_only",
+}
+
+// properties of OpenAI requests, which have no equivalent in Gemini
+var unsupportedCompletionsFields = []string{
+	"parallel_tool_calls", "service_tier", "store", "metadata", "prediction",
+	"audio", "modalities", "user",
+}
+
+func (s *stopSequences) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		var value string
+		if err := json.Unmarshal(data, &value); err != nil {
+			return err
+		}
+		*s = stopSequences{value}
+		return nil
+	}
+	var values []string
+	if err := json.Unmarshal(data, &values); err != nil {
+		return err
+	}
+	*s = stopSequences(values)
+	return nil
+}
+
+func getTokenLogprob(candidate *logprobsCandidate) tokenLogprob {
+	bytes := make([]int, len(candidate.Token))
+	for i := 0; i < len(candidate.Token); i++ {
+		bytes[i] = int(candidate.Token[i])
+	}
+	return tokenLogprob{
+		Token:   candidate.Token,
+		Logprob: candidate.LogProbability,
+		Bytes:   bytes,
+	}
+}
+
+func convertLogprobs(result *logprobsResult) *choiceLogprobs {
+	if result == nil {
+		return nil
+	}
+	content := make([]contentLogprob, len(result.ChosenCandidates))
+	for i := range result.ChosenCandidates {
+		content[i] = contentLogprob{
+			tokenLogprob: getTokenLogprob(&result.ChosenCandidates[i]),
+			TopLogprobs:  []tokenLogprob{},
+		}
+		if i < len(result.TopCandidates) {
+			top := result.TopCandidates[i].Candidates
+			content[i].TopLogprobs = make([]tokenLogprob, len(top))
+			for j := range top {
+				content[i].TopLogprobs[j] = getTokenLogprob(&top[j])
+			}
+		}
+	}
+	return &choiceLogprobs{
+		Content: content,
+	}
+}
+
+// findUnsupported returns names of properties set in the object, which
+// cannot be passed to Gemini, prefixed by the path to the object.
+func findUnsupported(object json.RawMessage, names []string, prefix string) []string {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(object, &fields); err != nil {
+		return nil
+	}
+	unsupported := []string{}
+	for _, name := range names {
+		if value, ok := fields[name]; ok && string(value) != "null" {
+			unsupported = append(unsupported, prefix+name)
+		}
+	}
+	return unsupported
+}
+
+func findUnsupportedOllama(payload []byte, names []string) []string {
+	var input struct {
+		Options json.RawMessage `json:"options"`
+	}
+	unsupported := findUnsupported(payload, names, "")
+	if err := json.Unmarshal(payload, &input); err == nil && len(input.Options) > 0 {
+		unsupported = append(unsupported, findUnsupported(input.Options, unsupportedOllamaOptions, "options.")...)
+	}
+	return unsupported
+}
+
+// warnUnsupported reports the ignored properties in the response header.
+func warnUnsupported(w http.ResponseWriter, unsupported []string) {
+	if len(unsupported) > 0 {
+		names := strings.Join(unsupported, ", ")
+		log.Dbg("! ignore unsupported %s", names)
+		w.Header().Set("X-Ovai-Warning", "unsupported properties ignored: "+names)
+	}
+}
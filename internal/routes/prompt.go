@@ -0,0 +1,165 @@
+package routes
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/prantlf/ovai/internal/cache"
+	"github.com/prantlf/ovai/internal/log"
+)
+
+type promptData struct {
+	System   string
+	Prompt   string
+	Suffix   string
+	Response string
+}
+
+const defaultFimTemplate = `Complete the text at the placeholder <FILL>. Respond only with the text to insert in place of the placeholder, without any explanation or formatting.
+
+{{.Prompt}}<FILL>{{.Suffix}}`
+
+var fimTemplate = template.Must(template.New("fim").Parse(defaultFimTemplate))
+
+// previous prompts and responses identified by the numbers in the context
+var generateContexts = cache.NewMemoryStore(16 * 1024 * 1024)
+
+const generateContextTtl = time.Hour
+
+// count of random 31-bit numbers identifying a context, which are safe
+// for JSON numbers in all clients and hard to guess together
+const generateContextSize = 4
+
+func SetFimTemplate(text string) error {
+	if len(text) == 0 {
+		text = defaultFimTemplate
+	}
+	tmpl, err := template.New("fim").Parse(text)
+	if err != nil {
+		return fmt.Errorf("invalid fim template: %v", err)
+	}
+	fimTemplate = tmpl
+	return nil
+}
+
+// placeholders of the prompt properties in the template from the request
+var promptPlaceholder = regexp.MustCompile(`\{\{\s*\.(System|Prompt|Suffix)\s*\}\}`)
+
+// substitutePrompt replaces the placeholders in the template from the request.
+// It isn't executed as a Go template, which could loop without a limit.
+func substitutePrompt(text string, data *promptData) string {
+	return promptPlaceholder.ReplaceAllStringFunc(text, func(placeholder string) string {
+		switch promptPlaceholder.FindStringSubmatch(placeholder)[1] {
+		case "System":
+			return data.System
+		case "Prompt":
+			return data.Prompt
+		default:
+			return data.Suffix
+		}
+	})
+}
+
+func renderPrompt(tmpl *template.Template, data *promptData) (string, error) {
+	var prompt strings.Builder
+	if err := tmpl.Execute(&prompt, data); err != nil {
+		return "", fmt.Errorf("rendering prompt failed: %v", err)
+	}
+	return prompt.String(), nil
+}
+
+// formatGeneratePrompt returns the prompt and the system instruction. The raw
+// prompt is sent as-is, the template from the request includes the system
+// instruction and the fill-in-the-middle template is used with the suffix.
+func formatGeneratePrompt(input *generateInput) (string, string, error) {
+	if input.Raw {
+		return input.Prompt, "", nil
+	}
+	data := &promptData{
+		System: input.System,
+		Prompt: input.Prompt,
+		Suffix: input.Suffix,
+	}
+	if len(input.Template) > 0 {
+		return substitutePrompt(input.Template, data), "", nil
+	}
+	if len(input.Suffix) > 0 {
+		prompt, err := renderPrompt(fimTemplate, data)
+		return prompt, input.System, err
+	}
+	return input.Prompt, input.System, nil
+}
+
+// loadGenerateContext returns the contents of the previous generation.
+func loadGenerateContext(context []int) []geminiContent {
+	if len(context) != generateContextSize {
+		if len(context) > 0 {
+			log.Dbg("! ignore context with %d numbers", len(context))
+		}
+		return nil
+	}
+	key := getGenerateContextKey(context)
+	data, ok := generateContexts.Get(key)
+	if !ok {
+		log.Dbg("! ignore unknown or expired context %s", key)
+		return nil
+	}
+	var contents []geminiContent
+	if err := json.Unmarshal(data, &contents); err != nil {
+		log.Dbg("! decoding context %s failed: %v", key, err)
+		return nil
+	}
+	return contents
+}
+
+func getGenerateContextKey(context []int) string {
+	numbers := make([]string, len(context))
+	for i, number := range context {
+		numbers[i] = strconv.Itoa(number)
+	}
+	return strings.Join(numbers, "-")
+}
+
+// newGenerateContext returns random numbers, which don't identify
+// any stored context yet.
+func newGenerateContext() ([]int, string) {
+	for {
+		context := make([]int, generateContextSize)
+		for i := range context {
+			context[i] = int(rand.Int32())
+		}
+		key := getGenerateContextKey(context)
+		if _, ok := generateContexts.Get(key); !ok {
+			return context, key
+		}
+	}
+}
+
+// storeGenerateContext remembers the contents of the request with the answer
+// and returns the context to continue the generation with.
+func storeGenerateContext(contents []geminiContent, answer string) []int {
+	turns := make([]geminiContent, len(contents), len(contents)+1)
+	copy(turns, contents)
+	turns = append(turns, geminiContent{
+		Role: "model",
+		Parts: []geminiPart{
+			{
+				Text: answer,
+			},
+		},
+	})
+	data, err := json.Marshal(turns)
+	if err != nil {
+		log.Dbg("! encoding context failed: %v", err)
+		return nil
+	}
+	context, key := newGenerateContext()
+	generateContexts.Set(key, data, generateContextTtl)
+	return context
+}
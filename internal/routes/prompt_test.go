@@ -0,0 +1,71 @@
+package routes
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prantlf/ovai/internal/test"
+)
+
+func TestFormatGeneratePrompt(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  generateInput
+		prompt string
+		system string
+	}{
+		{"plain", generateInput{Prompt: "Hi!", System: "Be brief."}, "Hi!", "Be brief."},
+		{"raw", generateInput{Prompt: "Hi!", System: "Be brief.", Template: "{{.System}}", Suffix: "!", Raw: true}, "Hi!", ""},
+		{"template", generateInput{Prompt: "Hi!", System: "Be brief.", Template: "{{.System}} Q: {{.Prompt}}"}, "Be brief. Q: Hi!", ""},
+		{"template spaces", generateInput{Prompt: "Hi!", Suffix: "?", Template: "{{ .Prompt }}{{ .Suffix }}"}, "Hi!?", ""},
+		{"template values", generateInput{Prompt: "{{.System}}", System: "Be brief.", Template: "{{.Prompt}}"}, "{{.System}}", ""},
+		{"template loop", generateInput{Prompt: "Hi!", Template: "{{range 2000000000}}xxxxxxxx{{end}}{{.Prompt}}"}, "{{range 2000000000}}xxxxxxxx{{end}}Hi!", ""},
+		{"suffix", generateInput{Prompt: "func add(", Suffix: ") int", System: "Write Go."},
+			"Complete the text at the placeholder <FILL>. Respond only with the text to insert in place of the placeholder, without any explanation or formatting.\n\nfunc add(<FILL>) int", "Write Go."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prompt, system, err := formatGeneratePrompt(&tt.input)
+			test.Nil(t, err)
+			test.Equal(t, tt.prompt, prompt)
+			test.Equal(t, tt.system, system)
+		})
+	}
+}
+
+func TestFimTemplate(t *testing.T) {
+	test.Nil(t, SetFimTemplate("<PRE>{{.Prompt}}<SUF>{{.Suffix}}<MID>"))
+	defer SetFimTemplate("")
+	prompt, _, err := formatGeneratePrompt(&generateInput{Prompt: "a", Suffix: "c"})
+	test.Nil(t, err)
+	test.Equal(t, "<PRE>a<SUF>c<MID>", prompt)
+
+	test.NotNil(t, SetFimTemplate("{{.Prompt"))
+}
+
+func TestGenerateContext(t *testing.T) {
+	contents := []geminiContent{{Role: "user", Parts: []geminiPart{{Text: "Hi!"}}}}
+	context := storeGenerateContext(contents, "Hello!")
+	test.Equal(t, generateContextSize, len(context))
+	// every answer gets its own context
+	other := storeGenerateContext(contents, "Hello!")
+	test.Equal(t, true, getGenerateContextKey(context) != getGenerateContextKey(other))
+	loaded := loadGenerateContext(context)
+	test.Equal(t, 2, len(loaded))
+	test.Equal(t, "Hi!", loaded[0].Parts[0].Text)
+	test.Equal(t, "model", loaded[1].Role)
+	test.Equal(t, "Hello!", loaded[1].Parts[0].Text)
+	// the stored contents are not affected by the request
+	test.Equal(t, 1, len(contents))
+
+	test.Equal(t, 0, len(loadGenerateContext([]int{1, 2})))
+	test.Equal(t, 0, len(loadGenerateContext([]int{1, 2, 3, 4})))
+	test.Equal(t, 0, len(loadGenerateContext(nil)))
+}
+
+func TestGenerateContextExpired(t *testing.T) {
+	generateContexts.Set("1-2-3-4", []byte(`[{"role":"user","parts":[{"text":"Hi!"}]}]`), time.Millisecond)
+	test.Equal(t, 1, len(loadGenerateContext([]int{1, 2, 3, 4})))
+	time.Sleep(5 * time.Millisecond)
+	test.Equal(t, 0, len(loadGenerateContext([]int{1, 2, 3, 4})))
+}
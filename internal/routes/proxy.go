@@ -1,10 +1,11 @@
 package routes
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
 	"io"
 	"net/http"
-	"os"
 	"strings"
 
 	"github.com/prantlf/ovai/internal/log"
@@ -14,21 +15,18 @@ import (
 var canProxy bool
 var ollamaOrigin string
 
-var _ = initProxy()
-
-func initProxy() bool {
-	ollamaOrigin = os.Getenv("OLLAMA_ORIGIN")
+func SetOllamaOrigin(origin string) {
+	ollamaOrigin = strings.TrimSuffix(origin, "/")
 	canProxy = len(ollamaOrigin) > 0
-	return true
 }
 
-func proxyRequest(name string, input []byte, w http.ResponseWriter, result string, model string) int {
+func proxyRequest(name string, input []byte, w http.ResponseWriter, result string, model string, responseModel string) int {
 	ollamaUrl := fmt.Sprintf("%s/api/%s", ollamaOrigin, name)
 	req, err := web.CreateRawPostRequest(ollamaUrl, input)
 	if err != nil {
 		return failRequest(w, http.StatusInternalServerError, err.Error())
 	}
-	status, output, err := web.DispatchRawRequest(req)
+	status, output, err := web.DispatchRawRequest(web.Ollama, req)
 	if err != nil {
 		return failRequest(w, status, err.Error())
 	}
@@ -41,6 +39,13 @@ func proxyRequest(name string, input []byte, w http.ResponseWriter, result strin
 				len(output), log.GetPlural(len(output)))
 		}
 	}
+	if len(responseModel) > 0 && responseModel != model {
+		if replaced, err := replaceModel(output, "model", responseModel); err == nil {
+			output = replaced
+		} else {
+			log.Dbg("! %v", err)
+		}
+	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
 	if _, err := w.Write(output); err != nil {
@@ -49,13 +54,32 @@ func proxyRequest(name string, input []byte, w http.ResponseWriter, result strin
 	return status
 }
 
-func proxyStream(name string, input []byte, w http.ResponseWriter, r *http.Request, result string, model string) int {
+// replaceStreamedModel replaces the model in a line of the response stream,
+// which can be an SSE event.
+func replaceStreamedModel(line []byte, model string) []byte {
+	payload := bytes.TrimSpace(line)
+	prefix := []byte{}
+	if data, ok := bytes.CutPrefix(payload, []byte("data: ")); ok {
+		prefix, payload = []byte("data: "), data
+	}
+	if len(payload) == 0 || payload[0] != '{' {
+		return line
+	}
+	replaced, err := replaceModel(payload, "model", model)
+	if err != nil {
+		log.Dbg("! %v", err)
+		return line
+	}
+	return append(append(prefix, replaced...), '\n')
+}
+
+func proxyStream(name string, input []byte, w http.ResponseWriter, r *http.Request, result string, model string, responseModel string) int {
 	ollamaUrl := fmt.Sprintf("%s/api/%s", ollamaOrigin, name)
 	req, err := web.CreateRawPostRequest(ollamaUrl, input)
 	if err != nil {
 		return failRequest(w, http.StatusInternalServerError, err.Error())
 	}
-	status, resReader, err := web.BeginRawRequest(req)
+	status, resReader, err := web.BeginRawRequest(web.Ollama, req)
 	if err != nil {
 		return failRequest(w, status, err.Error())
 	}
@@ -71,43 +95,40 @@ func proxyStream(name string, input []byte, w http.ResponseWriter, r *http.Reque
 	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
-	buf := make([]byte, 1024*1024)
+	replace := len(responseModel) > 0 && responseModel != model
+	// the model is replaced in whole lines, which can be split to more reads
+	reader := bufio.NewReaderSize(resReader, 64*1024)
 	for {
 		if f, ok := w.(http.Flusher); ok {
 			f.Flush()
 		}
-		size, err := resReader.Read(buf)
-		if err == io.EOF {
-			if size == 0 {
-				break
-			} else {
-				if log.IsDbg {
-					if len(model) > 0 {
-						log.Dbg("< %s by %s with %d byte%s and EOF", result, model, size, log.GetPlural(size))
-					} else {
-						log.Dbg("< %s with %d byte%s and EOF", result, size, log.GetPlural(size))
-					}
-				}
-			}
-		} else if err != nil {
-			log.Dbg("reading response body stream failed: %v", err)
-		} else {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
 			if log.IsDbg {
 				if len(model) > 0 {
-					log.Dbg("< %s by %s with %d byte%s", result, model, size, log.GetPlural(size))
+					log.Dbg("< %s by %s with %d byte%s", result, model, len(line), log.GetPlural(len(line)))
 				} else {
-					log.Dbg("< %s with %d byte%s", result, size, log.GetPlural(size))
+					log.Dbg("< %s with %d byte%s", result, len(line), log.GetPlural(len(line)))
 				}
 			}
+			if replace {
+				line = replaceStreamedModel(line, responseModel)
+			}
+			if sse {
+				web.WriteResponseString(w, "data: ")
+			}
+			if _, err := w.Write(line); err != nil {
+				log.Dbg("! writing response body failed: %v", err)
+			}
+			if sse {
+				web.WriteResponseString(w, "\n\n")
+			}
 		}
-		if sse {
-			web.WriteResponseString(w, "data: ")
-		}
-		if _, err := w.Write(buf[0:size]); err != nil {
-			log.Dbg("! writing response body failed: %v", err)
-		}
-		if sse {
-			web.WriteResponseString(w, "\n\n")
+		if err != nil {
+			if err != io.EOF {
+				log.Dbg("reading response body stream failed: %v", err)
+			}
+			break
 		}
 	}
 	return status
@@ -0,0 +1,34 @@
+package routes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prantlf/ovai/internal/test"
+)
+
+func TestReplaceStreamedModel(t *testing.T) {
+	test.Equal(t, `{"model":"alias"}`+"\n", string(replaceStreamedModel([]byte(`{"model":"qwen3"}`+"\n"), "alias")))
+	test.Equal(t, `data: {"model":"alias"}`+"\n", string(replaceStreamedModel([]byte(`data: {"model":"qwen3"}`+"\n"), "alias")))
+	test.Equal(t, "data: [DONE]\n", string(replaceStreamedModel([]byte("data: [DONE]\n"), "alias")))
+}
+
+func TestProxyStreamModel(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		// the first line is split to two writes
+		w.Write([]byte(`{"model":"qwen3","message":{"content":"Hel`))
+		w.(http.Flusher).Flush()
+		w.Write([]byte(`lo"},"done":false}` + "\n" + `{"model":"qwen3","done":true}` + "\n"))
+	}))
+	defer server.Close()
+	SetOllamaOrigin(server.URL)
+	defer SetOllamaOrigin("")
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/api/chat", strings.NewReader("{}"))
+	test.Equal(t, http.StatusOK, proxyStream("chat", []byte(`{"model":"qwen3"}`), w, r, "answer", "qwen3", "alias"))
+	test.Equal(t, `{"done":false,"message":{"content":"Hello"},"model":"alias"}`+"\n"+`{"done":true,"model":"alias"}`+"\n", w.Body.String())
+}
@@ -0,0 +1,191 @@
+package routes
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/prantlf/ovai/internal/cfg"
+)
+
+// redaction replaces sensitive values in the contents sent to Vertex AI
+// with placeholders like [[EMAIL_1]] and restores them in the answers.
+// The same value gets the same placeholder during the whole request.
+type redaction struct {
+	rules        []cfg.RedactionRule
+	values       map[string]string // placeholder -> value
+	placeholders map[string]string // value -> placeholder
+	counts       map[string]int
+	longest      int
+	// beginnings of placeholders at the end of the previous stream chunks
+	pending map[string]string
+}
+
+var placeholderPattern = regexp.MustCompile(`\[\[[A-Z][A-Z0-9_]*_\d+\]\]`)
+
+func newRedaction(deflts *cfg.Defaults) *redaction {
+	if len(deflts.RedactionRules) == 0 {
+		return nil
+	}
+	return &redaction{
+		rules:        deflts.RedactionRules,
+		values:       make(map[string]string),
+		placeholders: make(map[string]string),
+		counts:       make(map[string]int),
+		pending:      make(map[string]string),
+	}
+}
+
+func (r *redaction) substitute(name string, value string) string {
+	if placeholder, ok := r.placeholders[value]; ok {
+		return placeholder
+	}
+	r.counts[name]++
+	placeholder := fmt.Sprintf("[[%s_%d]]", name, r.counts[name])
+	r.placeholders[value] = placeholder
+	r.values[placeholder] = value
+	r.longest = max(r.longest, len(placeholder))
+	return placeholder
+}
+
+// redact applies the rules one after another. Placeholders inserted by
+// the previous rules are skipped.
+func (r *redaction) redact(text string) string {
+	if r == nil || len(text) == 0 {
+		return text
+	}
+	for i := range r.rules {
+		rule := &r.rules[i]
+		substitute := func(value string) string {
+			return r.substitute(rule.Name, value)
+		}
+		var result strings.Builder
+		start := 0
+		for _, loc := range placeholderPattern.FindAllStringIndex(text, -1) {
+			result.WriteString(rule.Replace(text[start:loc[0]], substitute))
+			result.WriteString(text[loc[0]:loc[1]])
+			start = loc[1]
+		}
+		result.WriteString(rule.Replace(text[start:], substitute))
+		text = result.String()
+	}
+	return text
+}
+
+func (r *redaction) redactMap(values map[string]string) {
+	for key, value := range values {
+		values[key] = r.redact(value)
+	}
+}
+
+func (r *redaction) redactContents(contents []geminiContent) {
+	for i := range contents {
+		parts := contents[i].Parts
+		for j := range parts {
+			parts[j].Text = r.redact(parts[j].Text)
+			if parts[j].FunctionCall != nil {
+				r.redactMap(parts[j].FunctionCall.Args)
+			}
+			if parts[j].FunctionResponse != nil {
+				r.redactMap(parts[j].FunctionResponse.Response)
+			}
+		}
+	}
+}
+
+// redactBody replaces sensitive values in the texts of the messages,
+// the system instruction and the function calls and responses.
+func (r *redaction) redactBody(body *geminiBody) {
+	if r == nil {
+		return
+	}
+	r.redactContents(body.Contents)
+	if body.SystemInstruction != nil {
+		r.redactContents([]geminiContent{*body.SystemInstruction})
+	}
+}
+
+func (r *redaction) restore(text string) string {
+	if r == nil || len(r.values) == 0 {
+		return text
+	}
+	return placeholderPattern.ReplaceAllStringFunc(text, func(placeholder string) string {
+		if value, ok := r.values[placeholder]; ok {
+			return value
+		}
+		return placeholder
+	})
+}
+
+// restoreChunk restores placeholders in a part of a streamed text. A possible
+// beginning of a placeholder at the end of the chunk is held back until the
+// next chunk of the same stream, identified by the key, or the last one.
+// An empty last chunk returns the held back text, when the stream ended.
+func (r *redaction) restoreChunk(key string, text string, last bool) string {
+	if r == nil || len(r.values) == 0 {
+		return text
+	}
+	text = r.pending[key] + text
+	delete(r.pending, key)
+	if !last {
+		hold := -1
+		if start := strings.LastIndex(text, "[["); start >= 0 &&
+			!strings.Contains(text[start:], "]]") && len(text)-start < r.longest {
+			hold = start
+		} else if strings.HasSuffix(text, "[") {
+			hold = len(text) - 1
+		}
+		if hold >= 0 {
+			r.pending[key] = text[hold:]
+			text = text[:hold]
+		}
+	}
+	return r.restore(text)
+}
+
+func (r *redaction) restoreFunctionCalls(functionCalls []functionCall) {
+	if r == nil {
+		return
+	}
+	for _, functionCall := range functionCalls {
+		for key, value := range functionCall.Args {
+			functionCall.Args[key] = r.restore(value)
+		}
+	}
+}
+
+func (r *redaction) restoreOutput(output interface{}) {
+	complete, ok := output.(*geminiCompleteOutput)
+	if r == nil || !ok {
+		return
+	}
+	for i := range complete.Candidates {
+		parts := complete.Candidates[i].Content.Parts
+		for j := range parts {
+			parts[j].Text = r.restore(parts[j].Text)
+			if parts[j].FunctionCall != nil {
+				r.restoreFunctionCalls([]functionCall{*parts[j].FunctionCall})
+			}
+		}
+	}
+}
+
+// restoreContents returns a copy of the contents with the placeholders
+// restored, to be remembered for the next request.
+func (r *redaction) restoreContents(contents []geminiContent) []geminiContent {
+	if r == nil {
+		return contents
+	}
+	restored := make([]geminiContent, len(contents))
+	for i, content := range contents {
+		restored[i] = geminiContent{
+			Role:  content.Role,
+			Parts: make([]geminiPart, len(content.Parts)),
+		}
+		for j, part := range content.Parts {
+			part.Text = r.restore(part.Text)
+			restored[i].Parts[j] = part
+		}
+	}
+	return restored
+}
@@ -0,0 +1,70 @@
+package routes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prantlf/ovai/internal/cfg"
+	"github.com/prantlf/ovai/internal/test"
+)
+
+func newTestRedaction(t *testing.T) *redaction {
+	file := filepath.Join(t.TempDir(), "model-defaults.json")
+	test.Nil(t, os.WriteFile(file, []byte(`{
+		"redactionRules": [
+			{ "name": "EMAIL", "preset": "email" },
+			{ "name": "PHONE", "preset": "phone" },
+			{ "name": "CUSTOMER", "pattern": "ACME-\\d+" }
+		]
+	}`), 0o600))
+	deflts, err := cfg.LoadDefaults(file)
+	test.Nil(t, err)
+	return newRedaction(deflts)
+}
+
+func TestRedact(t *testing.T) {
+	r := newTestRedaction(t)
+	redacted := r.redact("Mail john@example.com or jane@example.com, call +420 123 456 789 about ACME-42 and john@example.com.")
+	test.Equal(t, "Mail [[EMAIL_1]] or [[EMAIL_2]], call [[PHONE_1]] about [[CUSTOMER_1]] and [[EMAIL_1]].", redacted)
+	test.Equal(t, "Mail john@example.com or jane@example.com, call +420 123 456 789 about ACME-42 and john@example.com.", r.restore(redacted))
+	test.Equal(t, "keep [[EMAIL_9]]", r.restore("keep [[EMAIL_9]]"))
+}
+
+func TestRestoreChunks(t *testing.T) {
+	r := newTestRedaction(t)
+	r.redact("john@example.com")
+	chunks := []string{"Write to [", "[EMA", "IL_1]", "] soon [[", "x"}
+	var answer strings.Builder
+	for i, chunk := range chunks {
+		answer.WriteString(r.restoreChunk("content", chunk, i == len(chunks)-1))
+	}
+	test.Equal(t, "Write to john@example.com soon [[x", answer.String())
+}
+
+func TestNoRedaction(t *testing.T) {
+	var r *redaction
+	test.Equal(t, "john@example.com", r.redact("john@example.com"))
+	test.Equal(t, "[[EMAIL_1]]", r.restoreChunk("content", "[[EMAIL_1]]", false))
+}
+
+func TestRestoreUnfinishedStream(t *testing.T) {
+	deflts := newTestVertex(t, func(w http.ResponseWriter, r *http.Request) {
+		// the stream ends without the finish reason
+		writeTestEvents(w,
+			`{"candidates":[{"index":0,"content":{"role":"model","parts":[{"text":"Write to [[EMA"}]}}]}`)
+	})
+	deflts.RedactionRules = newTestRedaction(t).rules
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/api/chat", strings.NewReader(`{
+		"model": "gemini-2.5-flash",
+		"messages": [{ "role": "user", "content": "Write to john@example.com." }]
+	}`))
+	test.Equal(t, http.StatusOK, HandleChat(w, r))
+	body := w.Body.String()
+	test.Equal(t, true, strings.Contains(body, `"content":"Write to "`))
+	test.Equal(t, true, strings.Contains(body, `"content":"[[EMA"`))
+}
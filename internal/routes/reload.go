@@ -0,0 +1,150 @@
+package routes
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/prantlf/ovai/internal/auth"
+	"github.com/prantlf/ovai/internal/cfg"
+	"github.com/prantlf/ovai/internal/log"
+)
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+var defaultsFile string
+var accountFile string
+
+func statFile(file string) fileStamp {
+	info, err := os.Stat(file)
+	if err != nil {
+		return fileStamp{}
+	}
+	return fileStamp{
+		modTime: info.ModTime(),
+		size:    info.Size(),
+	}
+}
+
+func (s fileStamp) differs(other fileStamp) bool {
+	return !s.modTime.Equal(other.modTime) || s.size != other.size
+}
+
+func warnUnknownKeys(deflts *cfg.Defaults) {
+	if unknown := deflts.UnknownKeys(); len(unknown) > 0 {
+		log.Log("ignore unknown properties in %s: %s", defaultsFile, strings.Join(unknown, ", "))
+	}
+}
+
+func LoadConfig(defaults string, account string) error {
+	defaultsFile = defaults
+	accountFile = account
+	deflts, err := cfg.LoadDefaults(defaultsFile)
+	if err != nil {
+		return err
+	}
+	accnt, err := auth.LoadAccount(accountFile)
+	if err != nil {
+		// replaying recordings needs no credentials
+		if !auth.UsesFixedAccessToken() {
+			return err
+		}
+		log.Log("replay without account: %v", err)
+		accnt = &auth.Account{ProjectId: "replay"}
+	}
+	warnUnknownKeys(deflts)
+	cfg.SetDefaults(deflts)
+	auth.SetAccount(accnt)
+	return nil
+}
+
+func reloadDefaults() error {
+	deflts, err := cfg.LoadDefaults(defaultsFile)
+	if err != nil {
+		log.Log("keep previous %s: %v", defaultsFile, err)
+		return err
+	}
+	warnUnknownKeys(deflts)
+	cfg.SetDefaults(deflts)
+	log.Log("reloaded %s", defaultsFile)
+	return nil
+}
+
+func reloadAccount() error {
+	accnt, err := auth.LoadAccount(accountFile)
+	if err != nil {
+		log.Log("keep previous %s: %v", accountFile, err)
+		return err
+	}
+	auth.SetAccount(accnt)
+	log.Log("reloaded %s", accountFile)
+	return nil
+}
+
+func ReloadConfig() error {
+	return errors.Join(reloadDefaults(), reloadAccount())
+}
+
+func WatchConfig(interval time.Duration) {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		defaultsStamp := statFile(defaultsFile)
+		accountStamp := statFile(accountFile)
+		var ticks <-chan time.Time
+		if interval > 0 {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			ticks = ticker.C
+		}
+		for {
+			select {
+			case <-sighup:
+				log.Log("reload configuration on signal")
+				_ = ReloadConfig()
+				defaultsStamp = statFile(defaultsFile)
+				accountStamp = statFile(accountFile)
+			case <-ticks:
+				if stamp := statFile(defaultsFile); stamp.differs(defaultsStamp) {
+					defaultsStamp = stamp
+					_ = reloadDefaults()
+				}
+				if stamp := statFile(accountFile); stamp.differs(accountStamp) {
+					accountStamp = stamp
+					_ = reloadAccount()
+				}
+			}
+		}
+	}()
+}
+
+// isLocalRequest checks if the request comes from the loopback interface,
+// or from a unix socket, which is protected by the file permissions.
+func isLocalRequest(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip == nil || ip.IsLoopback()
+}
+
+func HandleReload(w http.ResponseWriter, r *http.Request) int {
+	if !isLocalRequest(r) {
+		return failRequest(w, http.StatusForbidden, "reloading allowed only from the local host")
+	}
+	log.Dbg(": reload")
+	if err := ReloadConfig(); err != nil {
+		return failRequest(w, http.StatusUnprocessableEntity, err.Error())
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return http.StatusNoContent
+}
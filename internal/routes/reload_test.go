@@ -0,0 +1,25 @@
+package routes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prantlf/ovai/internal/test"
+)
+
+func TestIsLocalRequest(t *testing.T) {
+	r := httptest.NewRequest("POST", "/api/reload", nil)
+	r.RemoteAddr = "127.0.0.1:1234"
+	test.Equal(t, true, isLocalRequest(r))
+	r.RemoteAddr = "[::1]:1234"
+	test.Equal(t, true, isLocalRequest(r))
+	// unix sockets have no address
+	r.RemoteAddr = "@"
+	test.Equal(t, true, isLocalRequest(r))
+	r.RemoteAddr = "192.0.2.1:1234"
+	test.Equal(t, false, isLocalRequest(r))
+
+	w := httptest.NewRecorder()
+	test.Equal(t, http.StatusForbidden, HandleReload(w, r))
+}
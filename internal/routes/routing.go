@@ -0,0 +1,121 @@
+package routes
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/prantlf/ovai/internal/cfg"
+	"github.com/prantlf/ovai/internal/log"
+)
+
+type modelTarget struct {
+	Name     string
+	Model    string
+	Forward  bool
+	Route    *cfg.ModelRoute
+	Defaults *cfg.Defaults
+	// shared by the fallbacks to keep the placeholders of the request
+	Redaction *redaction
+}
+
+func isGeminiModel(name string) bool {
+	return strings.HasPrefix(name, "gemini")
+}
+
+func isEmbeddingModel(name string) bool {
+	return strings.HasPrefix(name, "textembedding-gecko") ||
+		strings.HasPrefix(name, "textembedding-gecko-multilingual") ||
+		strings.HasPrefix(name, "text-embedding") ||
+		strings.HasPrefix(name, "multimodalembedding") ||
+		strings.HasPrefix(name, "text-multilingual-embedding") ||
+		strings.HasPrefix(name, "gemini-embedding")
+}
+
+func getBackendName(forward bool) string {
+	if forward {
+		return "vertex"
+	}
+	return "ollama"
+}
+
+func resolveModel(name string, isVertexModel func(string) bool) (*modelTarget, error) {
+	target := &modelTarget{
+		Name:     name,
+		Model:    name,
+		Defaults: cfg.GetDefaults(),
+	}
+	target.Redaction = newRedaction(target.Defaults)
+	route := target.Defaults.FindModelRoute(name)
+	if route != nil {
+		target.Route = route
+		if len(route.Model) > 0 {
+			target.Model = route.Model
+		}
+	}
+	if route != nil && len(route.Backend) > 0 {
+		target.Forward = route.Backend == "vertex"
+	} else {
+		target.Forward = isVertexModel(target.Model)
+	}
+	if !target.Forward && !canProxy {
+		return nil, fmt.Errorf("unrecognised model %q", name)
+	}
+	if route != nil {
+		log.Log("route %s by %q to %s using %s", name, route.Match,
+			target.Model, getBackendName(target.Forward))
+	}
+	return target, nil
+}
+
+func (t *modelTarget) responseModel() string {
+	if t.Route != nil && t.Route.ReportsTarget() {
+		return t.Model
+	}
+	return t.Name
+}
+
+func (t *modelTarget) thinkLevel(fallback thinkLevel) thinkLevel {
+	if t.Route != nil && len(t.Route.Think) > 0 {
+		return thinkLevel(t.Route.Think)
+	}
+	return fallback
+}
+
+func (t *modelTarget) generationConfig() cfg.GenerationConfig {
+	generationConfig, _, _ := t.Defaults.GetModelDefaults(t.Model)
+	if t.Route != nil {
+		cfg.MergeParameters(&generationConfig, &t.Route.Options)
+	}
+	return generationConfig
+}
+
+func (t *modelTarget) safetySettings() []cfg.SafetySetting {
+	_, safetySettings, _ := t.Defaults.GetModelDefaults(t.Model)
+	return safetySettings
+}
+
+func (t *modelTarget) dimensionality() int {
+	_, _, dimensionality := t.Defaults.GetModelDefaults(t.Model)
+	return dimensionality
+}
+
+func replaceModel(payload []byte, property string, model string) ([]byte, error) {
+	var body map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &body); err != nil {
+		return nil, fmt.Errorf("decoding request body failed: %v", err)
+	}
+	name, err := json.Marshal(model)
+	if err != nil {
+		return nil, fmt.Errorf("encoding model name failed: %v", err)
+	}
+	body[property] = name
+	return json.Marshal(body)
+}
+
+func (t *modelTarget) proxyPayload(payload []byte, property string) ([]byte, error) {
+	if t.Model == t.Name {
+		return payload, nil
+	}
+	return replaceModel(payload, property, t.Model)
+}
@@ -0,0 +1,180 @@
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/prantlf/ovai/internal/cfg"
+	"github.com/prantlf/ovai/internal/log"
+)
+
+type safetyRating struct {
+	Category         string  `json:"category"`
+	Probability      string  `json:"probability"`
+	ProbabilityScore float64 `json:"probabilityScore"`
+	Severity         string  `json:"severity"`
+	SeverityScore    float64 `json:"severityScore"`
+	Blocked          bool    `json:"blocked,omitempty"`
+}
+
+type citationDate struct {
+	Year  int `json:"year,omitempty"`
+	Month int `json:"month,omitempty"`
+	Day   int `json:"day,omitempty"`
+}
+
+type citation struct {
+	StartIndex      int           `json:"startIndex"`
+	EndIndex        int           `json:"endIndex"`
+	Uri             string        `json:"uri,omitempty"`
+	Title           string        `json:"title,omitempty"`
+	License         string        `json:"license,omitempty"`
+	PublicationDate *citationDate `json:"publicationDate,omitempty"`
+}
+
+type citationMetadata struct {
+	Citations []citation `json:"citations"`
+}
+
+type promptFeedback struct {
+	BlockReason        string         `json:"blockReason"`
+	BlockReasonMessage string         `json:"blockReasonMessage"`
+	SafetyRatings      []safetyRating `json:"safetyRatings"`
+}
+
+// candidateSafety is the extension of responses with safety ratings and
+// citations of the answer, which have no equivalent in ollama or OpenAI.
+type candidateSafety struct {
+	SafetyRatings []safetyRating `json:"safety_ratings,omitempty"`
+	Citations     []citation     `json:"citations,omitempty"`
+}
+
+// promptBlockedError is returned instead of an empty answer, if Gemini
+// refused to process the prompt.
+type promptBlockedError struct {
+	Reason  string
+	Message string
+}
+
+func (e *promptBlockedError) Error() string {
+	if len(e.Message) > 0 {
+		return fmt.Sprintf("prompt blocked for %s: %s", e.Reason, e.Message)
+	}
+	return "prompt blocked for " + e.Reason
+}
+
+func newCandidateSafety(candidate *geminiCandidate) candidateSafety {
+	var safety candidateSafety
+	safety.collect(candidate)
+	return safety
+}
+
+// collect keeps the latest safety ratings and all citations, which can
+// come in different chunks of a stream.
+func (s *candidateSafety) collect(candidate *geminiCandidate) {
+	if candidate == nil {
+		return
+	}
+	if len(candidate.SafetyRatings) > 0 {
+		s.SafetyRatings = candidate.SafetyRatings
+	}
+	if candidate.CitationMetadata != nil {
+		s.Citations = append(s.Citations, candidate.CitationMetadata.Citations...)
+	}
+}
+
+func getPromptBlock(output *geminiOutput) error {
+	if output.PromptFeedback == nil || len(output.PromptFeedback.BlockReason) == 0 {
+		return nil
+	}
+	return &promptBlockedError{
+		Reason:  output.PromptFeedback.BlockReason,
+		Message: output.PromptFeedback.BlockReasonMessage,
+	}
+}
+
+// convertDoneReason maps the finish reason of Gemini to ollama.
+func convertDoneReason(reason string) string {
+	switch reason {
+	case "STOP":
+		return "stop"
+	case "MAX_TOKENS":
+		return "length"
+	case "SAFETY", "RECITATION", "BLOCKLIST", "PROHIBITED_CONTENT", "SPII", "IMAGE_SAFETY":
+		return "content_filter"
+	}
+	return strings.ToLower(reason)
+}
+
+// convertFinishReason maps the finish reason of Gemini to OpenAI.
+func convertFinishReason(reason string, functionCalls bool) string {
+	switch reason {
+	case "STOP":
+		if functionCalls {
+			return "tool_calls"
+		}
+	case "MALFORMED_FUNCTION_CALL", "UNEXPECTED_TOOL_CALL":
+		return "tool_calls"
+	}
+	return convertDoneReason(reason)
+}
+
+// failForwarding reports a blocked prompt with the OpenAI code
+// content_filter and other errors as they are.
+func failForwarding(w http.ResponseWriter, r *http.Request, status int, err error) int {
+	var blockedErr *promptBlockedError
+	if errors.As(err, &blockedErr) {
+		return rejectRequest(w, r, status, err.Error(), "content_filter")
+	}
+	return failRequest(w, status, err.Error())
+}
+
+func getCompleteSafety(data interface{}) candidateSafety {
+	if output, ok := data.(*geminiCompleteOutput); ok && len(output.Candidates) > 0 {
+		return newCandidateSafety(&output.Candidates[0].geminiCandidate)
+	}
+	return candidateSafety{}
+}
+
+// getStreamCandidate returns the first candidate of the last event decoded
+// by extractStreamGeminiResponse.
+func getStreamCandidate(final bool, partialData interface{}, finalData interface{}) *geminiCandidate {
+	if final {
+		if output, ok := finalData.(*geminiFinalOutput); ok && len(output.Candidates) > 0 {
+			return &output.Candidates[0].geminiCandidate
+		}
+	} else if output, ok := partialData.(*geminiPartialOutput); ok && len(output.Candidates) > 0 {
+		return &output.Candidates[0].geminiCandidate
+	}
+	return nil
+}
+
+func getApiKey(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+// checkSafetySettings fails the request if the safety settings in it are
+// invalid or if they lower the default thresholds without a safety policy
+// granted to the API key of the caller.
+func checkSafetySettings(w http.ResponseWriter, r *http.Request, target *modelTarget, overrides []cfg.SafetySetting, path string) int {
+	if len(overrides) == 0 {
+		return 0
+	}
+	if err := cfg.ValidateSafetySettings(overrides, path); err != nil {
+		return rejectRequest(w, r, http.StatusBadRequest, err.Error(), "invalid_request_error")
+	}
+	policy := target.Defaults.FindSafetyPolicy(getApiKey(r))
+	if err := cfg.CheckSafetyOverrides(target.safetySettings(), overrides, policy); err != nil {
+		return rejectRequest(w, r, http.StatusForbidden, err.Error(), "permission_denied")
+	}
+	if policy != nil && log.IsDbg {
+		log.Dbg("> override safety settings using policy %s", policy.Name)
+	}
+	return 0
+}
@@ -0,0 +1,47 @@
+package routes
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/prantlf/ovai/internal/test"
+)
+
+func TestConvertFinishReason(t *testing.T) {
+	test.Equal(t, "stop", convertFinishReason("STOP", false))
+	test.Equal(t, "tool_calls", convertFinishReason("STOP", true))
+	test.Equal(t, "length", convertFinishReason("MAX_TOKENS", false))
+	test.Equal(t, "content_filter", convertFinishReason("RECITATION", false))
+	test.Equal(t, "tool_calls", convertFinishReason("MALFORMED_FUNCTION_CALL", false))
+	test.Equal(t, "content_filter", convertDoneReason("PROHIBITED_CONTENT"))
+	test.Equal(t, "malformed_function_call", convertDoneReason("MALFORMED_FUNCTION_CALL"))
+	test.Equal(t, "other", convertDoneReason("OTHER"))
+}
+
+func TestGetPromptBlock(t *testing.T) {
+	var output geminiCompleteOutput
+	err := json.Unmarshal([]byte(`{
+		"promptFeedback": { "blockReason": "PROHIBITED_CONTENT", "blockReasonMessage": "Not allowed." }
+	}`), &output)
+	test.Nil(t, err)
+	err = getPromptBlock(&output.geminiOutput)
+	test.NotNil(t, err)
+	test.Equal(t, "prompt blocked for PROHIBITED_CONTENT: Not allowed.", err.Error())
+
+	output = geminiCompleteOutput{}
+	test.Nil(t, getPromptBlock(&output.geminiOutput))
+}
+
+func TestCollectSafety(t *testing.T) {
+	var safety candidateSafety
+	safety.collect(&geminiCandidate{
+		CitationMetadata: &citationMetadata{Citations: []citation{{EndIndex: 10, Uri: "https://example.com"}}},
+	})
+	safety.collect(&geminiCandidate{
+		SafetyRatings:    []safetyRating{{Category: "HARM_CATEGORY_HARASSMENT", Probability: "NEGLIGIBLE"}},
+		CitationMetadata: &citationMetadata{Citations: []citation{{StartIndex: 20, EndIndex: 30}}},
+	})
+	safety.collect(nil)
+	test.Equal(t, 1, len(safety.SafetyRatings))
+	test.Equal(t, 2, len(safety.Citations))
+}
@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"strings"
 
+	"github.com/prantlf/ovai/internal/cfg"
 	"github.com/prantlf/ovai/internal/log"
 )
 
@@ -14,19 +15,60 @@ type showInput struct {
 	Name string `json:"name"`
 }
 
+type showRoute struct {
+	Match         string `json:"match"`
+	Model         string `json:"model"`
+	Backend       string `json:"backend"`
+	ResponseModel string `json:"response_model"`
+}
+
 type showOutput struct {
 	License    string       `json:"license"`
 	ModelFile  string       `json:"modelfile"`
 	Parameters string       `json:"parameters"`
 	Template   string       `json:"template"`
 	Details    modelDetails `json:"details"`
+	Route      *showRoute   `json:"route,omitempty"`
+}
+
+func isVertexModel(name string) bool {
+	return isGeminiModel(name) || isEmbeddingModel(name)
+}
+
+func formatParameters(config *cfg.GenerationConfig, safetySettings []cfg.SafetySetting, dimensionality int, think string) string {
+	var builder strings.Builder
+	if config.MaxOutputTokens != nil {
+		fmt.Fprintf(&builder, "num_predict %d\n", *config.MaxOutputTokens)
+	}
+	if config.Temperature != nil {
+		fmt.Fprintf(&builder, "temperature %g\n", *config.Temperature)
+	}
+	if config.TopP != nil {
+		fmt.Fprintf(&builder, "top_p %g\n", *config.TopP)
+	}
+	if config.TopK != nil {
+		fmt.Fprintf(&builder, "top_k %d\n", *config.TopK)
+	}
+	if config.ThinkingConfig.ThinkingBudget != nil {
+		fmt.Fprintf(&builder, "thinking_budget %d\n", *config.ThinkingConfig.ThinkingBudget)
+	}
+	if len(think) > 0 {
+		fmt.Fprintf(&builder, "think %s\n", think)
+	}
+	for _, setting := range safetySettings {
+		fmt.Fprintf(&builder, "safety_setting %s %s\n", setting.Category, setting.Threshold)
+	}
+	if dimensionality > 0 {
+		fmt.Fprintf(&builder, "dimensionality %d\n", dimensionality)
+	}
+	return builder.String()
 }
 
 func HandleShow(w http.ResponseWriter, r *http.Request) int {
 	var input showInput
 	reqPayload, err := io.ReadAll(r.Body)
 	if err != nil {
-		return wrongInput(w, fmt.Sprintf("reading request body failed: %v", err))
+		return failReading(w, r, err)
 	}
 	if err := json.Unmarshal(reqPayload, &input); err != nil {
 		return wrongInput(w, fmt.Sprintf("decoding request body failed: %v", err))
@@ -38,34 +80,54 @@ func HandleShow(w http.ResponseWriter, r *http.Request) int {
 		return wrongInput(w, "model name missing")
 	}
 	log.Dbg("> look for %s", input.Name)
-	if strings.HasPrefix(input.Name, "gemini") ||
-		strings.HasPrefix(input.Name, "textembedding-gecko") ||
-		strings.HasPrefix(input.Name, "textembedding-gecko-multilingual") ||
-		strings.HasPrefix(input.Name, "text-embedding") ||
-		strings.HasPrefix(input.Name, "multimodalembedding") ||
-		strings.HasPrefix(input.Name, "text-multilingual-embedding") {
-		var details *modelDetails
-		for _, model := range googleModels {
-			if model.Name == input.Name {
-				details = &model.Details
-			}
+	target, err := resolveModel(input.Name, isVertexModel)
+	if err != nil {
+		return wrongInput(w, err.Error())
+	}
+	if !target.Forward {
+		if reqPayload, err = target.proxyPayload(reqPayload, "name"); err != nil {
+			return wrongInput(w, err.Error())
+		}
+		return proxyRequest("show", reqPayload, w, "model", "", "")
+	}
+	var details *modelDetails
+	for _, model := range googleModels {
+		if model.Name == target.Model {
+			details = &model.Details
+		}
+	}
+	if details == nil {
+		return wrongInput(w, fmt.Sprintf("unrecognised model %q", input.Name))
+	}
+	if log.IsDbg {
+		log.Dbg("< found %s", target.Model)
+	}
+	var think string
+	if target.Route != nil {
+		think = target.Route.Think
+	}
+	generationConfig := target.generationConfig()
+	output := &showOutput{
+		Parameters: formatParameters(&generationConfig, target.safetySettings(), target.dimensionality(), think),
+		Details:    *details,
+	}
+	if target.Route != nil {
+		output.ModelFile = fmt.Sprintf("FROM %s\n", target.Model)
+		responseModel := "alias"
+		if target.Route.ReportsTarget() {
+			responseModel = "target"
 		}
-		if details != nil {
-			if log.IsDbg {
-				log.Dbg("< found %s", input.Name)
-			}
-			output := &showOutput{
-				Details: *details,
-			}
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusOK)
-			if err := json.NewEncoder(w).Encode(output); err != nil {
-				log.Dbg("! encoding response body failed: %v", err)
-			}
-			return http.StatusOK
+		output.Route = &showRoute{
+			Match:         target.Route.Match,
+			Model:         target.Model,
+			Backend:       getBackendName(target.Forward),
+			ResponseModel: responseModel,
 		}
-	} else if canProxy {
-		return proxyRequest("show", reqPayload, w, "model", "")
 	}
-	return wrongInput(w, fmt.Sprintf("unrecognised model %q", input.Name))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(output); err != nil {
+		log.Dbg("! encoding response body failed: %v", err)
+	}
+	return http.StatusOK
 }
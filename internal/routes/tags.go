@@ -422,7 +422,7 @@ func getAllModels(w http.ResponseWriter) ([]modelInfo, int) {
 		if err != nil {
 			return nil, failRequest(w, http.StatusInternalServerError, err.Error())
 		}
-		status, err := web.DispatchRequest(req, output)
+		status, err := web.DispatchRequest(web.Ollama, req, output)
 		if err != nil {
 			return nil, failRequest(w, status, err.Error())
 		}
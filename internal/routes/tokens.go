@@ -0,0 +1,193 @@
+package routes
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/prantlf/ovai/internal/log"
+)
+
+type countTokensBody struct {
+	Contents          []geminiContent `json:"contents"`
+	SystemInstruction *geminiContent  `json:"systemInstruction,omitempty"`
+	Tools             []toolsWrapper  `json:"tools,omitempty"`
+}
+
+type modalityTokenCount struct {
+	Modality   string `json:"modality"`
+	TokenCount int    `json:"tokenCount"`
+}
+
+type tokenCount struct {
+	TotalTokens             int                  `json:"totalTokens"`
+	TotalBillableCharacters int                  `json:"totalBillableCharacters"`
+	PromptTokensDetails     []modalityTokenCount `json:"promptTokensDetails"`
+}
+
+type countTokensInput struct {
+	Model    string          `json:"model"`
+	Messages json.RawMessage `json:"messages"`
+	Prompt   *string         `json:"prompt"`
+}
+
+type countTokensOutput struct {
+	Model                   string         `json:"model"`
+	TotalTokens             int            `json:"total_tokens"`
+	TotalBillableCharacters int            `json:"total_billable_characters"`
+	Modalities              map[string]int `json:"modalities"`
+}
+
+type inputTokensOutput struct {
+	Object             string         `json:"object"`
+	Model              string         `json:"model"`
+	InputTokens        int            `json:"input_tokens"`
+	InputTokensDetails map[string]int `json:"input_tokens_details"`
+}
+
+func convertBodyToCountTokens(body *geminiBody) *countTokensBody {
+	return &countTokensBody{
+		Contents:          body.Contents,
+		SystemInstruction: body.SystemInstruction,
+		Tools:             body.Tools,
+	}
+}
+
+func countTokens(model string, input *countTokensBody) (int, *tokenCount, error) {
+	var output tokenCount
+	status, _, err := forwardRequest(model+":countTokens", input, &output)
+	if err != nil {
+		return status, nil, err
+	}
+	if log.IsDbg {
+		log.Dbg("< %d token%s counted by %s", output.TotalTokens, log.GetPlural(output.TotalTokens), model)
+	}
+	return status, &output, nil
+}
+
+func getModalityTokens(output *tokenCount, suffix string) map[string]int {
+	modalities := make(map[string]int, len(output.PromptTokensDetails))
+	for _, details := range output.PromptTokensDetails {
+		modalities[strings.ToLower(details.Modality)+suffix] = details.TokenCount
+	}
+	return modalities
+}
+
+func resolveCountedModel(w http.ResponseWriter, r *http.Request, model string) (*modelTarget, int) {
+	if len(model) == 0 {
+		return nil, rejectRequest(w, r, http.StatusBadRequest, "model missing", "invalid_request_error")
+	}
+	target, err := resolveModel(model, isGeminiModel)
+	if err != nil {
+		return nil, rejectRequest(w, r, http.StatusBadRequest, err.Error(), "invalid_request_error")
+	}
+	if !target.Forward {
+		return nil, rejectRequest(w, r, http.StatusNotImplemented,
+			fmt.Sprintf("counting tokens not supported by ollama model %s", target.Model), "not_implemented")
+	}
+	return target, 0
+}
+
+// HandleCountTokens accepts bodies of chat and generate requests.
+func HandleCountTokens(w http.ResponseWriter, r *http.Request) int {
+	var input countTokensInput
+	reqPayload, err := io.ReadAll(r.Body)
+	if err != nil {
+		return failReading(w, r, err)
+	}
+	if err := json.Unmarshal(reqPayload, &input); err != nil {
+		return wrongInput(w, fmt.Sprintf("decoding request body failed: %v", err))
+	}
+	target, status := resolveCountedModel(w, r, input.Model)
+	if target == nil {
+		return status
+	}
+
+	var reqBody *geminiBody
+	if len(input.Messages) > 0 {
+		chat := chatInput{}
+		if err := json.Unmarshal(reqPayload, &chat); err != nil {
+			return wrongInput(w, fmt.Sprintf("decoding request body failed: %v", err))
+		}
+		log.Dbg("> count tokens of %d message%s using %s", len(chat.Messages),
+			log.GetPlural(len(chat.Messages)), target.Model)
+		chat.Model = target.Model
+		reqBody, err = convertChatBodyToGemini(&chat, target)
+	} else if input.Prompt != nil {
+		generate := generateInput{}
+		if err := json.Unmarshal(reqPayload, &generate); err != nil {
+			return wrongInput(w, fmt.Sprintf("decoding request body failed: %v", err))
+		}
+		log.Dbg("> count tokens of %d character%s using %s", len(generate.Prompt),
+			log.GetPlural(len(generate.Prompt)), target.Model)
+		generate.Model = target.Model
+		reqBody, err = convertGenerateBodyToGemini(&generate, target)
+	} else {
+		return wrongInput(w, "messages or prompt missing")
+	}
+	if err != nil {
+		return wrongInput(w, err.Error())
+	}
+
+	status, output, err := countTokens(target.Model, convertBodyToCountTokens(reqBody))
+	if err != nil {
+		return failRequest(w, status, err.Error())
+	}
+	resBody := &countTokensOutput{
+		Model:                   target.responseModel(),
+		TotalTokens:             output.TotalTokens,
+		TotalBillableCharacters: output.TotalBillableCharacters,
+		Modalities:              getModalityTokens(output, ""),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err = json.NewEncoder(w).Encode(resBody); err != nil {
+		log.Dbg("! encoding response body failed: %v", err)
+	}
+	return http.StatusOK
+}
+
+// HandleInputTokens accepts bodies of OpenAI chat completion requests.
+func HandleInputTokens(w http.ResponseWriter, r *http.Request) int {
+	var input completionsInput
+	reqPayload, err := io.ReadAll(r.Body)
+	if err != nil {
+		return failReading(w, r, err)
+	}
+	if err := json.Unmarshal(reqPayload, &input); err != nil {
+		return rejectRequest(w, r, http.StatusBadRequest, fmt.Sprintf("decoding request body failed: %v", err), "invalid_request_error")
+	}
+	target, status := resolveCountedModel(w, r, input.Model)
+	if target == nil {
+		return status
+	}
+	if len(input.Messages) == 0 {
+		return rejectRequest(w, r, http.StatusBadRequest, "messages missing", "invalid_request_error")
+	}
+	log.Dbg("> count tokens of %d message%s using %s", len(input.Messages),
+		log.GetPlural(len(input.Messages)), target.Model)
+
+	input.Model = target.Model
+	reqBody, err := convertCompletionsBodyToGemini(&input, target)
+	if err != nil {
+		return rejectRequest(w, r, http.StatusBadRequest, err.Error(), "invalid_request_error")
+	}
+	status, output, err := countTokens(target.Model, convertBodyToCountTokens(reqBody))
+	if err != nil {
+		return failOpenAIRequest(w, status, err.Error(), "upstream_error")
+	}
+	resBody := &inputTokensOutput{
+		Object:             "input_tokens",
+		Model:              target.responseModel(),
+		InputTokens:        output.TotalTokens,
+		InputTokensDetails: getModalityTokens(output, "_tokens"),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err = json.NewEncoder(w).Encode(resBody); err != nil {
+		log.Dbg("! encoding response body failed: %v", err)
+	}
+	return http.StatusOK
+}
@@ -0,0 +1,177 @@
+package routes
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/prantlf/ovai/internal/cfg"
+	"github.com/prantlf/ovai/internal/log"
+)
+
+type validationProblem struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+type validationFailResponse struct {
+	Error    string              `json:"error"`
+	Problems []validationProblem `json:"problems"`
+}
+
+type openaiValidationError struct {
+	openaiError
+	Problems []validationProblem `json:"problems"`
+}
+
+type openaiValidationFailResponse struct {
+	Error openaiValidationError `json:"error"`
+}
+
+var strictValidation bool
+
+func SetStrictValidation(strict bool) {
+	strictValidation = strict
+}
+
+// isStrict lets the header X-Ovai-Strict override the configured mode.
+func isStrict(r *http.Request) bool {
+	switch strings.ToLower(r.Header.Get("X-Ovai-Strict")) {
+	case "true", "1":
+		return true
+	case "false", "0":
+		return false
+	}
+	return strictValidation
+}
+
+func checkRange[T int | float64](problems []validationProblem, path string, value *T, min T, max T) []validationProblem {
+	if value != nil && (*value < min || *value > max) {
+		problems = append(problems, validationProblem{
+			Path:    path,
+			Message: fmt.Sprintf("out of range %v-%v: %v", min, max, *value),
+		})
+	}
+	return problems
+}
+
+func checkMinimum(problems []validationProblem, path string, value *int, min int) []validationProblem {
+	if value != nil && *value < min {
+		problems = append(problems, validationProblem{
+			Path:    path,
+			Message: fmt.Sprintf("less than %d: %d", min, *value),
+		})
+	}
+	return problems
+}
+
+func checkThinkingBudget(problems []validationProblem, path string, model string, budget *int) []validationProblem {
+	if budget != nil && !cfg.IsThinkingBudgetValid(model, *budget) {
+		min, max := cfg.ThinkingBudgetRange(model)
+		problems = checkRange(problems, path, budget, min, max)
+	}
+	return problems
+}
+
+func checkOllamaOptions(options *modelParameters, model string) []validationProblem {
+	problems := checkMinimum(nil, "$.options.num_predict", options.MaxOutputTokens, 1)
+	problems = checkRange(problems, "$.options.temperature", options.Temperature, 0, 2)
+	problems = checkRange(problems, "$.options.top_p", options.TopP, 0, 1)
+	problems = checkMinimum(problems, "$.options.top_k", options.TopK, 1)
+	problems = checkRange(problems, "$.options.candidate_count", options.CandidateCount, 1, 8)
+	problems = checkRange(problems, "$.options.presence_penalty", options.PresencePenalty, -2, 2)
+	problems = checkRange(problems, "$.options.frequency_penalty", options.FrequencyPenalty, -2, 2)
+	return checkThinkingBudget(problems, "$.options.thinking_budget", model, options.ThinkingBudget)
+}
+
+func checkCompletionsParameters(input *completionsInput, model string) []validationProblem {
+	problems := checkMinimum(nil, "$.max_tokens", input.MaxTokens, 1)
+	problems = checkMinimum(problems, "$.max_completion_tokens", input.MaxCompletionTokens, 1)
+	problems = checkRange(problems, "$.temperature", input.Temperature, 0, 2)
+	problems = checkRange(problems, "$.top_p", input.TopP, 0, 1)
+	problems = checkRange(problems, "$.n", input.N, 1, 8)
+	problems = checkRange(problems, "$.presence_penalty", input.PresencePenalty, -2, 2)
+	problems = checkRange(problems, "$.frequency_penalty", input.FrequencyPenalty, -2, 2)
+	problems = checkRange(problems, "$.top_logprobs", input.TopLogprobs, 0, 20)
+	return checkThinkingBudget(problems, "$.thinking_budget", model, input.ThinkingBudget)
+}
+
+// validateRequest checks the request body in the strict mode and fails the
+// request, if it finds problems. Otherwise properties, which aren't supported
+// by Gemini, are reported in the warning header. Unsupported properties and
+// values out of range are checked only for Vertex AI models.
+func validateRequest(w http.ResponseWriter, r *http.Request, payload []byte, input interface{}, unsupported []string, target *modelTarget, checkRanges func() []validationProblem) int {
+	if !isStrict(r) {
+		if target.Forward {
+			warnUnsupported(w, unsupported)
+		}
+		return 0
+	}
+	var value interface{}
+	if err := json.Unmarshal(payload, &value); err != nil {
+		return 0
+	}
+	var problems []validationProblem
+	for _, path := range cfg.FindUnknownProperties(value, reflect.TypeOf(input), "$") {
+		// properties not supported by Gemini are valid for ollama or OpenAI
+		if !slices.Contains(unsupported, strings.TrimPrefix(path, "$.")) {
+			problems = append(problems, validationProblem{
+				Path:    path,
+				Message: "unknown property",
+			})
+		}
+	}
+	if target.Forward {
+		for _, name := range unsupported {
+			problems = append(problems, validationProblem{
+				Path:    "$." + name,
+				Message: "not supported by gemini models",
+			})
+		}
+		if checkRanges != nil {
+			problems = append(problems, checkRanges()...)
+		}
+	}
+	if len(problems) > 0 {
+		return failValidation(w, r, problems)
+	}
+	return 0
+}
+
+func failValidation(w http.ResponseWriter, r *http.Request, problems []validationProblem) int {
+	msg := fmt.Sprintf("request validation failed with %d problem%s", len(problems), log.GetPlural(len(problems)))
+	if log.IsDbg {
+		log.Dbg("! %s", msg)
+		for _, problem := range problems {
+			log.Dbg("! %s: %s", problem.Path, problem.Message)
+		}
+	}
+	var resObj interface{}
+	if isOpenAIRequest(r) {
+		code := "validation_failed"
+		resObj = &openaiValidationFailResponse{
+			Error: openaiValidationError{
+				openaiError: openaiError{
+					Message: msg,
+					Type:    "invalid_request_error",
+					Code:    &code,
+				},
+				Problems: problems,
+			},
+		}
+	} else {
+		resObj = &validationFailResponse{
+			Error:    msg,
+			Problems: problems,
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	if err := json.NewEncoder(w).Encode(resObj); err != nil {
+		log.Dbg("! encoding response body failed: %v", err)
+	}
+	return http.StatusBadRequest
+}
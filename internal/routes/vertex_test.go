@@ -0,0 +1,55 @@
+package routes
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prantlf/ovai/internal/auth"
+	"github.com/prantlf/ovai/internal/cfg"
+	"github.com/prantlf/ovai/internal/test"
+	"github.com/prantlf/ovai/internal/web"
+)
+
+// newTestVertex makes the requests to Vertex AI go to the handler during the test.
+func newTestVertex(t *testing.T, handler http.HandlerFunc) *cfg.Defaults {
+	server := httptest.NewTLSServer(handler)
+	t.Cleanup(server.Close)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	test.Nil(t, os.WriteFile(caFile, ca, 0o600))
+	config := web.DefaultClientConfig()
+	config.CAFiles = []string{caFile}
+	test.Nil(t, web.ConfigureClient(web.Vertex, config))
+	t.Cleanup(func() {
+		test.Nil(t, web.ConfigureClient(web.Vertex, web.DefaultClientConfig()))
+	})
+
+	accnt := auth.GetAccount()
+	auth.SetAccount(&auth.Account{ProjectId: "p"})
+	auth.UseFixedAccessToken("test")
+	t.Cleanup(func() {
+		auth.SetAccount(accnt)
+		auth.UseFixedAccessToken("")
+	})
+
+	original := cfg.GetDefaults()
+	deflts := *original
+	deflts.ApiEndpoint = server.Listener.Addr().String()
+	cfg.SetDefaults(&deflts)
+	t.Cleanup(func() { cfg.SetDefaults(original) })
+	return &deflts
+}
+
+// writeTestEvents writes the events of a streamed response.
+func writeTestEvents(w http.ResponseWriter, events ...string) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	for _, event := range events {
+		w.Write([]byte("data: " + event + "\r\n\r\n"))
+		w.(http.Flusher).Flush()
+	}
+}
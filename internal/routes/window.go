@@ -0,0 +1,176 @@
+package routes
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/prantlf/ovai/internal/log"
+)
+
+// contextWindowError is returned if the request doesn't fit the input limit.
+type contextWindowError struct {
+	model  string
+	tokens int
+	limit  int
+}
+
+func (e *contextWindowError) Error() string {
+	return fmt.Sprintf("request with about %d tokens exceeds the input limit %d of %s", e.tokens, e.limit, e.model)
+}
+
+// the fixed count of tokens for an image in gemini models
+const imageTokens = 258
+
+var contextGuard string // "", estimate, count
+var contextTruncate bool
+
+func SetContextGuard(guard string, truncate bool) error {
+	switch guard {
+	case "", "estimate", "count":
+	default:
+		return fmt.Errorf("invalid context guard: %q", guard)
+	}
+	contextGuard = guard
+	contextTruncate = truncate
+	return nil
+}
+
+func getInputTokenLimit(model string) int {
+	switch {
+	case strings.HasPrefix(model, "gemini-1.0-pro"):
+		return 32760
+	case strings.HasPrefix(model, "gemini-1.5-pro"):
+		return 2097152
+	case strings.HasPrefix(model, "gemini"):
+		return 1048576
+	}
+	return 0
+}
+
+func estimateContentTokens(content *geminiContent) int {
+	tokens := 4
+	for _, part := range content.Parts {
+		tokens += len(part.Text) / 4
+		if part.InlineData != nil {
+			tokens += imageTokens
+		}
+		if part.FunctionCall != nil {
+			call, _ := json.Marshal(part.FunctionCall)
+			tokens += len(call) / 4
+		}
+		if part.FunctionResponse != nil {
+			response, _ := json.Marshal(part.FunctionResponse)
+			tokens += len(response) / 4
+		}
+	}
+	return tokens
+}
+
+func estimateToolsTokens(tools []toolsWrapper) int {
+	if len(tools) == 0 {
+		return 0
+	}
+	declarations, _ := json.Marshal(tools)
+	return len(declarations) / 4
+}
+
+// groupTurns returns indexes of contents, where a turn starts, which can be
+// dropped together. A function call is kept with its responses.
+func groupTurns(contents []geminiContent) []int {
+	starts := make([]int, 0, len(contents))
+	for i, content := range contents {
+		if i > 0 && isFunctionResponse(&content) {
+			continue
+		}
+		starts = append(starts, i)
+	}
+	return starts
+}
+
+func isFunctionResponse(content *geminiContent) bool {
+	for _, part := range content.Parts {
+		if part.FunctionResponse != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// guardContextWindow checks that the request fits the input limit of the model
+// or of num_ctx, if set. If truncating is enabled, the oldest turns are dropped
+// instead of failing, keeping the system instruction and the last turn.
+func guardContextWindow(body *geminiBody, model string, numCtx *int) error {
+	if len(contextGuard) == 0 {
+		return nil
+	}
+	limit := getInputTokenLimit(model)
+	if numCtx != nil && *numCtx > 0 && (limit == 0 || *numCtx < limit) {
+		limit = *numCtx
+	}
+	if limit == 0 {
+		return nil
+	}
+
+	estimates := make([]int, len(body.Contents))
+	fixed := estimateToolsTokens(body.Tools)
+	if body.SystemInstruction != nil {
+		fixed += estimateContentTokens(body.SystemInstruction)
+	}
+	total := fixed
+	for i := range body.Contents {
+		estimates[i] = estimateContentTokens(&body.Contents[i])
+		total += estimates[i]
+	}
+	// the local estimate is scaled to the exact count to decide what to drop
+	scale := 1.0
+	if contextGuard == "count" {
+		_, output, err := countTokens(model, convertBodyToCountTokens(body))
+		if err != nil {
+			log.Dbg("! counting tokens failed: %v", err)
+		} else if total > 0 {
+			scale = float64(output.TotalTokens) / float64(total)
+			total = output.TotalTokens
+		}
+	}
+	if total <= limit {
+		return nil
+	}
+	if !contextTruncate {
+		return &contextWindowError{model: model, tokens: total, limit: limit}
+	}
+
+	starts := groupTurns(body.Contents)
+	remaining := float64(total)
+	first := 0
+	for _, start := range starts[1:] {
+		if int(remaining) <= limit && body.Contents[first].Role == "user" {
+			break
+		}
+		for i := first; i < start; i++ {
+			remaining -= float64(estimates[i]) * scale
+		}
+		first = start
+	}
+	if int(remaining) > limit || body.Contents[first].Role != "user" {
+		return &contextWindowError{model: model, tokens: int(remaining), limit: limit}
+	}
+	if log.IsDbg {
+		log.Dbg(": dropped %d of %d content%s to fit %d tokens", first, len(body.Contents),
+			log.GetPlural(len(body.Contents)), limit)
+	}
+	body.Contents = body.Contents[first:]
+	return nil
+}
+
+// failPreparing fails the request with the OpenAI error code for exceeding
+// the context window.
+func failPreparing(w http.ResponseWriter, r *http.Request, err error) int {
+	var windowErr *contextWindowError
+	if errors.As(err, &windowErr) {
+		return rejectRequest(w, r, http.StatusBadRequest, err.Error(), "context_length_exceeded")
+	}
+	return wrongInput(w, err.Error())
+}
@@ -0,0 +1,232 @@
+package web
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+type Upstream int
+
+const (
+	Vertex Upstream = iota
+	OAuth
+	Ollama
+	Media
+	Storage
+)
+
+var upstreamNames = [...]string{"vertex", "oauth", "ollama", "media", "storage"}
+
+func (u Upstream) String() string {
+	return upstreamNames[u]
+}
+
+type ClientConfig struct {
+	Network               string // IPV4, IPV6
+	MaxIdleConns          int
+	MaxIdleConnsPerHost   int
+	MaxConnsPerHost       int
+	DialTimeout           time.Duration
+	KeepAlive             time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+	IdleConnTimeout       time.Duration
+	HTTP2                 bool
+	Proxy                 string // URL with optional credentials, "direct" or empty for the environment
+	CAFiles               []string
+	PinnedKeys            []string // base64-encoded SHA-256 hashes of public keys
+}
+
+func DefaultClientConfig() ClientConfig {
+	return ClientConfig{
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 16,
+		DialTimeout:         10 * time.Second,
+		KeepAlive:           30 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+		IdleConnTimeout:     90 * time.Second,
+		HTTP2:               true,
+	}
+}
+
+// one long-lived client per upstream keeps the connections and TLS sessions alive
+var clients = initClients()
+
+func initClients() []*http.Client {
+	clients, err := newClients(DefaultClientConfig())
+	if err != nil {
+		panic(err)
+	}
+	return clients
+}
+
+func getNetworkVersion(network string) (string, error) {
+	switch network {
+	case "":
+		return "", nil
+	case "IPV4":
+		return "tcp4", nil
+	case "IPV6":
+		return "tcp6", nil
+	default:
+		return "", fmt.Errorf("invalid network: %q", network)
+	}
+}
+
+func loadRootCAs(caFiles []string) (*x509.CertPool, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	for _, caFile := range caFiles {
+		caPem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s failed: %v", caFile, err)
+		}
+		if !pool.AppendCertsFromPEM(caPem) {
+			return nil, fmt.Errorf("no certificate found in %s", caFile)
+		}
+	}
+	return pool, nil
+}
+
+func getProxy(proxy string) (func(*http.Request) (*url.URL, error), error) {
+	switch proxy {
+	case "":
+		return http.ProxyFromEnvironment, nil
+	case "direct":
+		return nil, nil
+	}
+	proxyUrl, err := url.Parse(proxy)
+	if err != nil || len(proxyUrl.Host) == 0 {
+		return nil, fmt.Errorf("invalid proxy: %q", RedactUrl(proxy))
+	}
+	switch proxyUrl.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("invalid proxy scheme: %q", proxyUrl.Scheme)
+	}
+	// credentials in the URL are sent in the header Proxy-Authorization
+	return http.ProxyURL(proxyUrl), nil
+}
+
+// RedactUrl hides the password, if the URL contains credentials.
+func RedactUrl(rawUrl string) string {
+	parsedUrl, err := url.Parse(rawUrl)
+	if err != nil {
+		return "(invalid URL)"
+	}
+	return parsedUrl.Redacted()
+}
+
+func verifyPinnedKeys(pinnedKeys []string) func(tls.ConnectionState) error {
+	pins := make([]string, len(pinnedKeys))
+	for i, pin := range pinnedKeys {
+		pins[i] = strings.TrimPrefix(pin, "sha256/")
+	}
+	return func(state tls.ConnectionState) error {
+		for _, chain := range state.VerifiedChains {
+			for _, cert := range chain {
+				sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+				if slices.Contains(pins, base64.StdEncoding.EncodeToString(sum[:])) {
+					return nil
+				}
+			}
+		}
+		return fmt.Errorf("no pinned public key found in the certificate chain of %s", state.ServerName)
+	}
+}
+
+func NewTransport(config ClientConfig) (*http.Transport, error) {
+	networkVersion, err := getNetworkVersion(config.Network)
+	if err != nil {
+		return nil, err
+	}
+	rootCAs, err := loadRootCAs(config.CAFiles)
+	if err != nil {
+		return nil, err
+	}
+	proxy, err := getProxy(config.Proxy)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{
+		Timeout:   config.DialTimeout,
+		KeepAlive: config.KeepAlive,
+	}
+	transport := &http.Transport{
+		Proxy: proxy,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if len(networkVersion) > 0 {
+				network = networkVersion
+			}
+			return dialer.DialContext(ctx, network, addr)
+		},
+		TLSClientConfig: &tls.Config{
+			RootCAs:            rootCAs,
+			ClientSessionCache: tls.NewLRUClientSessionCache(0),
+		},
+		ForceAttemptHTTP2:     config.HTTP2,
+		MaxIdleConns:          config.MaxIdleConns,
+		MaxIdleConnsPerHost:   config.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       config.MaxConnsPerHost,
+		TLSHandshakeTimeout:   config.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: config.ResponseHeaderTimeout,
+		IdleConnTimeout:       config.IdleConnTimeout,
+		ExpectContinueTimeout: time.Second,
+	}
+	if len(config.PinnedKeys) > 0 {
+		transport.TLSClientConfig.VerifyConnection = verifyPinnedKeys(config.PinnedKeys)
+	}
+	if !config.HTTP2 {
+		// a non-nil empty map disables the automatic upgrade to HTTP/2
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return transport, nil
+}
+
+func NewClient(config ClientConfig) (*http.Client, error) {
+	transport, err := NewTransport(config)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+func newClients(config ClientConfig) ([]*http.Client, error) {
+	newClients := make([]*http.Client, len(upstreamNames))
+	for i := range newClients {
+		client, err := NewClient(config)
+		if err != nil {
+			return nil, err
+		}
+		newClients[i] = client
+	}
+	return newClients, nil
+}
+
+// ConfigureClient replaces the client for the upstream. It is supposed
+// to be called before the server starts.
+func ConfigureClient(upstream Upstream, config ClientConfig) error {
+	client, err := NewClient(config)
+	if err != nil {
+		return fmt.Errorf("configuring %s client failed: %v", upstream, err)
+	}
+	clients[upstream] = client
+	return nil
+}
+
+func GetClient(upstream Upstream) *http.Client {
+	return clients[upstream]
+}
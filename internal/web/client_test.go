@@ -0,0 +1,123 @@
+package web
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/pem"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/prantlf/ovai/internal/test"
+)
+
+func startConnectProxy(authorization string, tunnels *atomic.Int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if r.Header.Get("Proxy-Authorization") != authorization {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		target, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		client, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			target.Close()
+			return
+		}
+		tunnels.Add(1)
+		go func() {
+			_, _ = io.Copy(target, client)
+			target.Close()
+		}()
+		go func() {
+			_, _ = io.Copy(client, target)
+			client.Close()
+		}()
+	}))
+}
+
+func startTarget(t *testing.T) (*httptest.Server, string) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	caPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	test.Nil(t, os.WriteFile(caFile, caPem, 0o644))
+	return server, caFile
+}
+
+func get(client *http.Client, url string) (string, error) {
+	res, err := client.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	return string(body), err
+}
+
+func TestClientThroughProxy(t *testing.T) {
+	target, caFile := startTarget(t)
+	defer target.Close()
+	var tunnels atomic.Int32
+	auth := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:secret"))
+	proxy := startConnectProxy(auth, &tunnels)
+	defer proxy.Close()
+
+	config := DefaultClientConfig()
+	config.CAFiles = []string{caFile}
+	config.Proxy = "http://user:secret@" + proxy.Listener.Addr().String()
+	client, err := NewClient(config)
+	test.Nil(t, err)
+	body, err := get(client, target.URL)
+	test.Nil(t, err)
+	test.Equal(t, "ok", body)
+	test.Equal(t, int32(1), tunnels.Load())
+
+	config.Proxy = "http://user:wrong@" + proxy.Listener.Addr().String()
+	client, err = NewClient(config)
+	test.Nil(t, err)
+	_, err = get(client, target.URL)
+	test.NotNil(t, err)
+}
+
+func TestClientPinnedKeys(t *testing.T) {
+	target, caFile := startTarget(t)
+	defer target.Close()
+	sum := sha256.Sum256(target.Certificate().RawSubjectPublicKeyInfo)
+
+	config := DefaultClientConfig()
+	config.CAFiles = []string{caFile}
+	config.Proxy = "direct"
+	config.PinnedKeys = []string{"sha256/" + base64.StdEncoding.EncodeToString(sum[:])}
+	client, err := NewClient(config)
+	test.Nil(t, err)
+	_, err = get(client, target.URL)
+	test.Nil(t, err)
+
+	config.PinnedKeys = []string{"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="}
+	client, err = NewClient(config)
+	test.Nil(t, err)
+	_, err = get(client, target.URL)
+	test.NotNil(t, err)
+}
+
+func TestInvalidProxy(t *testing.T) {
+	config := DefaultClientConfig()
+	config.Proxy = "ftp://proxy"
+	_, err := NewClient(config)
+	test.NotNil(t, err)
+}
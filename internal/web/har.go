@@ -0,0 +1,86 @@
+package web
+
+// Recordings are stored in the HTTP Archive format (HAR 1.2) like the archive
+// in bench, with the timing of the response chunks in the custom property
+// _chunks of the entry.
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harCache struct{}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harRequest struct {
+	Method      string `json:"method"`
+	Url         string `json:"url"`
+	HttpVersion string `json:"httpVersion"`
+
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	Cookies     []harNameValue `json:"cookies"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+}
+
+type harContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HttpVersion string         `json:"httpVersion"`
+	Headers     []harNameValue `json:"headers"`
+	Cookies     []harNameValue `json:"cookies"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// harChunk is a part of the response body received at once, the time is in
+// milliseconds since the request started.
+type harChunk struct {
+	Time float64 `json:"time"`
+	Size int     `json:"size"`
+}
+
+type harEntry struct {
+	Cache           harCache    `json:"cache"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Timings         harTimings  `json:"timings"`
+	Chunks          []harChunk  `json:"_chunks"`
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type har struct {
+	Log harLog `json:"log"`
+}
@@ -0,0 +1,437 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/prantlf/ovai/internal/log"
+)
+
+// recorder saves the exchanges with the upstream to files, or serves
+// the responses from the files instead of calling the upstream.
+type recorder struct {
+	transport http.RoundTripper
+	replay    bool
+	dir       string
+	miss      string // fail, passthrough, closest
+	timing    bool
+}
+
+// recordingBody saves the exchange, when the response body was read completely,
+// or when it is closed, after the rest of it is read.
+type recordingBody struct {
+	io.ReadCloser
+	recorder *recorder
+	key      string
+	entry    *harEntry
+	start    time.Time
+	buffer   bytes.Buffer
+	saved    bool
+}
+
+// replayingBody returns the recorded chunks of the response body, optionally
+// at the recorded times.
+type replayingBody struct {
+	ctx    context.Context
+	text   string
+	chunks []harChunk
+	start  time.Time
+	timing bool
+}
+
+// the project and location of the model are ignored, when matching requests
+var locationPattern = regexp.MustCompile(`projects/[^/"]+/locations/[^/"]+/`)
+
+// SetRecording makes the client of the upstream record the exchanges to the
+// directory (record), or replay them from it (replay). It is supposed to be
+// called after ConfigureClient.
+func SetRecording(upstream Upstream, mode string, dir string, miss string, timing bool) error {
+	switch mode {
+	case "":
+		return nil
+	case "record", "replay":
+	default:
+		return fmt.Errorf("invalid recording mode: %q", mode)
+	}
+	switch miss {
+	case "fail", "passthrough", "closest":
+	default:
+		return fmt.Errorf("invalid behaviour on a missing recording: %q", miss)
+	}
+	if mode == "record" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return fmt.Errorf("creating %s failed: %v", dir, err)
+		}
+	}
+	client := clients[upstream]
+	transport := client.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	clients[upstream] = &http.Client{
+		Transport: &recorder{
+			transport: transport,
+			replay:    mode == "replay",
+			dir:       dir,
+			miss:      miss,
+			timing:    timing,
+		},
+		Timeout: client.Timeout,
+	}
+	return nil
+}
+
+func normaliseLocation(text string) string {
+	return locationPattern.ReplaceAllString(text, "projects/-/locations/-/")
+}
+
+func getRecordingKey(method string, url string, body string) string {
+	hash := sha256.New()
+	hash.Write([]byte(method))
+	hash.Write([]byte{' '})
+	hash.Write([]byte(normaliseLocation(url)))
+	hash.Write([]byte{0})
+	hash.Write([]byte(normaliseLocation(body)))
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// getRequestUrl returns the URL without the host, which depends on the location.
+func getRequestUrl(req *http.Request) string {
+	return req.URL.RequestURI()
+}
+
+func readRequestBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil {
+		return nil, nil
+	}
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	if err := req.Body.Close(); err != nil {
+		log.Dbg("closing request body stream failed: %v", err)
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	return body, nil
+}
+
+func getMilliseconds(duration time.Duration) float64 {
+	return float64(duration.Microseconds()) / 1000
+}
+
+// copyHeader copies only the content type, to leave out tokens and cookies.
+func copyHeader(header http.Header) []harNameValue {
+	headers := []harNameValue{}
+	if contentType := header.Get("Content-Type"); len(contentType) > 0 {
+		headers = append(headers, harNameValue{Name: "Content-Type", Value: contentType})
+	}
+	return headers
+}
+
+func newHarEntry(req *http.Request, body []byte, res *http.Response, start time.Time) *harEntry {
+	entry := &harEntry{
+		Request: harRequest{
+			Method:      req.Method,
+			Url:         req.URL.String(),
+			HttpVersion: req.Proto,
+			Headers:     copyHeader(req.Header),
+			QueryString: []harNameValue{},
+			Cookies:     []harNameValue{},
+			HeadersSize: -1,
+			BodySize:    int64(len(body)),
+		},
+		Response: harResponse{
+			Status:      res.StatusCode,
+			StatusText:  http.StatusText(res.StatusCode),
+			HttpVersion: res.Proto,
+			Headers:     copyHeader(res.Header),
+			Cookies:     []harNameValue{},
+			Content: harContent{
+				MimeType: res.Header.Get("Content-Type"),
+			},
+			HeadersSize: -1,
+		},
+		StartedDateTime: start.UTC().Format(time.RFC3339Nano),
+		Timings: harTimings{
+			Wait: getMilliseconds(time.Since(start)),
+		},
+		Chunks: []harChunk{},
+	}
+	for name, values := range req.URL.Query() {
+		for _, value := range values {
+			entry.Request.QueryString = append(entry.Request.QueryString, harNameValue{Name: name, Value: value})
+		}
+	}
+	if body != nil {
+		entry.Request.PostData = &harPostData{
+			MimeType: req.Header.Get("Content-Type"),
+			Text:     string(body),
+		}
+	}
+	return entry
+}
+
+func (b *recordingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.entry.Chunks = append(b.entry.Chunks, harChunk{
+			Time: getMilliseconds(time.Since(b.start)),
+			Size: n,
+		})
+		b.buffer.Write(p[:n])
+	}
+	if err == io.EOF && !b.saved {
+		b.saved = true
+		b.recorder.save(b.key, b.entry, &b.buffer, b.start)
+	}
+	return n, err
+}
+
+func (b *recordingBody) Close() error {
+	// the stream loops stop reading after the last finish reason
+	if !b.saved {
+		if _, err := io.Copy(io.Discard, b); err != nil {
+			log.Dbg("! reading rest of response body failed: %v", err)
+		}
+	}
+	return b.ReadCloser.Close()
+}
+
+func (r *recorder) save(key string, entry *harEntry, body *bytes.Buffer, start time.Time) {
+	entry.Time = getMilliseconds(time.Since(start))
+	entry.Timings.Receive = entry.Time - entry.Timings.Wait
+	entry.Response.Content.Text = body.String()
+	entry.Response.Content.Size = int64(body.Len())
+	entry.Response.BodySize = int64(body.Len())
+	content, err := json.MarshalIndent(&har{
+		Log: harLog{
+			Version: "1.2",
+			Creator: harCreator{Name: "ovai"},
+			Entries: []harEntry{*entry},
+		},
+	}, "", "  ")
+	if err != nil {
+		log.Dbg("! encoding recording failed: %v", err)
+		return
+	}
+	file := filepath.Join(r.dir, key+".har")
+	// a recording read at the same time must not be incomplete
+	temp := file + ".tmp"
+	if err := os.WriteFile(temp, content, 0o644); err != nil {
+		log.Log("writing %s failed: %v", temp, err)
+		return
+	}
+	if err := os.Rename(temp, file); err != nil {
+		log.Log("renaming %s failed: %v", temp, err)
+		return
+	}
+	log.Dbg(": record %s %s to %s", entry.Request.Method, entry.Request.Url, file)
+}
+
+func loadRecording(file string) (*harEntry, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var archive har
+	if err := json.Unmarshal(content, &archive); err != nil {
+		return nil, fmt.Errorf("decoding %s failed: %v", file, err)
+	}
+	if len(archive.Log.Entries) == 0 {
+		return nil, fmt.Errorf("no entry in %s", file)
+	}
+	return &archive.Log.Entries[0], nil
+}
+
+func getCommonPrefix(first string, second string) int {
+	length := min(len(first), len(second))
+	for i := 0; i < length; i++ {
+		if first[i] != second[i] {
+			return i
+		}
+	}
+	return length
+}
+
+// findClosestRecording returns the recording of the request with the same
+// method and URL, which body has the longest common beginning with the body
+// of the request.
+func (r *recorder) findClosestRecording(method string, url string, body string) (*harEntry, string) {
+	files, err := filepath.Glob(filepath.Join(r.dir, "*.har"))
+	if err != nil {
+		return nil, ""
+	}
+	url = normaliseLocation(url)
+	body = normaliseLocation(body)
+	var closest *harEntry
+	var closestFile string
+	var closestPrefix, closestDiff int
+	for _, file := range files {
+		entry, err := loadRecording(file)
+		if err != nil {
+			log.Dbg("! %v", err)
+			continue
+		}
+		request := &entry.Request
+		if request.Method != method || !strings.HasSuffix(normaliseLocation(request.Url), url) {
+			continue
+		}
+		var recorded string
+		if request.PostData != nil {
+			recorded = normaliseLocation(request.PostData.Text)
+		}
+		prefix := getCommonPrefix(body, recorded)
+		diff := len(body) - len(recorded)
+		if diff < 0 {
+			diff = -diff
+		}
+		if closest == nil || prefix > closestPrefix || prefix == closestPrefix && diff < closestDiff {
+			closest, closestFile, closestPrefix, closestDiff = entry, file, prefix, diff
+		}
+	}
+	return closest, closestFile
+}
+
+func (b *replayingBody) Read(p []byte) (int, error) {
+	if len(b.chunks) == 0 {
+		if len(b.text) == 0 {
+			return 0, io.EOF
+		}
+		// the recording was edited, the rest of the text makes the last chunk
+		b.chunks = []harChunk{{Size: len(b.text)}}
+	}
+	chunk := &b.chunks[0]
+	if b.timing {
+		if delay := time.Until(b.start.Add(time.Duration(chunk.Time * float64(time.Millisecond)))); delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-b.ctx.Done():
+				return 0, b.ctx.Err()
+			}
+		}
+	}
+	size := min(len(p), chunk.Size, len(b.text))
+	n := copy(p, b.text[:size])
+	b.text = b.text[n:]
+	chunk.Size -= n
+	if chunk.Size <= 0 {
+		b.chunks = b.chunks[1:]
+	}
+	return n, nil
+}
+
+func (b *replayingBody) Close() error {
+	return nil
+}
+
+func newReplayedResponse(req *http.Request, entry *harEntry, timing bool) (*http.Response, error) {
+	start := time.Now()
+	if timing && entry.Timings.Wait > 0 {
+		select {
+		case <-time.After(time.Duration(entry.Timings.Wait * float64(time.Millisecond))):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+	header := make(http.Header)
+	for _, pair := range entry.Response.Headers {
+		header.Add(pair.Name, pair.Value)
+	}
+	chunks := make([]harChunk, len(entry.Chunks))
+	copy(chunks, entry.Chunks)
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", entry.Response.Status, entry.Response.StatusText),
+		StatusCode:    entry.Response.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		ContentLength: int64(len(entry.Response.Content.Text)),
+		Body: &replayingBody{
+			ctx:    req.Context(),
+			text:   entry.Response.Content.Text,
+			chunks: chunks,
+			start:  start,
+			timing: timing,
+		},
+		Request: req,
+	}, nil
+}
+
+func newMissingResponse(req *http.Request) *http.Response {
+	msg := fmt.Sprintf("no recording of %s %s", req.Method, getRequestUrl(req))
+	body, _ := json.Marshal(&responseErrorComplex{Error: errorObj{Message: msg}})
+	header := make(http.Header)
+	header.Set("Content-Type", "application/json")
+	return &http.Response{
+		Status:        "404 Not Found",
+		StatusCode:    http.StatusNotFound,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		ContentLength: int64(len(body)),
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		Request:       req,
+	}
+}
+
+func (r *recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := readRequestBody(req)
+	if err != nil {
+		return nil, err
+	}
+	url := getRequestUrl(req)
+	key := getRecordingKey(req.Method, url, string(body))
+	if !r.replay {
+		start := time.Now()
+		res, err := r.transport.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+		res.Body = &recordingBody{
+			ReadCloser: res.Body,
+			recorder:   r,
+			key:        key,
+			entry:      newHarEntry(req, body, res, start),
+			start:      start,
+		}
+		return res, nil
+	}
+	file := filepath.Join(r.dir, key+".har")
+	entry, err := loadRecording(file)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		switch r.miss {
+		case "passthrough":
+			log.Dbg("! pass %s %s through without recording", req.Method, url)
+			return r.transport.RoundTrip(req)
+		case "closest":
+			if entry, file = r.findClosestRecording(req.Method, url, string(body)); entry == nil {
+				log.Dbg("! no recording of %s %s", req.Method, url)
+				return newMissingResponse(req), nil
+			}
+		default:
+			log.Dbg("! no recording of %s %s", req.Method, url)
+			return newMissingResponse(req), nil
+		}
+	}
+	log.Dbg(": replay %s %s from %s", req.Method, url, file)
+	return newReplayedResponse(req, entry, r.timing)
+}
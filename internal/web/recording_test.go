@@ -0,0 +1,89 @@
+package web
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prantlf/ovai/internal/test"
+)
+
+func exchange(t *testing.T, client *http.Client, url string, body string) (int, string) {
+	req, err := CreateRawPostRequest(url, []byte(body))
+	test.Nil(t, err)
+	req.Header.Set("Authorization", "Bearer secret")
+	res, err := client.Do(req)
+	test.Nil(t, err)
+	defer res.Body.Close()
+	content, err := io.ReadAll(res.Body)
+	test.Nil(t, err)
+	return res.StatusCode, string(content)
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: 1\r\n\r\n"))
+		w.(http.Flusher).Flush()
+		w.Write([]byte("data: 2\r\n\r\n"))
+	}))
+	dir := t.TempDir()
+	url := server.URL + "/v1/projects/one/locations/here/publishers/google/models/m:streamGenerateContent?alt=sse"
+	rec := &recorder{transport: http.DefaultTransport, dir: dir}
+	status, content := exchange(t, &http.Client{Transport: rec}, url, `{"contents":"a"}`)
+	test.Equal(t, http.StatusOK, status)
+	test.Equal(t, "data: 1\r\n\r\ndata: 2\r\n\r\n", content)
+	server.Close()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.har"))
+	test.Equal(t, 1, len(files))
+	entry, err := loadRecording(files[0])
+	test.Nil(t, err)
+	// the authorization header is left out
+	test.Equal(t, 1, len(entry.Request.Headers))
+	test.Equal(t, "Content-Type", entry.Request.Headers[0].Name)
+	test.Equal(t, true, len(entry.Chunks) > 0)
+
+	// the project and location differ, the host is not reachable any more
+	url = "https://example.com/v1/projects/two/locations/there/publishers/google/models/m:streamGenerateContent?alt=sse"
+	rec = &recorder{replay: true, dir: dir, miss: "fail"}
+	status, content = exchange(t, &http.Client{Transport: rec}, url, `{"contents":"a"}`)
+	test.Equal(t, http.StatusOK, status)
+	test.Equal(t, "data: 1\r\n\r\ndata: 2\r\n\r\n", content)
+
+	status, content = exchange(t, &http.Client{Transport: rec}, url, `{"contents":"b"}`)
+	test.Equal(t, http.StatusNotFound, status)
+	test.Equal(t, true, strings.Contains(content, "no recording of POST"))
+
+	rec.miss = "closest"
+	status, _ = exchange(t, &http.Client{Transport: rec}, url, `{"contents":"b"}`)
+	test.Equal(t, http.StatusOK, status)
+}
+
+func TestRecordUnfinishedRead(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: 1\r\n\r\n"))
+		w.(http.Flusher).Flush()
+		w.Write([]byte("data: 2\r\n\r\n"))
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	req, err := CreateRawPostRequest(server.URL+"/v1/m:streamGenerateContent", []byte(`{}`))
+	test.Nil(t, err)
+	res, err := (&http.Client{Transport: &recorder{transport: http.DefaultTransport, dir: dir}}).Do(req)
+	test.Nil(t, err)
+	// the reading stops before the end of the body
+	_, err = res.Body.Read(make([]byte, 4))
+	test.Nil(t, err)
+	test.Nil(t, res.Body.Close())
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.har"))
+	test.Equal(t, 1, len(files))
+	entry, err := loadRecording(files[0])
+	test.Nil(t, err)
+	test.Equal(t, "data: 1\r\n\r\ndata: 2\r\n\r\n", entry.Response.Content.Text)
+}
@@ -2,13 +2,11 @@ package web
 
 import (
 	"bytes"
-	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
-	"net"
 	"net/http"
-	"os"
 
 	"github.com/prantlf/ovai/internal/log"
 )
@@ -64,12 +62,20 @@ func readError(req *http.Request, res *http.Response) string {
 }
 
 func CreatePostRequest(url string, input interface{}) (*http.Request, error) {
+	return createJsonRequest("POST", url, input)
+}
+
+func CreatePatchRequest(url string, input interface{}) (*http.Request, error) {
+	return createJsonRequest("PATCH", url, input)
+}
+
+func createJsonRequest(method string, url string, input interface{}) (*http.Request, error) {
 	if log.IsNet {
 		inputJson, errLog := json.MarshalIndent(input, "", "  ")
 		if errLog != nil {
-			log.Net("send POST %s\n with body %+v", url, input)
+			log.Net("send %s %s\n with body %+v", method, url, input)
 		} else {
-			log.Net("send POST %s\n with body %s", url, inputJson)
+			log.Net("send %s %s\n with body %s", method, url, inputJson)
 		}
 	}
 	reader, writer := io.Pipe()
@@ -82,7 +88,7 @@ func CreatePostRequest(url string, input interface{}) (*http.Request, error) {
 		}
 	}()
 
-	req, err := http.NewRequest("POST", url, reader)
+	req, err := http.NewRequest(method, url, reader)
 	if err != nil {
 		log.Dbg("preparing request failed: %v", err)
 		return nil, errors.New("preparing request failed")
@@ -93,8 +99,16 @@ func CreatePostRequest(url string, input interface{}) (*http.Request, error) {
 }
 
 func CreateGetRequest(url string) (*http.Request, error) {
-	log.Net("send GET %s", url)
-	req, err := http.NewRequest("GET", url, nil)
+	return createEmptyRequest("GET", url)
+}
+
+func CreateDeleteRequest(url string) (*http.Request, error) {
+	return createEmptyRequest("DELETE", url)
+}
+
+func createEmptyRequest(method string, url string) (*http.Request, error) {
+	log.Net("send %s %s", method, url)
+	req, err := http.NewRequest(method, url, nil)
 	if err != nil {
 		log.Dbg("preparing request failed: %v", err)
 		return nil, errors.New("preparing request failed")
@@ -124,73 +138,64 @@ func CreateRawPostRequest(url string, input []byte) (*http.Request, error) {
 	return req, nil
 }
 
-func WriteResponseString(w http.ResponseWriter, text string) bool {
-	if _, err := w.Write([]byte(text)); err != nil {
-		log.Dbg("! writing response body failed: %v", err)
-		return false
+// FetchContent downloads the content of the URL and returns it with its
+// content type. The download fails if the content exceeds the size limit.
+// Redirects are followed only if checkRedirect accepts the next request,
+// they are not followed at all if checkRedirect is nil.
+func FetchContent(upstream Upstream, url string, limit int64, checkRedirect func(*http.Request) error) (string, []byte, error) {
+	req, err := createEmptyRequest("GET", url)
+	if err != nil {
+		return "", nil, err
 	}
-	return true
-}
-
-// type happyEyeballs int
-
-// const (
-// 	ipDefault happyEyeballs = iota + 1
-// 	ipV4
-// 	ipV6
-// )
-
-// var happyEyeballNames = [...]string{"Default", "IPV4", "IPV6"}
-
-// func (h happyEyeballs) String() string {
-// 	return happyEyeballNames[h-1]
-// }
-
-// func (h happyEyeballs) EnumIndex() int {
-// 	return int(h)
-// }
-
-// func parseHappyEyeballs(input string) (happyEyeballs, error) {
-// 	for index, value := range happyEyeballNames {
-// 		if value == input {
-// 			return happyEyeballs(index), nil
-// 		}
-// 	}
-// 	return 0, fmt.Errorf("invalid enum value: %q", input)
-// }
-
-var dialer net.Dialer
-var networkVersion = initDialer()
-
-func initDialer() string {
-	network := os.Getenv("NETWORK")
-	if len(network) > 0 {
-		if network == "IPV4" {
-			return "tcp4"
+	req.Header.Set("Accept", "*/*")
+	client := *GetClient(upstream)
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if checkRedirect == nil {
+			return fmt.Errorf("redirect to %s not allowed", req.URL.Redacted())
 		}
-		if network == "IPV6" {
-			return "tcp6"
+		if len(via) >= 10 {
+			return errors.New("too many redirects")
 		}
-		log.Ftl("Invalid value of NETWORK variable: %q", network)
+		return checkRedirect(req)
 	}
-	return ""
+	res, err := client.Do(req)
+	if err != nil {
+		log.Dbg("making request failed: %v", err)
+		return "", nil, fmt.Errorf("fetching %s failed", url)
+	}
+	defer func() {
+		if err := res.Body.Close(); err != nil {
+			log.Dbg("closing response body stream failed: %v", err)
+		}
+	}()
+	if res.StatusCode != http.StatusOK {
+		return "", nil, fmt.Errorf("fetching %s failed: %s", url, res.Status)
+	}
+	if res.ContentLength > limit {
+		return "", nil, fmt.Errorf("content of %s larger than %d bytes", url, limit)
+	}
+	content, err := io.ReadAll(io.LimitReader(res.Body, limit+1))
+	if err != nil {
+		log.Dbg("reading response body failed: %v", err)
+		return "", nil, fmt.Errorf("fetching %s failed", url)
+	}
+	if int64(len(content)) > limit {
+		return "", nil, fmt.Errorf("content of %s larger than %d bytes", url, limit)
+	}
+	log.Net("receive %d byte%s from %s", len(content), log.GetPlural(len(content)), url)
+	return res.Header.Get("Content-Type"), content, nil
 }
 
-func createHttpClient() *http.Client {
-	client := &http.Client{}
-	if len(networkVersion) > 0 {
-		transport := http.DefaultTransport.(*http.Transport).Clone()
-		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
-			return dialer.DialContext(ctx, networkVersion, addr)
-		}
-		client.Transport = transport
+func WriteResponseString(w http.ResponseWriter, text string) bool {
+	if _, err := w.Write([]byte(text)); err != nil {
+		log.Dbg("! writing response body failed: %v", err)
+		return false
 	}
-	return client
+	return true
 }
 
-func DispatchRequest(req *http.Request, output interface{}) (int, error) {
-	client := createHttpClient()
-	res, err := client.Do(req)
+func DispatchRequest(upstream Upstream, req *http.Request, output interface{}) (int, error) {
+	res, err := GetClient(upstream).Do(req)
 	if err != nil {
 		log.Dbg("making request failed: %v", err)
 		return http.StatusInternalServerError, errors.New("making request failed")
@@ -236,9 +241,8 @@ func DispatchRequest(req *http.Request, output interface{}) (int, error) {
 	return http.StatusOK, nil
 }
 
-func BeginRawRequest(req *http.Request) (int, io.ReadCloser, error) {
-	client := createHttpClient()
-	res, err := client.Do(req)
+func BeginRawRequest(upstream Upstream, req *http.Request) (int, io.ReadCloser, error) {
+	res, err := GetClient(upstream).Do(req)
 	if err != nil {
 		log.Dbg("making request failed: %v", err)
 		return http.StatusInternalServerError, nil, errors.New("making request failed")
@@ -260,8 +264,8 @@ func BeginRawRequest(req *http.Request) (int, io.ReadCloser, error) {
 	return http.StatusOK, res.Body, nil
 }
 
-func DispatchRawRequest(req *http.Request) (int, []byte, error) {
-	status, resReader, err := BeginRawRequest(req)
+func DispatchRawRequest(upstream Upstream, req *http.Request) (int, []byte, error) {
+	status, resReader, err := BeginRawRequest(upstream, req)
 	if err != nil {
 		return status, nil, err
 	}
@@ -0,0 +1,62 @@
+package web
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prantlf/ovai/internal/test"
+)
+
+func TestFetchContent(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Write([]byte("%PDF-1.4"))
+	}))
+	defer server.Close()
+
+	contentType, content, err := FetchContent(Media, server.URL, 8, nil)
+	test.Nil(t, err)
+	test.Equal(t, "application/pdf", contentType)
+	test.Equal(t, "%PDF-1.4", string(content))
+
+	_, _, err = FetchContent(Media, server.URL, 7, nil)
+	test.NotNil(t, err)
+}
+
+func TestFetchContentFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	_, _, err := FetchContent(Media, server.URL, 8, nil)
+	test.NotNil(t, err)
+}
+
+func TestFetchContentRedirect(t *testing.T) {
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("secret"))
+	}))
+	defer internal.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, internal.URL+"/metadata", http.StatusFound)
+	}))
+	defer server.Close()
+
+	// redirects are not followed without a check
+	_, _, err := FetchContent(Media, server.URL, 8, nil)
+	test.NotNil(t, err)
+
+	_, _, err = FetchContent(Media, server.URL, 8, func(req *http.Request) error {
+		return errors.New("not allowed")
+	})
+	test.NotNil(t, err)
+
+	_, content, err := FetchContent(Media, server.URL, 8, func(req *http.Request) error {
+		return nil
+	})
+	test.Nil(t, err)
+	test.Equal(t, "secret", string(content))
+}
@@ -0,0 +1,109 @@
+package web
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prantlf/ovai/internal/log"
+)
+
+type certificateReloader struct {
+	certFile string
+	keyFile  string
+	lock     sync.Mutex
+	cert     *tls.Certificate
+	modTime  time.Time
+	checked  time.Time
+}
+
+func latestModTime(files ...string) (time.Time, error) {
+	var latest time.Time
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return latest, err
+		}
+		if modTime := info.ModTime(); modTime.After(latest) {
+			latest = modTime
+		}
+	}
+	return latest, nil
+}
+
+func (r *certificateReloader) load() error {
+	modTime, err := latestModTime(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("loading %s failed: %v", r.certFile, err)
+	}
+	r.cert = &cert
+	r.modTime = modTime
+	return nil
+}
+
+// getCertificate loads the certificate again, if its files changed, checking
+// them at most once a second. The previous certificate is kept on errors.
+func (r *certificateReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if now := time.Now(); now.Sub(r.checked) >= time.Second {
+		r.checked = now
+		if modTime, err := latestModTime(r.certFile, r.keyFile); err == nil && !modTime.Equal(r.modTime) {
+			if err := r.load(); err != nil {
+				log.Log("keep previous %s: %v", r.certFile, err)
+			} else {
+				log.Log("reloaded %s", r.certFile)
+			}
+		}
+	}
+	return r.cert, nil
+}
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	caPem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s failed: %v", caFile, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPem) {
+		return nil, fmt.Errorf("no certificate found in %s", caFile)
+	}
+	return pool, nil
+}
+
+// NewServerTLSConfig prepares serving HTTPS with the certificate reloaded on
+// change and, if the client CA is set, requiring verified client certificates.
+func NewServerTLSConfig(certFile string, keyFile string, clientCAFile string) (*tls.Config, error) {
+	if len(certFile) == 0 || len(keyFile) == 0 {
+		return nil, errors.New("certificate and private key missing")
+	}
+	reloader := &certificateReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		checked:  time.Now(),
+	}
+	if err := reloader.load(); err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.getCertificate,
+	}
+	if len(clientCAFile) > 0 {
+		pool, err := loadCertPool(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}